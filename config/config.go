@@ -1,9 +1,14 @@
 package config
 
-import "os"
+import (
+	"os"
+	"runtime"
+	"strconv"
+)
 
 type Config struct {
-	DB *DBConfig
+	DB     *DBConfig
+	Ingest *IngestConfig
 }
 
 type DBConfig struct {
@@ -14,6 +19,23 @@ type DBConfig struct {
 	DBname   string
 }
 
+// Settings for loading uploaded files into the database
+type IngestConfig struct {
+	// Rows written per INSERT statement, capped by ingestion so a statement
+	// never binds more parameters than Postgres allows
+	BatchSize int
+	Workers   int
+	// Directory background uploads wait in until processed, kept across
+	// restarts for unfinished jobs to resume. Background uploads are
+	// disabled when unset.
+	SpoolDir string
+	// Most bytes a compressed upload or archive entry may expand to
+	MaxDecompressedSize int64
+}
+
+// Default most bytes a compressed upload may expand to, 1 GiB
+const DefaultMaxDecompressedSize = 1 << 30
+
 func GetConfig() *Config {
 	return &Config{
 		DB: &DBConfig{
@@ -23,5 +45,23 @@ func GetConfig() *Config {
 			Host:     os.Getenv("DB_HOST"),
 			DBname:   os.Getenv("DB_NAME"),
 		},
+		Ingest: &IngestConfig{
+			BatchSize: intFromEnv("INGEST_BATCH_SIZE", 1000),
+			Workers:   intFromEnv("INGEST_WORKERS", runtime.NumCPU()),
+			SpoolDir:  os.Getenv("UPLOAD_SPOOL_DIR"),
+
+			MaxDecompressedSize: int64(intFromEnv("UPLOAD_MAX_DECOMPRESSED_SIZE", DefaultMaxDecompressedSize)),
+		},
 	}
 }
+
+// Reads an integer environment variable, falling back to def when unset or invalid
+func intFromEnv(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+
+	if err != nil || v <= 0 {
+		return def
+	}
+
+	return v
+}
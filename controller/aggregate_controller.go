@@ -0,0 +1,429 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/gorilla/mux"
+	"github.com/pborman/uuid"
+	"github.com/phankanp/csv-to-json/auth"
+	"github.com/phankanp/csv-to-json/model"
+	"github.com/phankanp/csv-to-json/response"
+)
+
+// Aggregates the rows of a document, grouped by the columns in group and
+// computing the aggregates in agg, over rows matching filter or column and data
+func (server *Server) AggregateDocumentRows(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	apiKey := r.Context().Value("key").(string)
+	username := vars["username"]
+	docID := vars["docID"]
+
+	user := &model.User{}
+	retrievedUser, err := user.AuthenticateUser(server.DB, username)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ok := auth.CheckPasswordHash(retrievedUser.AuthKey, apiKey)
+
+	if !ok {
+		err = errors.New("invalid api key")
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	document := &model.Document{}
+	retrievedDocument, err := document.GetDocumentByID(server.DB, uuid.Parse(docID))
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if !uuid.Equal(retrievedDocument.UserID, retrievedUser.ID) {
+		err = errors.New("document belongs to another user")
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	q, err := aggregateQuery(r, retrievedDocument)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format, err := response.NegotiateFormat(r)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := retrievedDocument.Aggregate(server.DB, q)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if format.Name == response.JSON.Name {
+		response.JsonResponse(w, http.StatusOK, result)
+		return
+	}
+
+	response.FormatHeaders(w, format, retrievedDocument.Title, false)
+	w.WriteHeader(http.StatusOK)
+
+	err = writeAggregate(w, format, retrievedDocument.Title, result)
+
+	if err != nil {
+		log.Printf("writing aggregate of document %s: %s", retrievedDocument.ID, err)
+	}
+}
+
+// Writes each group of an aggregation in a format
+func writeAggregate(w http.ResponseWriter, f response.Format, title string, result *model.AggregateResult) error {
+	encoder, err := f.NewEncoder(w, result.Columns, response.EncoderOptions{Title: title})
+
+	if err != nil {
+		return err
+	}
+
+	for i, group := range result.Groups() {
+		err = encoder.Encode(group, result.Rows[i])
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return encoder.Close()
+}
+
+// Reads group, agg, filter, column and data query parameters for an
+// aggregation of a document's rows
+func aggregateQuery(r *http.Request, d *model.Document) (model.AggregateQuery, error) {
+	params := r.URL.Query()
+	q := model.AggregateQuery{}
+
+	var err error
+
+	if v := params.Get("group"); v != "" {
+		err = q.GroupBy(v, d.Header)
+
+		if err != nil {
+			return q, err
+		}
+	}
+
+	if v := params.Get("agg"); v != "" {
+		err = q.Compute(v, d.Header)
+
+		if err != nil {
+			return q, err
+		}
+	}
+
+	if v := params.Get("filter"); v != "" {
+		err = q.Rows.Filter(v, d.Header)
+
+		if err != nil {
+			return q, err
+		}
+	}
+
+	if column := params.Get("column"); column != "" {
+		q.Rows.WhereEquals(column, params.Get("data"))
+	}
+
+	return q, nil
+}
+
+// Number of seconds computed statistics are cached for. Entries are keyed by
+// document version so a changed document is never served stale statistics.
+const statsCacheSeconds = 3600
+
+// Gets the profile of a column of a document, with the top most frequent
+// values
+func (server *Server) GetColumnStats(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	apiKey := r.Context().Value("key").(string)
+	username := vars["username"]
+	docID := vars["docID"]
+	name := vars["name"]
+
+	user := &model.User{}
+	retrievedUser, err := user.AuthenticateUser(server.DB, username)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ok := auth.CheckPasswordHash(retrievedUser.AuthKey, apiKey)
+
+	if !ok {
+		err = errors.New("invalid api key")
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	document := &model.Document{}
+	retrievedDocument, err := document.GetDocumentByID(server.DB, uuid.Parse(docID))
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if !uuid.Equal(retrievedDocument.UserID, retrievedUser.ID) {
+		err = errors.New("document belongs to another user")
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	header, err := retrievedDocument.HeaderByName(name)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	top, err := topValues(r)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	key := fmt.Sprintf("stats:%s:%d:%d:column:%s", retrievedDocument.ID, retrievedDocument.Version(), top, name)
+
+	stats, err := server.cachedJSON(key, func() (interface{}, error) {
+		return retrievedDocument.ColumnStats(server.DB, header, top)
+	})
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response.JsonResponse(w, http.StatusOK, stats)
+}
+
+// Gets the profile of every column of a document
+func (server *Server) GetDocumentStats(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	apiKey := r.Context().Value("key").(string)
+	username := vars["username"]
+	docID := vars["docID"]
+
+	user := &model.User{}
+	retrievedUser, err := user.AuthenticateUser(server.DB, username)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ok := auth.CheckPasswordHash(retrievedUser.AuthKey, apiKey)
+
+	if !ok {
+		err = errors.New("invalid api key")
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	document := &model.Document{}
+	retrievedDocument, err := document.GetDocumentByID(server.DB, uuid.Parse(docID))
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if !uuid.Equal(retrievedDocument.UserID, retrievedUser.ID) {
+		err = errors.New("document belongs to another user")
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	top, err := topValues(r)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	key := fmt.Sprintf("stats:%s:%d:%d", retrievedDocument.ID, retrievedDocument.Version(), top)
+
+	stats, err := server.cachedJSON(key, func() (interface{}, error) {
+		return retrievedDocument.Stats(server.DB, top)
+	})
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response.JsonResponse(w, http.StatusOK, stats)
+}
+
+// Reads the number of most frequent values to report from the top query
+// parameter
+func topValues(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("top")
+
+	if v == "" {
+		return model.DefaultTopValues, nil
+	}
+
+	top, err := strconv.Atoi(v)
+
+	if err != nil || top < 0 || top > model.MaxTopValues {
+		return 0, fmt.Errorf("top must be a number between 0 and %d", model.MaxTopValues)
+	}
+
+	return top, nil
+}
+
+// Gets JSON cached under key, computing and caching it when missing. A failing
+// cache only costs recomputing the value.
+func (server *Server) cachedJSON(key string, compute func() (interface{}, error)) (json.RawMessage, error) {
+	conn := server.Cache.Get()
+	defer conn.Close()
+
+	cached, err := redis.Bytes(conn.Do("GET", key))
+
+	if err == nil {
+		return cached, nil
+	}
+
+	value, err := compute()
+
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Do("SETEX", key, statsCacheSeconds, b)
+
+	if err != nil {
+		log.Printf("caching %s: %s", key, err)
+	}
+
+	return b, nil
+}
+
+// Gets a page of the distinct values of a column with their counts, starting
+// with prefix and read from rows matching filter
+func (server *Server) GetColumnValues(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	apiKey := r.Context().Value("key").(string)
+	username := vars["username"]
+	docID := vars["docID"]
+	name := vars["name"]
+
+	user := &model.User{}
+	retrievedUser, err := user.AuthenticateUser(server.DB, username)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ok := auth.CheckPasswordHash(retrievedUser.AuthKey, apiKey)
+
+	if !ok {
+		err = errors.New("invalid api key")
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	document := &model.Document{}
+	retrievedDocument, err := document.GetDocumentByID(server.DB, uuid.Parse(docID))
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if !uuid.Equal(retrievedDocument.UserID, retrievedUser.ID) {
+		err = errors.New("document belongs to another user")
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	header, err := retrievedDocument.HeaderByName(name)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	q, err := valueQuery(r, retrievedDocument)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	list, err := retrievedDocument.DistinctValues(server.DB, header, q)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	pageHeaders(w, r, list.Page)
+	response.JsonResponse(w, http.StatusOK, list.Values)
+}
+
+// Reads limit, offset, count, filter, prefix and order query parameters for a
+// listing of a column's distinct values
+func valueQuery(r *http.Request, d *model.Document) (model.ValueQuery, error) {
+	params := r.URL.Query()
+
+	rows, err := pageQuery(r)
+
+	if err != nil {
+		return model.ValueQuery{}, err
+	}
+
+	if v := params.Get("filter"); v != "" {
+		err = rows.Filter(v, d.Header)
+
+		if err != nil {
+			return model.ValueQuery{}, err
+		}
+	}
+
+	q := model.ValueQuery{Rows: rows, Prefix: params.Get("prefix")}
+
+	switch params.Get("order") {
+	case "", "value":
+	case "count":
+		q.ByCount = true
+	default:
+		return q, errors.New("order must be value or count")
+	}
+
+	return q, nil
+}
@@ -4,14 +4,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"mime/multipart"
 	"net/http"
 	"runtime"
+	"strconv"
 	"sync"
 
 	"github.com/gorilla/mux"
 	"github.com/pborman/uuid"
 	"github.com/phankanp/csv-to-json/auth"
+	"github.com/phankanp/csv-to-json/config"
 	"github.com/phankanp/csv-to-json/helper"
 	"github.com/phankanp/csv-to-json/model"
 	"github.com/phankanp/csv-to-json/response"
@@ -40,15 +41,53 @@ func (server *Server) GetDocuments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	withRows, err := queryBool(r, "rows", false)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	withHeaders, err := queryBool(r, "headers", true)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var fields model.Fields
+
+	if v := r.URL.Query().Get("fields"); v != "" {
+		fields = model.ParseFields(v)
+	}
+
 	document := &model.Document{}
 
-	d, err := document.GetDocuments(server.DB, user.ID)
+	d, err := document.GetDocuments(server.DB, user.ID, withRows, fields)
 
 	if err != nil {
 		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// Fields of the listing only need to be a header of one of the documents
+	headers := []model.Header{}
+
+	for i := range *d {
+		headers = append(headers, (*d)[i].Header...)
+
+		if !withHeaders {
+			(*d)[i].Header = nil
+		}
+	}
+
+	err = fields.Check(headers)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	response.JsonResponse(w, http.StatusOK, d)
 }
 
@@ -76,49 +115,268 @@ func (server *Server) GetDocument(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	withRows, err := queryBool(r, "rows", false)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	withHeaders, err := queryBool(r, "headers", true)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	document := &model.Document{}
 
 	d, err := document.GetDocumentByID(server.DB, uuid.Parse(docID))
 
 	if err != nil {
-		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
+		response.ErrorResponse(w, err, err.Error(), http.StatusNotFound)
 		return
 	}
 
+	if !uuid.Equal(d.UserID, retrievedUser.ID) {
+		err = errors.New("document belongs to another user")
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	fields, err := rowFields(r, d.Header)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format, err := response.NegotiateFormat(r)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Other formats hold the rows of the document alone
+	if format.Name != response.JSON.Name {
+		server.export(w, d, model.RowQuery{Fields: fields}, format, false)
+		return
+	}
+
+	// Rows are paged like a listing of the document's rows
+	if withRows {
+		q, err := rowQuery(r, d)
+
+		if err != nil {
+			response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		row := &model.Row{}
+		list, err := row.ListRows(server.DB, d.ID, q)
+
+		if err != nil {
+			response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		pageHeaders(w, r, list.Page)
+		d.Row = list.Rows
+	}
+
+	if !withHeaders {
+		d.Header = nil
+	}
+
 	response.JsonResponse(w, http.StatusOK, d)
 }
 
-// Concurrently processes uploaded csv files and stores in database
-func (server *Server) UploadHandlerConcurrent(w http.ResponseWriter, r *http.Request) {
-	sessionToken, err := auth.GetSessionToken(r)
+// Builds ingest options from server configuration and upload form fields
+func (server *Server) ingestOptions(r *http.Request) (model.IngestOptions, error) {
+	opts := model.IngestOptions{}
+
+	if server.Config != nil && server.Config.Ingest != nil {
+		opts.BatchSize = server.Config.Ingest.BatchSize
+	}
+
+	policy, err := model.ParseErrorPolicy(r.FormValue("on_error"))
 
 	if err != nil {
-		if err == http.ErrNoCookie {
-			response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
-			return
+		return opts, err
+	}
+
+	opts.ErrorPolicy = policy
+
+	if types := r.FormValue("types"); types != "" {
+		err = json.Unmarshal([]byte(types), &opts.Types)
+
+		if err != nil {
+			return opts, fmt.Errorf("invalid types: %s", err)
+		}
+
+		err = model.ValidateTypeOverrides(opts.Types)
+
+		if err != nil {
+			return opts, err
 		}
-		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
-		return
 	}
 
-	userEmail, err := auth.GetUserEmailFromSessionToken(server.Cache, sessionToken)
+	opts.Dialect, err = dialectOptions(r)
 
 	if err != nil {
-		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
+		return opts, err
+	}
+
+	opts.Format = r.FormValue("format")
+
+	if opts.Format != "" && !model.ValidFormat(opts.Format) {
+		return opts, fmt.Errorf("unsupported format %q", opts.Format)
+	}
+
+	opts.Sheet = r.FormValue("sheet")
+	opts.FlattenSeparator = r.FormValue("flatten_separator")
+	opts.Key = r.FormValue("key")
+
+	if v := r.FormValue("upsert"); v != "" {
+		opts.Upsert, err = strconv.ParseBool(v)
+
+		if err != nil {
+			return opts, errors.New("upsert must be true or false")
+		}
+	}
+
+	return opts, nil
+}
+
+// Most bytes an uploaded file may expand to once decompressed
+func (server *Server) maxDecompressedSize() int64 {
+	if server.Config != nil && server.Config.Ingest != nil && server.Config.Ingest.MaxDecompressedSize > 0 {
+		return server.Config.Ingest.MaxDecompressedSize
+	}
+
+	return config.DefaultMaxDecompressedSize
+}
+
+// Reads csv dialect settings from upload form fields
+func dialectOptions(r *http.Request) (model.DialectOptions, error) {
+	opts := model.DialectOptions{
+		Delimiter: r.FormValue("delimiter"),
+		Quote:     r.FormValue("quote"),
+		Comment:   r.FormValue("comment"),
+		Encoding:  r.FormValue("encoding"),
+	}
+
+	switch opts.Delimiter {
+	case "tab", `\t`:
+		opts.Delimiter = "\t"
+	}
+
+	if v := r.FormValue("lazy_quotes"); v != "" {
+		lazyQuotes, err := strconv.ParseBool(v)
+
+		if err != nil {
+			return opts, errors.New("lazy_quotes must be true or false")
+		}
+
+		opts.LazyQuotes = lazyQuotes
+	}
+
+	if v := r.FormValue("has_header"); v != "" {
+		hasHeader, err := strconv.ParseBool(v)
+
+		if err != nil {
+			return opts, errors.New("has_header must be true or false")
+		}
+
+		opts.HasHeader = &hasHeader
+	}
+
+	return opts, opts.Validate()
+}
+
+// Writes the error response for a failed document ingestion
+func ingestErrorResponse(w http.ResponseWriter, err error) {
+	e := ingestError(err)
+	response.ErrorDetailsResponse(w, err, e.Message, e.Code, e.Details)
+}
+
+// Builds the error of a failed document ingestion, with its status code and
+// the rows or headers at fault
+func ingestError(err error) response.HTTPError {
+	e := response.HTTPError{Error: err.Error(), Message: err.Error(), Code: http.StatusInternalServerError}
+
+	var rowErr *model.RowError
+	var duplicateErr *model.DuplicateKeyError
+	var mismatchErr *model.HeaderMismatchError
+	var limitErr *sizeLimitError
+
+	switch {
+	case errors.As(err, &rowErr):
+		e.Code = http.StatusUnprocessableEntity
+		e.Details = []model.RowError{*rowErr}
+	case errors.As(err, &duplicateErr):
+		e.Code = http.StatusConflict
+		e.Details = duplicateErr
+	case errors.As(err, &mismatchErr):
+		e.Code = http.StatusUnprocessableEntity
+		e.Details = mismatchErr
+	case errors.As(err, &limitErr):
+		e.Code = http.StatusRequestEntityTooLarge
+	}
+
+	return e
+}
+
+// Outcome of one file of an upload: the document created from it or the
+// error it failed with
+type uploadResult struct {
+	Title    string              `json:"title"`
+	Document *model.Document     `json:"document,omitempty"`
+	Error    *response.HTTPError `json:"error,omitempty"`
+}
+
+// Writes the error response for an uploaded file that could not be read,
+// using 413 when it is too large once decompressed
+func uploadErrorResponse(w http.ResponseWriter, err error, code int) {
+	var limitErr *sizeLimitError
+
+	if errors.As(err, &limitErr) {
+		code = http.StatusRequestEntityTooLarge
+	}
+
+	response.ErrorResponse(w, err, err.Error(), code)
+}
+
+// Writes the error response for row data that does not match the document
+// schema, or whose key is missing or taken, and 500 for other failures
+func rowDataErrorResponse(w http.ResponseWriter, err error) {
+	var schemaErr *model.SchemaError
+
+	if errors.As(err, &schemaErr) {
+		response.ErrorDetailsResponse(w, err, err.Error(), http.StatusUnprocessableEntity, schemaErr.Violations)
 		return
 	}
 
-	if userEmail == "" {
-		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+	var duplicateErr *model.DuplicateKeyError
+
+	if errors.As(err, &duplicateErr) {
+		response.ErrorDetailsResponse(w, err, err.Error(), http.StatusConflict, duplicateErr)
 		return
 	}
 
-	user := &model.User{}
+	response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
+}
 
-	authenticatedUser, err := user.GetUserByEmail(server.DB, userEmail)
+// Concurrently processes uploaded csv files and stores in database, or queues
+// them as a background job when the async form field is true. Each file is
+// stored in its own transaction, so when only some fail the response is 207
+// with the document or error of every file.
+func (server *Server) UploadHandlerConcurrent(w http.ResponseWriter, r *http.Request) {
+	authenticatedUser, code, err := server.sessionUser(r)
 
 	if err != nil {
-		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
+		response.ErrorResponse(w, err, err.Error(), code)
 		return
 	}
 
@@ -128,29 +386,40 @@ func (server *Server) UploadHandlerConcurrent(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	opts, err := server.ingestOptions(r)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	formdata := r.MultipartForm
 
-	files := formdata.File["multiplefiles"]
-	titles := formdata.Value["title"]
+	items, err := uploadItems(formdata.File["multiplefiles"], formdata.Value["title"], opts, server.maxDecompressedSize())
 
-	documents := make([]*model.Document, 0)
+	if err != nil {
+		uploadErrorResponse(w, err, http.StatusBadRequest)
+		return
+	}
 
-	// Channels which receive files, errors, and results
-	resCh := make(chan *model.Document)
-	errCh := make(chan error)
-	doneCh := make(chan struct{})
-	filesCh := make(chan map[string]*multipart.FileHeader)
+	if r.FormValue("async") == "true" {
+		server.uploadAsync(w, items, authenticatedUser, opts)
+		return
+	}
+
+	// Result of each item, in upload order. Every worker writes only the
+	// results of the items it takes.
+	results := make([]uploadResult, len(items))
+	indexes := make(chan int)
 
 	// Variable of type Waitgroup to coordinate goroutine execution
 	wg := sync.WaitGroup{}
 
-	// Anonymous goroutine function which iterates through and sends all uploaded files to the files channel
+	// Anonymous goroutine function which iterates through and sends the index of every uploaded file to the indexes channel
 	go func() {
-		defer close(filesCh)
-		for i, _ := range files {
-			m := make(map[string]*multipart.FileHeader)
-			m[titles[i]] = files[i]
-			filesCh <- m
+		defer close(indexes)
+		for i := range items {
+			indexes <- i
 		}
 	}()
 	// Loop through number of CPU's on machine
@@ -162,65 +431,358 @@ func (server *Server) UploadHandlerConcurrent(w http.ResponseWriter, r *http.Req
 		// Anonymous goroutine function
 		go func() {
 			defer wg.Done()
-			// Loop through files in files channel
-			for m := range filesCh {
-				// Get file name and file
-				for key, val := range m {
-					fname := key
-					file := val
+			// Loop through files in indexes channel
+			for i := range indexes {
+				item := items[i]
+				fname := item.title
+				results[i].Title = fname
+
+				// Open file for reading
+				f, err := item.open()
+
+				if err != nil {
+					e := ingestError(fmt.Errorf("cannot open file: %w", err))
+					results[i].Error = &e
+					continue
+				}
 
-					// Open file for reading
-					f, err := file.Open()
+				doc := model.Document{}
 
-					if err != nil {
-						errCh <- fmt.Errorf("cannot open file: %s", err)
-						return
-					}
+				// Create document in database
+				data, err := doc.CreateDocument(f, fname, server.DB, authenticatedUser, item.options(opts))
+				f.Close()
 
-					defer f.Close()
+				if err != nil {
+					e := ingestError(fmt.Errorf("%s: %w", fname, err))
+					results[i].Error = &e
+					continue
+				}
 
-					doc := model.Document{}
+				results[i].Document = data
+			}
+		}()
+	}
 
-					// Create document in database
-					data, err := doc.CreateDocument(f, fname, server.DB, authenticatedUser)
+	wg.Wait()
 
-					if err != nil {
-						errCh <- err
-					}
+	documents := make([]*model.Document, 0, len(results))
+	var failed *response.HTTPError
 
-					// Send results of document creation to results channel
-					resCh <- data
-				}
+	for _, result := range results {
+		if result.Error != nil {
+			if failed == nil {
+				failed = result.Error
 			}
-		}()
+
+			continue
+		}
+
+		documents = append(documents, result.Document)
 	}
-	// Anonymous goroutine function which blocks until all goroutines and complete and sends a signal to done channel
-	go func() {
-		wg.Wait()
-		doneCh <- struct{}{}
-	}()
-	// Processes responses received from channels and sends json response
-	for {
-		select {
-		case err := <-errCh:
+
+	// Nothing was created, so the upload can be retried as a whole
+	if failed != nil && len(documents) == 0 {
+		response.ErrorDetailsResponse(w, errors.New(failed.Error), failed.Message, failed.Code, failed.Details)
+		return
+	}
+
+	// Reports each file when only some were created, so clients know which
+	// to upload again
+	if failed != nil {
+		response.JsonResponse(w, http.StatusMultiStatus, results)
+		return
+	}
+
+	response.JsonResponse(w, http.StatusOK, documents)
+}
+
+// Deletes a users document
+func (server *Server) DeleteDocument(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	apiKey := r.Context().Value("key").(string)
+	username := vars["username"]
+	docID := vars["id"]
+
+	user := &model.User{}
+	retrievedUser, err := user.AuthenticateUser(server.DB, username)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ok := auth.CheckPasswordHash(retrievedUser.AuthKey, apiKey)
+
+	if !ok {
+		err = errors.New("invalid api key")
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	document := &model.Document{}
+	retrievedDocument, err := document.GetDocumentByID(server.DB, uuid.Parse(docID))
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if !uuid.Equal(retrievedDocument.UserID, retrievedUser.ID) {
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	_, err = document.DeleteDocument(server.DB, uuid.Parse(docID))
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response.JsonResponse(w, http.StatusOK, "")
+}
+
+// Appends the rows of an uploaded csv file to a document
+func (server *Server) AppendDocumentRows(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	apiKey := r.Context().Value("key").(string)
+	username := vars["username"]
+	docID := vars["id"]
+
+	user := &model.User{}
+	retrievedUser, err := user.AuthenticateUser(server.DB, username)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ok := auth.CheckPasswordHash(retrievedUser.AuthKey, apiKey)
+
+	if !ok {
+		err = errors.New("invalid api key")
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	document := &model.Document{}
+	retrievedDocument, err := document.GetDocumentByID(server.DB, uuid.Parse(docID))
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if !uuid.Equal(retrievedDocument.UserID, retrievedUser.ID) {
+		err = errors.New("document belongs to another user")
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	err = r.ParseMultipartForm(200000)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	opts, err := server.ingestOptions(r)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if opts.Format != "" && opts.Format != model.FormatCSV {
+		err = errors.New("only csv files can be appended")
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mode, err := model.ParseHeaderMode(r.FormValue("header_mode"))
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, fileHeader, err := r.FormFile("file")
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f, _, err := openUpload(fileHeader, server.maxDecompressedSize())
+
+	if err != nil {
+		uploadErrorResponse(w, err, http.StatusBadRequest)
+		return
+	}
+
+	defer f.Close()
+
+	result, err := retrievedDocument.AppendRows(f, server.DB, opts, mode)
+
+	if err != nil {
+		ingestErrorResponse(w, err)
+		return
+	}
+
+	response.JsonResponse(w, http.StatusOK, result)
+}
+
+// Replaces the contents of a document with an uploaded file, keeping its id,
+// and responds with a summary of the changed rows
+func (server *Server) ReplaceDocumentContent(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	apiKey := r.Context().Value("key").(string)
+	username := vars["username"]
+	docID := vars["id"]
+
+	user := &model.User{}
+	retrievedUser, err := user.AuthenticateUser(server.DB, username)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ok := auth.CheckPasswordHash(retrievedUser.AuthKey, apiKey)
+
+	if !ok {
+		err = errors.New("invalid api key")
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	document := &model.Document{}
+	retrievedDocument, err := document.GetDocumentByID(server.DB, uuid.Parse(docID))
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if !uuid.Equal(retrievedDocument.UserID, retrievedUser.ID) {
+		err = errors.New("document belongs to another user")
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	err = r.ParseMultipartForm(200000)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	opts, err := server.ingestOptions(r)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, fileHeader, err := r.FormFile("file")
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f, name, err := openUpload(fileHeader, server.maxDecompressedSize())
+
+	if err != nil {
+		uploadErrorResponse(w, err, http.StatusBadRequest)
+		return
+	}
+
+	defer f.Close()
+
+	if opts.Format == "" {
+		opts.Format = model.DetectFormat(name)
+	}
+
+	diff, err := retrievedDocument.ReplaceContent(f, server.DB, opts)
+
+	if err != nil {
+		ingestErrorResponse(w, err)
+		return
+	}
+
+	response.JsonResponse(w, http.StatusOK, diff)
+}
+
+// Sequentially processes csv files and stores in database
+func (server *Server) UploadHandler(w http.ResponseWriter, r *http.Request) {
+	authenticatedUser, code, err := server.sessionUser(r)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), code)
+		return
+	}
+
+	err = r.ParseMultipartForm(200000)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	opts, err := server.ingestOptions(r)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	formdata := r.MultipartForm
+
+	items, err := uploadItems(formdata.File["multiplefiles"], formdata.Value["title"], opts, server.maxDecompressedSize())
+
+	if err != nil {
+		uploadErrorResponse(w, err, http.StatusBadRequest)
+		return
+	}
+
+	documents := make([]*model.Document, 0)
+
+	for _, item := range items {
+		fname := item.title
+
+		f, err := item.open()
+
+		if err != nil {
 			response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
 			return
-		case data := <-resCh:
-			documents = append(documents, data)
-		case <-doneCh:
-			response.JsonResponse(w, http.StatusOK, documents)
+		}
+
+		doc := model.Document{}
+
+		data, err := doc.CreateDocument(f, fname, server.DB, authenticatedUser, item.options(opts))
+		f.Close()
+
+		if err != nil {
+			ingestErrorResponse(w, fmt.Errorf("%s: %w", fname, err))
 			return
 		}
+
+		documents = append(documents, data)
+
 	}
+	response.JsonResponse(w, http.StatusOK, documents)
 }
 
-// Deletes a users document
-func (server *Server) DeleteDocument(w http.ResponseWriter, r *http.Request) {
+// Gets all rows for a document
+func (server *Server) GetDocumentRows(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	apiKey := r.Context().Value("key").(string)
 	username := vars["username"]
-	docID := vars["id"]
+	docID := vars["docID"]
 
 	user := &model.User{}
 	retrievedUser, err := user.AuthenticateUser(server.DB, username)
@@ -251,91 +813,119 @@ func (server *Server) DeleteDocument(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = document.DeleteDocument(server.DB, uuid.Parse(docID))
+	q, err := rowQuery(r, retrievedDocument)
 
 	if err != nil {
 		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	response.JsonResponse(w, http.StatusOK, "")
-}
-
-// Sequentially processes csv files and stores in database
-func (server *Server) UploadHandler(w http.ResponseWriter, r *http.Request) {
-	sessionToken, err := auth.GetSessionToken(r)
+	format, err := response.NegotiateFormat(r)
 
 	if err != nil {
-		if err == http.ErrNoCookie {
-			response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
-			return
-		}
 		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	userEmail, err := auth.GetUserEmailFromSessionToken(server.Cache, sessionToken)
+	if format.Name != response.JSON.Name {
+		server.export(w, retrievedDocument, q, format, false)
+		return
+	}
+
+	row := &model.Row{}
+
+	list, err := row.ListRows(server.DB, uuid.Parse(docID), q)
 
 	if err != nil {
 		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if userEmail == "" {
+	pageHeaders(w, r, list.Page)
+	response.JsonResponse(w, http.StatusOK, list.Rows)
+}
+
+// Creates a new row for a document
+func (server *Server) CreateDocumentRow(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	apiKey := r.Context().Value("key").(string)
+	username := vars["username"]
+	docID := vars["docID"]
+
+	user := &model.User{}
+	retrievedUser, err := user.AuthenticateUser(server.DB, username)
+
+	if err != nil {
 		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	user := &model.User{}
-
-	authenticatedUser, err := user.GetUserByEmail(server.DB, userEmail)
+	ok := auth.CheckPasswordHash(retrievedUser.AuthKey, apiKey)
 
-	if err != nil {
-		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
+	if !ok {
+		err = errors.New("invalid api key")
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	err = r.ParseMultipartForm(200000)
+	document := &model.Document{}
+	retrievedDocument, err := document.GetDocumentByID(server.DB, uuid.Parse(docID))
+
 	if err != nil {
-		fmt.Fprintln(w, err)
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	formdata := r.MultipartForm
-
-	files := formdata.File["multiplefiles"]
-	titles := formdata.Value["title"]
+	if !uuid.Equal(retrievedDocument.UserID, retrievedUser.ID) {
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
 
-	documents := make([]*model.Document, 0)
+	fields, err := rowFields(r, retrievedDocument.Header)
 
-	for i, _ := range files {
-		file := files[i]
-		fname := titles[i]
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-		f, err := file.Open()
-		defer f.Close()
+	rowData := model.JSONB{}
+	err = json.NewDecoder(r.Body).Decode(&rowData)
 
-		if err != nil {
-			return
-		}
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
 
-		doc := model.Document{}
+	createdRow, err := retrievedDocument.WriteRow(server.DB, &model.Row{}, rowData, r.URL.Query().Get("upsert") == "true")
 
-		data, err := doc.CreateDocument(f, fname, server.DB, authenticatedUser)
+	if err != nil {
+		rowDataErrorResponse(w, err)
+		return
+	}
 
-		documents = append(documents, data)
+	err = fields.Project(createdRow)
 
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	response.JsonResponse(w, http.StatusOK, documents)
+
+	response.JsonResponse(w, http.StatusOK, createdRow)
 }
 
-// Gets all rows for a document
-func (server *Server) GetDocumentRows(w http.ResponseWriter, r *http.Request) {
+// Get a specified row in a document
+func (server *Server) GetDocumentRow(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	apiKey := r.Context().Value("key").(string)
 	username := vars["username"]
 	docID := vars["docID"]
+	rowID, err := helper.IntFromString(vars["rowID"])
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
+	}
 
 	user := &model.User{}
 	retrievedUser, err := user.AuthenticateUser(server.DB, username)
@@ -366,25 +956,40 @@ func (server *Server) GetDocumentRows(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	fields, err := rowFields(r, retrievedDocument.Header)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	row := &model.Row{}
 
-	rows, err := row.GetAllRowsByDocument(server.DB, uuid.Parse(docID))
+	retrievedRow, err := row.GetRowByID(server.DB, uuid.Parse(docID), uint(rowID))
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = fields.Project(retrievedRow)
 
 	if err != nil {
 		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	response.JsonResponse(w, http.StatusOK, rows)
+	response.JsonResponse(w, http.StatusOK, retrievedRow)
 }
 
-// Creates a new row for a document
-func (server *Server) CreateDocumentRow(w http.ResponseWriter, r *http.Request) {
+// Updates a specified document row
+func (server *Server) UpdateDocumentRow(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	apiKey := r.Context().Value("key").(string)
 	username := vars["username"]
 	docID := vars["docID"]
+	rowID, err := helper.IntFromString(vars["rowID"])
 
 	user := &model.User{}
 	retrievedUser, err := user.AuthenticateUser(server.DB, username)
@@ -415,42 +1020,49 @@ func (server *Server) CreateDocumentRow(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	newRow := model.Row{}
-	rowData := model.JSONB{}
-	err = json.NewDecoder(r.Body).Decode(&rowData)
+	fields, err := rowFields(r, retrievedDocument.Header)
 
 	if err != nil {
-		response.ErrorResponse(w, err, err.Error(), http.StatusUnprocessableEntity)
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	row := &model.Row{}
+
+	retrievedRow, err := row.GetRowByID(server.DB, uuid.Parse(docID), uint(rowID))
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	headers, err := document.GetDocumentHeaders(server.DB)
+	rowData := model.JSONB{}
+	err = json.NewDecoder(r.Body).Decode(&rowData)
 
 	if err != nil {
 		response.ErrorResponse(w, err, err.Error(), http.StatusUnprocessableEntity)
 		return
 	}
 
-	ok = helper.CompareHeaders(rowData, headers)
+	updatedRow, err := retrievedDocument.WriteRow(server.DB, &model.Row{ID: retrievedRow.ID}, rowData, false)
 
-	if !ok {
-		err := errors.New("data keys do not match csv headers")
-		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+	if err != nil {
+		rowDataErrorResponse(w, err)
 		return
 	}
 
-	createdRow, err := newRow.CreateRow(server.DB, uuid.Parse(docID), rowData)
+	err = fields.Project(updatedRow)
 
 	if err != nil {
 		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	response.JsonResponse(w, http.StatusOK, createdRow)
+	response.JsonResponse(w, http.StatusOK, updatedRow)
 }
 
-// Get a specified row in a document
-func (server *Server) GetDocumentRow(w http.ResponseWriter, r *http.Request) {
+// Deletes a specified document row
+func (server *Server) DeleteDocumentRow(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	apiKey := r.Context().Value("key").(string)
@@ -458,10 +1070,56 @@ func (server *Server) GetDocumentRow(w http.ResponseWriter, r *http.Request) {
 	docID := vars["docID"]
 	rowID, err := helper.IntFromString(vars["rowID"])
 
+	user := &model.User{}
+	retrievedUser, err := user.AuthenticateUser(server.DB, username)
+
 	if err != nil {
-		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ok := auth.CheckPasswordHash(retrievedUser.AuthKey, apiKey)
+
+	if !ok {
+		err = errors.New("invalid api key")
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	document := &model.Document{}
+	retrievedDocument, err := document.GetDocumentByID(server.DB, uuid.Parse(docID))
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if !uuid.Equal(retrievedDocument.UserID, retrievedUser.ID) {
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	row := &model.Row{}
+
+	_, err = row.DeleteRow(server.DB, uuid.Parse(docID), uint(rowID))
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
 	}
 
+	response.JsonResponse(w, http.StatusOK, "")
+}
+
+// Get the row of a document with the given key column value
+func (server *Server) GetDocumentRowByKey(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	apiKey := r.Context().Value("key").(string)
+	username := vars["username"]
+	docID := vars["docID"]
+	key := vars["key"]
+
 	user := &model.User{}
 	retrievedUser, err := user.AuthenticateUser(server.DB, username)
 
@@ -482,18 +1140,38 @@ func (server *Server) GetDocumentRow(w http.ResponseWriter, r *http.Request) {
 	retrievedDocument, err := document.GetDocumentByID(server.DB, uuid.Parse(docID))
 
 	if err != nil {
-		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		response.ErrorResponse(w, err, err.Error(), http.StatusNotFound)
 		return
 	}
 
 	if !uuid.Equal(retrievedDocument.UserID, retrievedUser.ID) {
+		err = errors.New("document belongs to another user")
 		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
+	if retrievedDocument.KeyColumn == "" {
+		err = errors.New("document has no key column")
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fields, err := rowFields(r, retrievedDocument.Header)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	row := &model.Row{}
+	retrievedRow, err := row.GetRowByKey(server.DB, retrievedDocument.ID, key)
 
-	retrievedRow, err := row.GetRowByID(server.DB, uuid.Parse(docID), uint(rowID))
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	err = fields.Project(retrievedRow)
 
 	if err != nil {
 		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
@@ -503,14 +1181,15 @@ func (server *Server) GetDocumentRow(w http.ResponseWriter, r *http.Request) {
 	response.JsonResponse(w, http.StatusOK, retrievedRow)
 }
 
-// Updates a specified document row
-func (server *Server) UpdateDocumentRow(w http.ResponseWriter, r *http.Request) {
+// Updates the row of a document with the given key column value. The key is
+// kept when the new data leaves out the key column.
+func (server *Server) UpdateDocumentRowByKey(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	apiKey := r.Context().Value("key").(string)
 	username := vars["username"]
 	docID := vars["docID"]
-	rowID, err := helper.IntFromString(vars["rowID"])
+	key := vars["key"]
 
 	user := &model.User{}
 	retrievedUser, err := user.AuthenticateUser(server.DB, username)
@@ -532,20 +1211,37 @@ func (server *Server) UpdateDocumentRow(w http.ResponseWriter, r *http.Request)
 	retrievedDocument, err := document.GetDocumentByID(server.DB, uuid.Parse(docID))
 
 	if err != nil {
-		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		response.ErrorResponse(w, err, err.Error(), http.StatusNotFound)
 		return
 	}
 
 	if !uuid.Equal(retrievedDocument.UserID, retrievedUser.ID) {
+		err = errors.New("document belongs to another user")
 		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
+	if retrievedDocument.KeyColumn == "" {
+		err = errors.New("document has no key column")
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fields, err := rowFields(r, retrievedDocument.Header)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	row := &model.Row{}
+	retrievedRow, err := row.GetRowByKey(server.DB, retrievedDocument.ID, key)
 
-	retrievedRow, err := row.GetRowByID(server.DB, uuid.Parse(docID), uint(rowID))
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusNotFound)
+		return
+	}
 
-	updateRow := model.Row{}
 	rowData := model.JSONB{}
 	err = json.NewDecoder(r.Body).Decode(&rowData)
 
@@ -554,24 +1250,26 @@ func (server *Server) UpdateDocumentRow(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	headers, err := document.GetDocumentHeaders(server.DB)
+	if _, ok := rowData[retrievedDocument.KeyColumn]; !ok {
+		existingData := model.JSONB{}
+		err = json.Unmarshal(retrievedRow.Data, &existingData)
 
-	if err != nil {
-		response.ErrorResponse(w, err, err.Error(), http.StatusUnprocessableEntity)
-		return
+		if err != nil {
+			response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rowData[retrievedDocument.KeyColumn] = existingData[retrievedDocument.KeyColumn]
 	}
 
-	ok = helper.CompareHeaders(rowData, headers)
+	updatedRow, err := retrievedDocument.WriteRow(server.DB, &model.Row{ID: retrievedRow.ID}, rowData, false)
 
-	if !ok {
-		err := errors.New("data keys do not match csv headers")
-		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+	if err != nil {
+		rowDataErrorResponse(w, err)
 		return
 	}
 
-	updateRow.ID = retrievedRow.ID
-
-	updatedRow, err := updateRow.UpdateRow(server.DB, rowData)
+	err = fields.Project(updatedRow)
 
 	if err != nil {
 		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
@@ -581,14 +1279,14 @@ func (server *Server) UpdateDocumentRow(w http.ResponseWriter, r *http.Request)
 	response.JsonResponse(w, http.StatusOK, updatedRow)
 }
 
-// Deletes a specified document row
-func (server *Server) DeleteDocumentRow(w http.ResponseWriter, r *http.Request) {
+// Deletes the row of a document with the given key column value
+func (server *Server) DeleteDocumentRowByKey(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	apiKey := r.Context().Value("key").(string)
 	username := vars["username"]
 	docID := vars["docID"]
-	rowID, err := helper.IntFromString(vars["rowID"])
+	key := vars["key"]
 
 	user := &model.User{}
 	retrievedUser, err := user.AuthenticateUser(server.DB, username)
@@ -610,18 +1308,31 @@ func (server *Server) DeleteDocumentRow(w http.ResponseWriter, r *http.Request)
 	retrievedDocument, err := document.GetDocumentByID(server.DB, uuid.Parse(docID))
 
 	if err != nil {
-		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		response.ErrorResponse(w, err, err.Error(), http.StatusNotFound)
 		return
 	}
 
 	if !uuid.Equal(retrievedDocument.UserID, retrievedUser.ID) {
+		err = errors.New("document belongs to another user")
 		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
+	if retrievedDocument.KeyColumn == "" {
+		err = errors.New("document has no key column")
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	row := &model.Row{}
+	retrievedRow, err := row.GetRowByKey(server.DB, retrievedDocument.ID, key)
 
-	_, err = row.DeleteRow(server.DB, uuid.Parse(docID), uint(rowID))
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	_, err = row.DeleteRowByKey(server.DB, retrievedDocument.ID, *retrievedRow.Key)
 
 	if err != nil {
 		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
@@ -670,14 +1381,34 @@ func (server *Server) SearchRows(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	q, err := rowQuery(r, retrievedDocument)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format, err := response.NegotiateFormat(r)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if format.Name != response.JSON.Name {
+		q.WhereEquals(headerInput, dataInput)
+		server.export(w, retrievedDocument, q, format, false)
+		return
+	}
+
 	row := &model.Row{}
-	println("****************test3************")
-	rows, err := row.SearchRows(server.DB, uuid.Parse(docID), headerInput, dataInput)
+	list, err := row.SearchRows(server.DB, uuid.Parse(docID), headerInput, dataInput, q)
 
 	if err != nil {
 		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	response.JsonResponse(w, http.StatusOK, rows)
+	pageHeaders(w, r, list.Page)
+	response.JsonResponse(w, http.StatusOK, list.Rows)
 }
@@ -0,0 +1,194 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/pborman/uuid"
+	"github.com/phankanp/csv-to-json/auth"
+	"github.com/phankanp/csv-to-json/model"
+	"github.com/phankanp/csv-to-json/response"
+)
+
+// Exports a document as a file in the format of its extension, honoring the
+// filter, sort, fields and q parameters of row listings
+func (server *Server) ExportDocument(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	apiKey := r.Context().Value("key").(string)
+	username := vars["username"]
+	docID := vars["id"]
+
+	format, ok := response.FormatByName(vars["format"])
+
+	if !ok {
+		err := fmt.Errorf("unknown export format %q", vars["format"])
+		response.ErrorResponse(w, err, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	user := &model.User{}
+	retrievedUser, err := user.AuthenticateUser(server.DB, username)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ok = auth.CheckPasswordHash(retrievedUser.AuthKey, apiKey)
+
+	if !ok {
+		err = errors.New("invalid api key")
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	document := &model.Document{}
+	retrievedDocument, err := document.GetDocumentByID(server.DB, uuid.Parse(docID))
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if !uuid.Equal(retrievedDocument.UserID, retrievedUser.ID) {
+		err = errors.New("document belongs to another user")
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	q, err := rowQuery(r, retrievedDocument)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	server.export(w, retrievedDocument, q, format, true)
+}
+
+// Streams the rows of a document matching the query in a format, one row at
+// a time, with columns in header order. Exports are offered as a file when
+// attach is set. Cursors only page JSON listings, so queries with one are
+// answered with 400.
+func (server *Server) export(w http.ResponseWriter, d *model.Document, q model.RowQuery, f response.Format, attach bool) {
+	if q.Cursor != nil {
+		err := fmt.Errorf("cursor pages json listings only, export %s from an offset instead", f.Name)
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	columns := exportColumns(d, q.Fields)
+
+	var encoder response.Encoder
+
+	start := func() error {
+		response.FormatHeaders(w, f, d.Title, attach)
+
+		// CSV is written in the document's encoding
+		if f.Name == "csv" && d.Dialect.Encoding != "" && d.Dialect.Encoding != model.EncodingUTF8 {
+			w.Header().Set("Content-Type", f.ContentType+"; charset="+d.Dialect.Encoding)
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+		var err error
+		encoder, err = f.NewEncoder(w, columns, response.EncoderOptions{Title: d.Title, Dialect: d.Dialect})
+
+		return err
+	}
+
+	row := &model.Row{}
+	err := row.EachRow(server.DB, d.ID, q, func(row *model.Row) error {
+		if encoder == nil {
+			err := start()
+
+			if err != nil {
+				return err
+			}
+		}
+
+		values, err := rowValues(row, columns)
+
+		if err != nil {
+			return err
+		}
+
+		return encoder.Encode(row, values)
+	})
+
+	if err == nil && encoder == nil {
+		err = start()
+	}
+
+	if err != nil && encoder == nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if encoder != nil {
+		closeErr := encoder.Close()
+
+		if err == nil {
+			err = closeErr
+		}
+	}
+
+	// Past the first row the status is sent, so failures can only be logged
+	if err != nil {
+		log.Printf("exporting document %s: %s", d.ID, err)
+	}
+}
+
+// Headers exported for a document, in header order and limited to the fields
+// when given
+func exportColumns(d *model.Document, fields model.Fields) []string {
+	columns := make([]string, 0, len(d.Header))
+
+	for _, h := range d.Header {
+		if len(fields) > 0 && !containsString(fields, h.Name) {
+			continue
+		}
+
+		columns = append(columns, h.Name)
+	}
+
+	return columns
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reads the values of the columns from the data of a row, keeping numbers as
+// written. Missing values are nil.
+func rowValues(row *model.Row, columns []string) ([]interface{}, error) {
+	data := map[string]interface{}{}
+	dec := json.NewDecoder(bytes.NewReader(row.Data))
+	dec.UseNumber()
+
+	err := dec.Decode(&data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]interface{}, len(columns))
+
+	for i, column := range columns {
+		values[i] = data[column]
+	}
+
+	return values, nil
+}
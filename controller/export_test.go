@@ -0,0 +1,22 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/phankanp/csv-to-json/model"
+	"github.com/phankanp/csv-to-json/response"
+)
+
+func TestExportRejectsCursor(t *testing.T) {
+	server := &Server{}
+	f, _ := response.FormatByName("csv")
+
+	w := httptest.NewRecorder()
+	server.export(w, &model.Document{}, model.RowQuery{Cursor: &model.Cursor{}}, f, true)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
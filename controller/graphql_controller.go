@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/phankanp/csv-to-json/auth"
+	"github.com/phankanp/csv-to-json/graph"
+	"github.com/phankanp/csv-to-json/model"
+	"github.com/phankanp/csv-to-json/response"
+)
+
+// GraphQL request, sent as a JSON body or as query parameters of a GET
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// Runs a GraphQL query or mutation against a schema of the user's documents
+func (server *Server) GraphQL(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	apiKey := r.Context().Value("key").(string)
+	username := vars["username"]
+
+	user := &model.User{}
+	retrievedUser, err := user.AuthenticateUser(server.DB, username)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ok := auth.CheckPasswordHash(retrievedUser.AuthKey, apiKey)
+
+	if !ok {
+		err = errors.New("invalid api key")
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	request, err := readGraphQLRequest(r)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	document := &model.Document{}
+	documents, err := document.GetDocuments(server.DB, retrievedUser.ID, false, nil)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	schema, err := graph.NewSchema(server.DB, *documents)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema:         schema,
+		RequestString:  request.Query,
+		VariableValues: request.Variables,
+		OperationName:  request.OperationName,
+		Context:        r.Context(),
+	})
+
+	response.JsonResponse(w, http.StatusOK, result)
+}
+
+// Reads a GraphQL request from the body of a POST or the query parameters of
+// a GET. Mutations are only run when posted.
+func readGraphQLRequest(r *http.Request) (graphQLRequest, error) {
+	request := graphQLRequest{}
+
+	if r.Method == http.MethodPost {
+		err := json.NewDecoder(r.Body).Decode(&request)
+
+		if err != nil {
+			return request, err
+		}
+	} else {
+		params := r.URL.Query()
+		request.Query = params.Get("query")
+		request.OperationName = params.Get("operationName")
+
+		if v := params.Get("variables"); v != "" {
+			err := json.Unmarshal([]byte(v), &request.Variables)
+
+			if err != nil {
+				return request, err
+			}
+		}
+	}
+
+	if request.Query == "" {
+		return request, errors.New("query must be given")
+	}
+
+	if r.Method != http.MethodPost && isMutation(request) {
+		return request, errors.New("mutations must be sent with POST")
+	}
+
+	return request, nil
+}
+
+// Checks if the operation of a request is a mutation. Requests that do not
+// parse are left for execution to report.
+func isMutation(request graphQLRequest) bool {
+	document, err := parser.Parse(parser.ParseParams{Source: request.Query})
+
+	if err != nil {
+		return false
+	}
+
+	for _, definition := range document.Definitions {
+		operation, ok := definition.(*ast.OperationDefinition)
+
+		if !ok {
+			continue
+		}
+
+		name := ""
+
+		if operation.Name != nil {
+			name = operation.Name.Value
+		}
+
+		if request.OperationName == "" || request.OperationName == name {
+			return operation.Operation == ast.OperationTypeMutation
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,188 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/gorilla/mux"
+	"github.com/pborman/uuid"
+	"github.com/phankanp/csv-to-json/model"
+	"github.com/phankanp/csv-to-json/response"
+)
+
+// Starts the background upload workers and requeues files of jobs that were
+// unfinished when the server last stopped. Background uploads stay disabled
+// when no spool directory is configured, as spooled files must survive
+// restarts for jobs to resume.
+func (server *Server) StartJobWorkers() {
+	if server.spoolDir() == "" {
+		log.Println("UPLOAD_SPOOL_DIR is not set, background uploads are disabled")
+		return
+	}
+
+	err := os.MkdirAll(server.spoolDir(), 0700)
+
+	if err != nil {
+		log.Println("Cannot create upload spool directory, background uploads are disabled:", err)
+		return
+	}
+
+	workers := runtime.NumCPU()
+
+	if server.Config != nil && server.Config.Ingest != nil && server.Config.Ingest.Workers > 0 {
+		workers = server.Config.Ingest.Workers
+	}
+
+	server.jobs = make(chan model.JobFile, workers)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for f := range server.jobs {
+				err := f.Process(server.DB)
+
+				if err != nil {
+					log.Printf("job %s: %s: %s", f.JobID.String(), f.Title, err)
+				}
+			}
+		}()
+	}
+
+	jobFile := &model.JobFile{}
+	files, err := jobFile.GetUnfinishedJobFiles(server.DB)
+
+	if err != nil {
+		log.Printf("cannot resume upload jobs: %s", err)
+		return
+	}
+
+	server.enqueueJobFiles(files)
+}
+
+// Sends job files to the workers without blocking the caller
+func (server *Server) enqueueJobFiles(files []model.JobFile) {
+	go func() {
+		for _, f := range files {
+			server.jobs <- f
+		}
+	}()
+}
+
+// Spools uploaded files to disk and queues them as a background job,
+// responding with 202 and the job before any file is processed. Answers 503
+// when background uploads are disabled.
+func (server *Server) uploadAsync(w http.ResponseWriter, items []uploadItem, user *model.User, opts model.IngestOptions) {
+	if server.jobs == nil {
+		err := errors.New("background uploads are disabled on this server, upload without async")
+		response.ErrorResponse(w, err, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	job := &model.Job{}
+	err := job.PrepareJob(user.ID, opts)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for i, item := range items {
+		path := filepath.Join(server.spoolDir(), fmt.Sprintf("%s-%d", job.ID.String(), i))
+		err = spoolFile(item.open, path)
+
+		if err != nil {
+			os.Remove(path)
+			removeJobFiles(job.Files)
+			uploadErrorResponse(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		job.Files = append(job.Files, model.JobFile{Title: item.title, Path: path, Format: item.format, Sheet: item.sheet})
+	}
+
+	createdJob, err := job.CreateJob(server.DB)
+
+	if err != nil {
+		removeJobFiles(job.Files)
+		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	server.enqueueJobFiles(createdJob.Files)
+
+	w.Header().Set("Location", "/jobs/"+createdJob.ID.String())
+	response.JsonResponse(w, http.StatusAccepted, createdJob)
+}
+
+// Directory uploads are spooled to for background jobs
+func (server *Server) spoolDir() string {
+	if server.Config != nil && server.Config.Ingest != nil {
+		return server.Config.Ingest.SpoolDir
+	}
+
+	return ""
+}
+
+// Copies an uploaded file, decompressed, to path
+func spoolFile(open func() (io.ReadCloser, error), path string) error {
+	src, err := open()
+
+	if err != nil {
+		return fmt.Errorf("cannot open file: %w", err)
+	}
+
+	defer src.Close()
+
+	dst, err := os.Create(path)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func removeJobFiles(files []model.JobFile) {
+	for _, f := range files {
+		os.Remove(f.Path)
+	}
+}
+
+// Gets the status of an upload job
+func (server *Server) GetJob(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	authenticatedUser, code, err := server.sessionUser(r)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), code)
+		return
+	}
+
+	job := &model.Job{}
+	retrievedJob, err := job.GetJobByID(server.DB, uuid.Parse(vars["id"]))
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if !uuid.Equal(retrievedJob.UserID, authenticatedUser.ID) {
+		err = errors.New("job belongs to another user")
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	response.JsonResponse(w, http.StatusOK, retrievedJob)
+}
@@ -0,0 +1,26 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/phankanp/csv-to-json/config"
+	"github.com/phankanp/csv-to-json/model"
+)
+
+func TestUploadAsyncWithoutSpoolDir(t *testing.T) {
+	server := &Server{Config: &config.Config{Ingest: &config.IngestConfig{}}}
+	server.StartJobWorkers()
+
+	if server.jobs != nil {
+		t.Fatal("workers started without a spool directory")
+	}
+
+	w := httptest.NewRecorder()
+	server.uploadAsync(w, nil, &model.User{}, model.IngestOptions{})
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/pborman/uuid"
+	"github.com/phankanp/csv-to-json/auth"
+	"github.com/phankanp/csv-to-json/model"
+	"github.com/phankanp/csv-to-json/openapi"
+	"github.com/phankanp/csv-to-json/response"
+)
+
+// Gets an OpenAPI specification of the documents of a user, typed by their
+// headers
+func (server *Server) GetOpenAPI(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	apiKey := r.Context().Value("key").(string)
+	username := vars["username"]
+
+	user := &model.User{}
+	retrievedUser, err := user.AuthenticateUser(server.DB, username)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ok := auth.CheckPasswordHash(retrievedUser.AuthKey, apiKey)
+
+	if !ok {
+		err = errors.New("invalid api key")
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	document := &model.Document{}
+	documents, err := document.GetDocuments(server.DB, retrievedUser.ID, false, nil)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response.JsonResponse(w, http.StatusOK, openapi.Documents(username, *documents))
+}
+
+// Gets an OpenAPI specification of a single document
+func (server *Server) GetDocumentOpenAPI(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	apiKey := r.Context().Value("key").(string)
+	username := vars["username"]
+	docID := vars["id"]
+
+	user := &model.User{}
+	retrievedUser, err := user.AuthenticateUser(server.DB, username)
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ok := auth.CheckPasswordHash(retrievedUser.AuthKey, apiKey)
+
+	if !ok {
+		err = errors.New("invalid api key")
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	document := &model.Document{}
+	retrievedDocument, err := document.GetDocumentByID(server.DB, uuid.Parse(docID))
+
+	if err != nil {
+		response.ErrorResponse(w, err, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if !uuid.Equal(retrievedDocument.UserID, retrievedUser.ID) {
+		err = errors.New("document belongs to another user")
+		response.ErrorResponse(w, err, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	response.JsonResponse(w, http.StatusOK, openapi.Documents(username, []model.Document{*retrievedDocument}))
+}
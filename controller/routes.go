@@ -7,12 +7,29 @@ func (server *Server) InitializeRoutes() {
 	server.Router.HandleFunc("/register", server.Register).Methods("POST")
 	server.Router.HandleFunc("/upload", server.UploadHandlerConcurrent).Methods("POST")
 	server.Router.HandleFunc("/uploadLinear", server.UploadHandler).Methods("POST")
+	server.Router.HandleFunc("/jobs/{id}", server.GetJob).Methods("GET")
+	server.Router.HandleFunc("/{username}/graphql", middleware.MiddlewareAuth(server.GraphQL)).Methods("GET", "POST")
+	server.Router.HandleFunc("/{username}/openapi.json", middleware.MiddlewareAuth(server.GetOpenAPI)).Methods("GET")
 	server.Router.HandleFunc("/{username}/documents", middleware.MiddlewareAuth(server.GetDocuments)).Methods("GET")
+	server.Router.HandleFunc("/{username}/documents/{id}.{format}", middleware.MiddlewareAuth(server.ExportDocument)).Methods("GET")
 	server.Router.HandleFunc("/{username}/documents/{id}", middleware.MiddlewareAuth(server.GetDocument)).Methods("GET")
 	server.Router.HandleFunc("/{username}/documents/{id}", middleware.MiddlewareAuth(server.DeleteDocument)).Methods("DELETE")
+	server.Router.HandleFunc("/{username}/documents/{id}/openapi.json", middleware.MiddlewareAuth(server.GetDocumentOpenAPI)).Methods("GET")
+	server.Router.HandleFunc("/{username}/documents/{id}/schema", middleware.MiddlewareAuth(server.GetDocumentSchema)).Methods("GET")
+	server.Router.HandleFunc("/{username}/documents/{id}/append", middleware.MiddlewareAuth(server.AppendDocumentRows)).Methods("POST")
+	server.Router.HandleFunc("/{username}/documents/{id}/content", middleware.MiddlewareAuth(server.ReplaceDocumentContent)).Methods("PUT")
+	server.Router.HandleFunc("/{username}/documents/{docID}/aggregate", middleware.MiddlewareAuth(server.AggregateDocumentRows)).Methods("GET")
+	server.Router.HandleFunc("/{username}/documents/{docID}/stats", middleware.MiddlewareAuth(server.GetDocumentStats)).Methods("GET")
+	server.Router.HandleFunc("/{username}/documents/{docID}/columns/{name}/stats", middleware.MiddlewareAuth(server.GetColumnStats)).Methods("GET")
+	server.Router.HandleFunc("/{username}/documents/{docID}/columns/{name}/values", middleware.MiddlewareAuth(server.GetColumnValues)).Methods("GET")
+	server.Router.HandleFunc("/{username}/documents/{docID}/columns/{name}/rules", middleware.MiddlewareAuth(server.GetColumnRules)).Methods("GET")
+	server.Router.HandleFunc("/{username}/documents/{docID}/columns/{name}/rules", middleware.MiddlewareAuth(server.SetColumnRules)).Methods("PUT")
 	server.Router.HandleFunc("/{username}/documents/{docID}/rows", middleware.MiddlewareAuth(server.SearchRows)).Queries("column", "{column}", "data", "{data}").Methods("GET")
 	server.Router.HandleFunc("/{username}/documents/{docID}/rows", middleware.MiddlewareAuth(server.GetDocumentRows)).Methods("GET")
 	server.Router.HandleFunc("/{username}/documents/{docID}/rows", middleware.MiddlewareAuth(server.CreateDocumentRow)).Methods("POST")
+	server.Router.HandleFunc("/{username}/documents/{docID}/rows/by-key/{key}", middleware.MiddlewareAuth(server.GetDocumentRowByKey)).Methods("GET")
+	server.Router.HandleFunc("/{username}/documents/{docID}/rows/by-key/{key}", middleware.MiddlewareAuth(server.UpdateDocumentRowByKey)).Methods("PUT")
+	server.Router.HandleFunc("/{username}/documents/{docID}/rows/by-key/{key}", middleware.MiddlewareAuth(server.DeleteDocumentRowByKey)).Methods("DELETE")
 	server.Router.HandleFunc("/{username}/documents/{docID}/rows/{rowID}", middleware.MiddlewareAuth(server.GetDocumentRow)).Methods("GET")
 	server.Router.HandleFunc("/{username}/documents/{docID}/rows/{rowID}", middleware.MiddlewareAuth(server.UpdateDocumentRow)).Methods("PUT")
 	server.Router.HandleFunc("/{username}/documents/{docID}/rows/{rowID}", middleware.MiddlewareAuth(server.DeleteDocumentRow)).Methods("DELETE")
@@ -0,0 +1,184 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/phankanp/csv-to-json/model"
+)
+
+// Reads limit, offset, cursor, count, filter, sort, fields, q and columns
+// query parameters for a listing of a document's rows
+func rowQuery(r *http.Request, d *model.Document) (model.RowQuery, error) {
+	params := r.URL.Query()
+
+	q, err := pageQuery(r)
+
+	if err != nil {
+		return q, err
+	}
+
+	if v := params.Get("cursor"); v != "" {
+		if q.Offset > 0 {
+			return q, errors.New("cursor and offset cannot be combined")
+		}
+
+		q.Cursor, err = model.DecodeCursor(v)
+
+		if err != nil {
+			return q, err
+		}
+	}
+
+	if v := params.Get("filter"); v != "" {
+		err = q.Filter(v, d.Header)
+
+		if err != nil {
+			return q, err
+		}
+	}
+
+	if v := params.Get("sort"); v != "" {
+		err = q.SortBy(v, d.Header)
+
+		if err != nil {
+			return q, err
+		}
+	}
+
+	q.Fields, err = rowFields(r, d.Header)
+
+	if err != nil {
+		return q, err
+	}
+
+	if v := params.Get("q"); v != "" {
+		columns := model.Fields{}
+
+		if c := params.Get("columns"); c != "" {
+			columns = model.ParseFields(c)
+			err = columns.Check(d.Header)
+
+			if err != nil {
+				return q, err
+			}
+		}
+
+		q.Search(v, columns, d.Header)
+	}
+
+	if q.Cursor != nil && q.Ranked() {
+		return q, errors.New("search results ranked by relevance are paged with offsets, not cursors")
+	}
+
+	return q, nil
+}
+
+// Reads limit, offset and count query parameters for a listing
+func pageQuery(r *http.Request) (model.RowQuery, error) {
+	params := r.URL.Query()
+	q := model.RowQuery{}
+
+	var err error
+
+	if v := params.Get("limit"); v != "" {
+		q.Limit, err = strconv.Atoi(v)
+
+		if err != nil || q.Limit < 1 {
+			return q, fmt.Errorf("limit must be a number between 1 and %d", model.MaxRowLimit)
+		}
+	}
+
+	if v := params.Get("offset"); v != "" {
+		q.Offset, err = strconv.Atoi(v)
+
+		if err != nil || q.Offset < 0 {
+			return q, errors.New("offset must be a positive number")
+		}
+	}
+
+	q.Count, err = queryBool(r, "count", false)
+
+	if err != nil {
+		return q, err
+	}
+
+	return q, nil
+}
+
+// Reads the fields query parameter listing the headers rows are projected to,
+// checked against the document's headers
+func rowFields(r *http.Request, headers []model.Header) (model.Fields, error) {
+	v := r.URL.Query().Get("fields")
+
+	if v == "" {
+		return nil, nil
+	}
+
+	fields := model.ParseFields(v)
+	err := fields.Check(headers)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return fields, nil
+}
+
+// Reads a true or false query parameter, def when absent
+func queryBool(r *http.Request, name string, def bool) (bool, error) {
+	v := r.URL.Query().Get(name)
+
+	if v == "" {
+		return def, nil
+	}
+
+	b, err := strconv.ParseBool(v)
+
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false", name)
+	}
+
+	return b, nil
+}
+
+// Sets Link headers to the neighbouring pages of a listing, and the
+// X-Total-Count header when items were counted
+func pageHeaders(w http.ResponseWriter, r *http.Request, list model.Page) {
+	links := make([]string, 0, 2)
+
+	if list.Next != nil {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageURL(r, list.Limit, list.Next)))
+	}
+
+	if list.Prev != nil {
+		links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, pageURL(r, list.Limit, list.Prev)))
+	}
+
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+
+	if list.Total != nil {
+		w.Header().Set("X-Total-Count", strconv.FormatInt(*list.Total, 10))
+	}
+}
+
+// Url of the request pointed at another page
+func pageURL(r *http.Request, limit int, page *model.PageRef) string {
+	params := r.URL.Query()
+	params.Del("offset")
+	params.Del("cursor")
+	params.Set("limit", strconv.Itoa(limit))
+
+	if page.Cursor != "" {
+		params.Set("cursor", page.Cursor)
+	} else if page.Offset > 0 {
+		params.Set("offset", strconv.Itoa(page.Offset))
+	}
+
+	return r.URL.Path + "?" + params.Encode()
+}
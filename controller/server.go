@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/gorilla/mux"
@@ -16,13 +17,17 @@ import (
 type Server struct {
 	Router *mux.Router
 	DB     *gorm.DB
-	Cache  redis.Conn
+	Cache  *redis.Pool
+	Config *config.Config
+	jobs   chan model.JobFile
 }
 
 // Initializes postgres/redis connections and url routes
 func (server *Server) Initialize(config *config.Config) {
 	var err error
 
+	server.Config = config
+
 	connectionString := fmt.Sprintf(
 		"host=%s port=%s user=%s dbname=%s sslmode=disable password=%s",
 		config.DB.Host, config.DB.Port, config.DB.User, config.DB.DBname, config.DB.Password)
@@ -36,17 +41,37 @@ func (server *Server) Initialize(config *config.Config) {
 		fmt.Println("Successfully connected to Database")
 	}
 
-	conn, err := redis.DialURL("redis://localhost")
+	// Connections are not safe for concurrent use, so each call to the cache
+	// takes its own from the pool
+	server.Cache = &redis.Pool{
+		MaxIdle:     10,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL("redis://localhost")
+		},
+	}
+
+	conn := server.Cache.Get()
+	_, err = conn.Do("PING")
+	conn.Close()
+
 	if err != nil {
 		panic(err)
 	} else {
 		fmt.Println("Successfully connected to redis")
 	}
 
-	server.Cache = conn
-	server.DB.AutoMigrate(&model.User{}, &model.Document{}, &model.Row{}, &model.Header{})
+	server.DB.AutoMigrate(&model.User{}, &model.Document{}, &model.Row{}, &model.Header{}, &model.Job{}, &model.JobFile{})
+
+	err = model.CreateSearchIndex(server.DB)
+
+	if err != nil {
+		log.Println("Failed to create search index:", err)
+	}
+
 	server.Router = mux.NewRouter()
 	server.InitializeRoutes()
+	server.StartJobWorkers()
 
 }
 
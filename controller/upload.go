@@ -0,0 +1,428 @@
+package controller
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/phankanp/csv-to-json/model"
+	"github.com/phankanp/csv-to-json/xlsx"
+)
+
+// Uploaded file, archive entry, or sheet of a workbook ingested as one document
+type uploadItem struct {
+	title  string
+	open   func() (io.ReadCloser, error)
+	format string
+	sheet  string
+}
+
+// Ingest options for the item
+func (item uploadItem) options(opts model.IngestOptions) model.IngestOptions {
+	opts.Format = item.format
+	opts.Sheet = item.sheet
+	return opts
+}
+
+// Compression formats recognised from their magic bytes
+const (
+	compressionNone  = ""
+	compressionGzip  = "gzip"
+	compressionBzip2 = "bzip2"
+	compressionZstd  = "zstd"
+	compressionZip   = "zip"
+)
+
+// File name extensions removed once a file has been decompressed
+var compressionExts = map[string]bool{".gz": true, ".gzip": true, ".bz2": true, ".zst": true, ".zstd": true}
+
+// Pairs uploaded files with their titles, falling back to the file name when
+// no title is given. Compressed files are decompressed, zip archives are
+// expanded into one item per entry and workbooks into one item per sheet
+// unless a sheet was chosen. Decompressed files and archive entries fail with
+// a *sizeLimitError once they grow past limit bytes.
+func uploadItems(files []*multipart.FileHeader, titles []string, opts model.IngestOptions, limit int64) ([]uploadItem, error) {
+	items := make([]uploadItem, 0, len(files))
+
+	for i, file := range files {
+		file := file
+		title := baseTitle(file.Filename)
+
+		if i < len(titles) && strings.TrimSpace(titles[i]) != "" {
+			title = titles[i]
+		}
+
+		open := func() (io.ReadCloser, error) {
+			return file.Open()
+		}
+
+		compression, err := sniffCompression(open)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file.Filename, err)
+		}
+
+		if compression == compressionZip && !isWorkbookUpload(file, opts) {
+			entries, err := archiveItems(file, opts, limit)
+
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file.Filename, err)
+			}
+
+			items = append(items, entries...)
+			continue
+		}
+
+		expanded, err := fileItems(title, file.Filename, open, opts, limit)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file.Filename, err)
+		}
+
+		items = append(items, expanded...)
+	}
+
+	return items, nil
+}
+
+// Builds the items for a single file, decompressing it when needed and
+// splitting workbooks into sheets
+func fileItems(title string, name string, open func() (io.ReadCloser, error), opts model.IngestOptions, limit int64) ([]uploadItem, error) {
+	compression, err := sniffCompression(open)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch compression {
+	case compressionGzip, compressionBzip2, compressionZstd:
+		open = decompressed(open, compression, limit)
+
+		if ext := strings.ToLower(filepath.Ext(name)); compressionExts[ext] {
+			name = strings.TrimSuffix(name, filepath.Ext(name))
+		}
+	}
+
+	format := opts.Format
+
+	if format == "" {
+		format = model.DetectFormat(name)
+	}
+
+	if format != model.FormatXLSX || opts.Sheet != "" {
+		return []uploadItem{{title: title, open: open, format: format, sheet: opts.Sheet}}, nil
+	}
+
+	sheets, err := workbookSheets(open)
+
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]uploadItem, 0, len(sheets))
+
+	for _, sheet := range sheets {
+		sheetTitle := title
+
+		if len(sheets) > 1 {
+			sheetTitle = fmt.Sprintf("%s - %s", title, sheet)
+		}
+
+		items = append(items, uploadItem{title: sheetTitle, open: open, format: format, sheet: sheet})
+	}
+
+	return items, nil
+}
+
+// Builds items for every file in an uploaded zip archive, titled with the
+// entry's path without its extensions. Entries are limited to limit bytes
+// once inflated.
+func archiveItems(file *multipart.FileHeader, opts model.IngestOptions, limit int64) ([]uploadItem, error) {
+	f, err := file.Open()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	archive, err := zip.NewReader(f, file.Size)
+
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]uploadItem, 0, len(archive.File))
+
+	for _, entry := range archive.File {
+		if entry.FileInfo().IsDir() || strings.HasPrefix(entry.Name, "__MACOSX/") || strings.HasPrefix(path.Base(entry.Name), ".") {
+			continue
+		}
+
+		name := entry.Name
+		open := func() (io.ReadCloser, error) {
+			f, err := file.Open()
+
+			if err != nil {
+				return nil, err
+			}
+
+			archive, err := zip.NewReader(f, file.Size)
+
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+
+			for _, e := range archive.File {
+				if e.Name == name {
+					rc, err := e.Open()
+
+					if err != nil {
+						f.Close()
+						return nil, err
+					}
+
+					return readCloser{limitSize(rc, limit), func() error {
+						rc.Close()
+						return f.Close()
+					}}, nil
+				}
+			}
+
+			f.Close()
+			return nil, fmt.Errorf("archive entry %s not found", name)
+		}
+
+		title := path.Join(path.Dir(name), baseTitle(name))
+		entryItems, err := fileItems(title, name, open, opts, limit)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		items = append(items, entryItems...)
+	}
+
+	return items, nil
+}
+
+// Checks if an uploaded zip file is an xlsx workbook rather than an archive
+func isWorkbookUpload(file *multipart.FileHeader, opts model.IngestOptions) bool {
+	if opts.Format == model.FormatXLSX || model.DetectFormat(file.Filename) == model.FormatXLSX {
+		return true
+	}
+
+	f, err := file.Open()
+
+	if err != nil {
+		return false
+	}
+
+	defer f.Close()
+
+	return xlsx.IsWorkbook(f, file.Size)
+}
+
+// Detects compression from the first bytes of a file
+func sniffCompression(open func() (io.ReadCloser, error)) (string, error) {
+	f, err := open()
+
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	head := make([]byte, 4)
+	n, err := io.ReadFull(f, head)
+
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1F, 0x8B}):
+		return compressionGzip, nil
+	case bytes.HasPrefix(head, []byte("BZh")):
+		return compressionBzip2, nil
+	case bytes.HasPrefix(head, []byte{0x28, 0xB5, 0x2F, 0xFD}):
+		return compressionZstd, nil
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return compressionZip, nil
+	}
+
+	return compressionNone, nil
+}
+
+// Opens a single uploaded file, decompressing it when it is compressed, and
+// returns its name without any compression extension. Archives are rejected.
+func openUpload(file *multipart.FileHeader, limit int64) (io.ReadCloser, string, error) {
+	open := func() (io.ReadCloser, error) {
+		return file.Open()
+	}
+
+	compression, err := sniffCompression(open)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	if compression == compressionZip && model.DetectFormat(file.Filename) != model.FormatXLSX {
+		return nil, "", errors.New("archives are not supported here, upload a single file")
+	}
+
+	name := file.Filename
+
+	if compression != compressionZip && compression != compressionNone {
+		if ext := strings.ToLower(filepath.Ext(name)); compressionExts[ext] {
+			name = strings.TrimSuffix(name, filepath.Ext(name))
+		}
+	}
+
+	f, err := decompressed(open, compression, limit)()
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return f, name, nil
+}
+
+// Wraps an opener so the file is decompressed as it is read, failing with a
+// *sizeLimitError past limit bytes so small uploads cannot expand without bound
+func decompressed(open func() (io.ReadCloser, error), compression string, limit int64) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		f, err := open()
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch compression {
+		case compressionGzip:
+			gz, err := gzip.NewReader(f)
+
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+
+			return readCloser{limitSize(gz, limit), func() error {
+				gz.Close()
+				return f.Close()
+			}}, nil
+		case compressionBzip2:
+			return readCloser{limitSize(bzip2.NewReader(f), limit), f.Close}, nil
+		case compressionZstd:
+			zr, err := zstd.NewReader(f)
+
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+
+			return readCloser{limitSize(zr, limit), func() error {
+				zr.Close()
+				return f.Close()
+			}}, nil
+		}
+
+		return f, nil
+	}
+}
+
+// Reader with a custom close function
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (rc readCloser) Close() error {
+	return rc.close()
+}
+
+// Error reading a decompressed file past the maximum size
+type sizeLimitError struct {
+	limit int64
+}
+
+func (e *sizeLimitError) Error() string {
+	return fmt.Sprintf("file is larger than %d bytes once decompressed", e.limit)
+}
+
+// Reader failing with a *sizeLimitError once more than limit bytes are read,
+// rather than stopping short so a truncated file is never ingested
+type limitedReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func limitSize(r io.Reader, limit int64) io.Reader {
+	return &limitedReader{r: io.LimitReader(r, limit+1), limit: limit}
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+
+	if l.read > l.limit {
+		return 0, &sizeLimitError{limit: l.limit}
+	}
+
+	return n, err
+}
+
+// Lists the sheets of an uploaded workbook. Workbooks that cannot be read at
+// arbitrary offsets, such as archive entries, are read into memory first.
+func workbookSheets(open func() (io.ReadCloser, error)) ([]string, error) {
+	f, err := open()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	if mf, ok := f.(multipart.File); ok {
+		size, err := mf.Seek(0, io.SeekEnd)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return model.SheetNames(mf, size)
+	}
+
+	b, err := ioutil.ReadAll(f)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return model.SheetNames(bytes.NewReader(b), int64(len(b)))
+}
+
+// Title for a file without a given title: its name without extensions
+func baseTitle(filename string) string {
+	name := filepath.Base(filename)
+
+	if ext := strings.ToLower(filepath.Ext(name)); compressionExts[ext] {
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
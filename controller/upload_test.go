@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/phankanp/csv-to-json/model"
+)
+
+// Opener of a gzip file expanding to size zero bytes
+func gzipOpener(t *testing.T, size int) func() (io.ReadCloser, error) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+
+	if _, err := gz.Write(make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	}
+}
+
+func TestDecompressedLimit(t *testing.T) {
+	tests := []struct {
+		size     int
+		limit    int64
+		tooLarge bool
+	}{
+		{1 << 20, 1 << 20, false},
+		{1<<20 + 1, 1 << 20, true},
+		{64 << 20, 1 << 20, true},
+	}
+
+	for _, tt := range tests {
+		f, err := decompressed(gzipOpener(t, tt.size), compressionGzip, tt.limit)()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n, err := io.Copy(ioutil.Discard, f)
+		f.Close()
+
+		var limitErr *sizeLimitError
+
+		if tt.tooLarge {
+			if !errors.As(err, &limitErr) || n > tt.limit {
+				t.Errorf("%d bytes: got %d bytes, %v, want a size limit error", tt.size, n, err)
+			}
+
+			continue
+		}
+
+		if err != nil || n != int64(tt.size) {
+			t.Errorf("%d bytes: got %d bytes, %v", tt.size, n, err)
+		}
+	}
+}
+
+func TestIngestError(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{fmt.Errorf("a.csv: %w", &model.RowError{Line: 3, Reason: "bad"}), http.StatusUnprocessableEntity},
+		{fmt.Errorf("a.csv: %w", &model.DuplicateKeyError{Column: "sku", Value: "1"}), http.StatusConflict},
+		{fmt.Errorf("a.csv: %w", &model.HeaderMismatchError{Missing: []string{"sku"}}), http.StatusUnprocessableEntity},
+		{fmt.Errorf("cannot open file: %w", &sizeLimitError{limit: 1}), http.StatusRequestEntityTooLarge},
+		{errors.New("connection refused"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		e := ingestError(tt.err)
+
+		if e.Code != tt.code || e.Message != tt.err.Error() {
+			t.Errorf("%v: got %d %q, want %d", tt.err, e.Code, e.Message, tt.code)
+		}
+	}
+}
@@ -2,10 +2,13 @@ package controller
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"time"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/pborman/uuid"
+	"github.com/phankanp/csv-to-json/auth"
 	"github.com/phankanp/csv-to-json/model"
 	"github.com/phankanp/csv-to-json/response"
 )
@@ -59,7 +62,9 @@ func (server *Server) Login(w http.ResponseWriter, r *http.Request) {
 
 	sessionToken := uuid.NewRandom().String()
 
-	_, err = server.Cache.Do("SETEX", sessionToken, "120", email)
+	conn := server.Cache.Get()
+	_, err = conn.Do("SETEX", sessionToken, "120", email)
+	conn.Close()
 
 	if err != nil {
 		response.ErrorResponse(w, err, err.Error(), http.StatusInternalServerError)
@@ -72,3 +77,38 @@ func (server *Server) Login(w http.ResponseWriter, r *http.Request) {
 		Expires: time.Now().Add(120 * time.Second),
 	})
 }
+
+// Gets the user logged in with the request's session token, along with the
+// status code to respond with when there is no valid session
+func (server *Server) sessionUser(r *http.Request) (*model.User, int, error) {
+	sessionToken, err := auth.GetSessionToken(r)
+
+	if err != nil {
+		if err == http.ErrNoCookie {
+			return nil, http.StatusUnauthorized, err
+		}
+		return nil, http.StatusBadRequest, err
+	}
+
+	conn := server.Cache.Get()
+	userEmail, err := auth.GetUserEmailFromSessionToken(conn, sessionToken)
+	conn.Close()
+
+	if err == redis.ErrNil || (err == nil && userEmail == "") {
+		return nil, http.StatusUnauthorized, errors.New("invalid or expired session token")
+	}
+
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	user := &model.User{}
+
+	authenticatedUser, err := user.GetUserByEmail(server.DB, userEmail)
+
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return authenticatedUser, http.StatusOK, nil
+}
@@ -6,9 +6,12 @@ require (
 	github.com/badoux/checkmail v1.2.1
 	github.com/gomodule/redigo v1.8.2
 	github.com/gorilla/mux v1.8.0
+	github.com/graphql-go/graphql v0.8.1
 	github.com/joho/godotenv v1.3.0
+	github.com/klauspost/compress v1.11.7
 	github.com/pborman/uuid v1.2.1
 	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	golang.org/x/text v0.3.3
 	gorm.io/datatypes v0.0.0-20200806042100-bc394008dd0d
 	gorm.io/driver/postgres v1.0.0
 	gorm.io/gorm v1.20.1
@@ -0,0 +1,87 @@
+package graph
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/phankanp/csv-to-json/model"
+)
+
+// 64 bit integer, for integer columns holding values past the 32 bits of Int.
+// Values past 2^53 should be sent as strings to keep every digit.
+var Long = graphql.NewScalar(graphql.ScalarConfig{
+	Name:         "Long",
+	Description:  "A 64 bit integer",
+	Serialize:    toLong,
+	ParseValue:   toLong,
+	ParseLiteral: parseLongLiteral,
+})
+
+// Date and time in RFC 3339 format, for datetime columns
+var DateTime = graphql.NewScalar(graphql.ScalarConfig{
+	Name:         "DateTime",
+	Description:  "A date and time in RFC 3339 format",
+	Serialize:    toDateTime,
+	ParseValue:   toDateTime,
+	ParseLiteral: parseDateTimeLiteral,
+})
+
+func toLong(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	case json.Number:
+		return toLong(v.String())
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<63 {
+			return int64(v)
+		}
+	case string:
+		i, err := strconv.ParseInt(v, 10, 64)
+
+		if err == nil {
+			return i
+		}
+	}
+
+	return nil
+}
+
+func parseLongLiteral(v ast.Value) interface{} {
+	switch v := v.(type) {
+	case *ast.IntValue:
+		return toLong(v.Value)
+	case *ast.StringValue:
+		return toLong(v.Value)
+	}
+
+	return nil
+}
+
+// Normalizes a date and time to the format datetime columns store
+func toDateTime(v interface{}) interface{} {
+	switch v.(type) {
+	case string, time.Time:
+		t, err := model.ConvertValue(model.TypeDateTime, v)
+
+		if err == nil {
+			return t
+		}
+	}
+
+	return nil
+}
+
+func parseDateTimeLiteral(v ast.Value) interface{} {
+	if v, ok := v.(*ast.StringValue); ok {
+		return toDateTime(v.Value)
+	}
+
+	return nil
+}
@@ -0,0 +1,693 @@
+package graph
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/phankanp/csv-to-json/helper"
+	"github.com/phankanp/csv-to-json/model"
+	"gorm.io/gorm"
+)
+
+// Reference to a neighbouring page, read with cursor or offset
+var pageRefType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "PageRef",
+	Fields: graphql.Fields{
+		"cursor": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			if ref := p.Source.(*model.PageRef); ref.Cursor != "" {
+				return ref.Cursor, nil
+			}
+
+			return nil, nil
+		}},
+		"offset": &graphql.Field{Type: graphql.Int},
+	},
+})
+
+var pageInfoType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "PageInfo",
+	Fields: graphql.Fields{
+		"limit": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"total": &graphql.Field{
+			Type:        Long,
+			Description: "Number of matching rows, counted only when selected",
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				if total := p.Source.(model.Page).Total; total != nil {
+					return *total, nil
+				}
+
+				return nil, nil
+			},
+		},
+		"next": &graphql.Field{Type: pageRefType},
+		"prev": &graphql.Field{Type: pageRefType},
+	},
+})
+
+var headerInfoType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "HeaderInfo",
+	Fields: graphql.Fields{
+		"name": &graphql.Field{Type: graphql.NewNonNull(graphql.String), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(column).Name, nil
+		}},
+		"field": &graphql.Field{Type: graphql.NewNonNull(graphql.String), Description: "Field of the column in row data"},
+		"type": &graphql.Field{Type: graphql.NewNonNull(graphql.String), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(column).Type, nil
+		}},
+		"nullable": &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(column).Nullable, nil
+		}},
+	},
+})
+
+var documentInfoType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "DocumentInfo",
+	Fields: graphql.Fields{
+		"id": &graphql.Field{Type: graphql.NewNonNull(graphql.ID), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(*document).ID.String(), nil
+		}},
+		"title": &graphql.Field{Type: graphql.NewNonNull(graphql.String), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(*document).Title, nil
+		}},
+		"typeName": &graphql.Field{Type: graphql.NewNonNull(graphql.String), Description: "Name of the types of the document's rows"},
+		"keyColumn": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			if d := p.Source.(*document); d.KeyColumn != "" {
+				return d.KeyColumn, nil
+			}
+
+			return nil, nil
+		}},
+		"headers": &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(headerInfoType)))},
+	},
+})
+
+// Document of a schema, with the GraphQL names of its types and columns
+type document struct {
+	model.Document
+	TypeName string
+	// Data fields of the columns, in header order
+	Headers []column
+}
+
+type column struct {
+	model.Header
+	Field string
+}
+
+// Builds a GraphQL schema of documents. Every document has query fields
+// listing its rows and getting a row, and mutations creating, updating and
+// deleting rows, resolved with db.
+func NewSchema(db *gorm.DB, docs []model.Document) (graphql.Schema, error) {
+	names := helper.TypeNames(docs)
+	documents := make([]*document, len(docs))
+
+	for i, d := range docs {
+		documents[i] = &document{Document: d, TypeName: names[d.ID.String()], Headers: columns(d.Header)}
+	}
+
+	query := graphql.Fields{
+		"documents": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(documentInfoType))),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return documents, nil
+			},
+		},
+	}
+
+	mutation := graphql.Fields{}
+
+	for _, d := range documents {
+		// Object types need a field, so documents without headers are left
+		// out
+		if len(d.Headers) == 0 {
+			continue
+		}
+
+		d.addFields(db, query, mutation)
+	}
+
+	config := graphql.SchemaConfig{Query: graphql.NewObject(graphql.ObjectConfig{Name: "Query", Fields: query})}
+
+	if len(mutation) > 0 {
+		config.Mutation = graphql.NewObject(graphql.ObjectConfig{Name: "Mutation", Fields: mutation})
+	}
+
+	return graphql.NewSchema(config)
+}
+
+// Adds the types of a document and the query and mutation fields of its rows
+func (d *document) addFields(db *gorm.DB, query graphql.Fields, mutation graphql.Fields) {
+	dataFields := graphql.Fields{}
+	highlightFields := graphql.Fields{}
+	inputFields := graphql.InputObjectConfigFieldMap{}
+
+	for _, c := range d.Headers {
+		c := c
+
+		dataFields[c.Field] = &graphql.Field{
+			Type:        columnType(c.Type),
+			Description: c.Name,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return columnValue(c.Type, p.Source.(map[string]interface{})[c.Name]), nil
+			},
+		}
+
+		highlightFields[c.Field] = &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				if h, ok := p.Source.(map[string]string)[c.Name]; ok {
+					return h, nil
+				}
+
+				return nil, nil
+			},
+		}
+
+		var fieldType graphql.Input = columnType(c.Type)
+
+		if !c.AcceptsNull() {
+			fieldType = graphql.NewNonNull(fieldType)
+		}
+
+		inputFields[c.Field] = &graphql.InputObjectFieldConfig{Type: fieldType, Description: c.Name}
+	}
+
+	rowType := graphql.NewObject(graphql.ObjectConfig{
+		Name: d.TypeName + "Row",
+		Fields: graphql.Fields{
+			"id": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Int),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return int(sourceRow(p).ID), nil
+				},
+			},
+			"data": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewObject(graphql.ObjectConfig{Name: d.TypeName + "Data", Fields: dataFields})),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return rowData(sourceRow(p))
+				},
+			},
+			"highlights": &graphql.Field{
+				Type:        graphql.NewObject(graphql.ObjectConfig{Name: d.TypeName + "Highlights", Fields: highlightFields}),
+				Description: "Values matching the search, with matched words in <b> tags",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if h := sourceRow(p).Highlights; h != nil {
+						return h, nil
+					}
+
+					return nil, nil
+				},
+			},
+		},
+	})
+
+	pageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: d.TypeName + "Page",
+		Fields: graphql.Fields{
+			"rows": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(rowType))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*model.RowList).Rows, nil
+				},
+			},
+			"pageInfo": &graphql.Field{
+				Type: graphql.NewNonNull(pageInfoType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*model.RowList).Page, nil
+				},
+			},
+		},
+	})
+
+	inputType := graphql.NewInputObject(graphql.InputObjectConfig{Name: d.TypeName + "Input", Fields: inputFields})
+	field := lowerFirst(d.TypeName)
+
+	query[field+"Rows"] = &graphql.Field{
+		Type:        graphql.NewNonNull(pageType),
+		Description: "Lists a page of the rows of " + d.Title,
+		Args: graphql.FieldConfigArgument{
+			"limit":   &graphql.ArgumentConfig{Type: graphql.Int},
+			"offset":  &graphql.ArgumentConfig{Type: graphql.Int},
+			"cursor":  &graphql.ArgumentConfig{Type: graphql.String},
+			"filter":  &graphql.ArgumentConfig{Type: graphql.String, Description: "Condition rows must match, such as price > 10"},
+			"sort":    &graphql.ArgumentConfig{Type: graphql.String, Description: "Comma separated columns, each descending when prefixed by -"},
+			"q":       &graphql.ArgumentConfig{Type: graphql.String, Description: "Full text search of row values"},
+			"columns": &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String)), Description: "Columns searched by q"},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			q, err := d.rowQuery(p)
+
+			if err != nil {
+				return nil, err
+			}
+
+			row := &model.Row{}
+
+			return row.ListRows(db, d.ID, q)
+		},
+	}
+
+	query[field+"Row"] = &graphql.Field{
+		Type:        rowType,
+		Description: "Gets a row of " + d.Title,
+		Args: graphql.FieldConfigArgument{
+			"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			row := &model.Row{}
+			retrievedRow, err := row.GetRowByID(db, d.ID, uint(p.Args["id"].(int)))
+
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, nil
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			return retrievedRow, d.fields(p, "data").Project(retrievedRow)
+		},
+	}
+
+	if d.KeyColumn != "" {
+		query[field+"RowByKey"] = &graphql.Field{
+			Type:        rowType,
+			Description: "Gets the row of " + d.Title + " by its " + d.KeyColumn,
+			Args: graphql.FieldConfigArgument{
+				"key": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				row := &model.Row{}
+				retrievedRow, err := row.GetRowByKey(db, d.ID, p.Args["key"].(string))
+
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					return nil, nil
+				}
+
+				if err != nil {
+					return nil, err
+				}
+
+				return retrievedRow, d.fields(p, "data").Project(retrievedRow)
+			},
+		}
+	}
+
+	mutation["create"+d.TypeName+"Row"] = &graphql.Field{
+		Type:        graphql.NewNonNull(rowType),
+		Description: "Creates a row of " + d.Title + ", or with upsert updates the row holding its key",
+		Args: graphql.FieldConfigArgument{
+			"data":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(inputType)},
+			"upsert": &graphql.ArgumentConfig{Type: graphql.Boolean, DefaultValue: false},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			row, err := d.WriteRow(db, &model.Row{}, d.inputData(p.Args["data"]), p.Args["upsert"].(bool))
+
+			if err != nil {
+				return nil, writeError(err)
+			}
+
+			return row, nil
+		},
+	}
+
+	mutation["update"+d.TypeName+"Row"] = &graphql.Field{
+		Type:        graphql.NewNonNull(rowType),
+		Description: "Replaces the data of a row of " + d.Title,
+		Args: graphql.FieldConfigArgument{
+			"id":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+			"data": &graphql.ArgumentConfig{Type: graphql.NewNonNull(inputType)},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			row := &model.Row{}
+			retrievedRow, err := row.GetRowByID(db, d.ID, uint(p.Args["id"].(int)))
+
+			if err != nil {
+				return nil, err
+			}
+
+			updatedRow, err := d.WriteRow(db, &model.Row{ID: retrievedRow.ID}, d.inputData(p.Args["data"]), false)
+
+			if err != nil {
+				return nil, writeError(err)
+			}
+
+			return updatedRow, nil
+		},
+	}
+
+	mutation["delete"+d.TypeName+"Row"] = &graphql.Field{
+		Type:        graphql.NewNonNull(graphql.Boolean),
+		Description: "Deletes a row of " + d.Title,
+		Args: graphql.FieldConfigArgument{
+			"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			rowID := uint(p.Args["id"].(int))
+			row := &model.Row{}
+			_, err := row.GetRowByID(db, d.ID, rowID)
+
+			if err != nil {
+				return nil, err
+			}
+
+			_, err = row.DeleteRow(db, d.ID, rowID)
+
+			if err != nil {
+				return nil, err
+			}
+
+			return true, nil
+		},
+	}
+}
+
+// Reads the arguments of a row listing, the same as the query parameters of
+// row listings
+func (d *document) rowQuery(p graphql.ResolveParams) (model.RowQuery, error) {
+	q := model.RowQuery{}
+
+	var err error
+
+	if v, ok := p.Args["limit"].(int); ok {
+		if v < 1 || v > model.MaxRowLimit {
+			return q, fmt.Errorf("limit must be a number between 1 and %d", model.MaxRowLimit)
+		}
+
+		q.Limit = v
+	}
+
+	if v, ok := p.Args["offset"].(int); ok {
+		if v < 0 {
+			return q, errors.New("offset must be a positive number")
+		}
+
+		q.Offset = v
+	}
+
+	if v, ok := p.Args["cursor"].(string); ok && v != "" {
+		if q.Offset > 0 {
+			return q, errors.New("cursor and offset cannot be combined")
+		}
+
+		q.Cursor, err = model.DecodeCursor(v)
+
+		if err != nil {
+			return q, err
+		}
+	}
+
+	if v, ok := p.Args["filter"].(string); ok && v != "" {
+		err = q.Filter(v, d.Header)
+
+		if err != nil {
+			return q, err
+		}
+	}
+
+	if v, ok := p.Args["sort"].(string); ok && v != "" {
+		err = q.SortBy(v, d.Header)
+
+		if err != nil {
+			return q, err
+		}
+	}
+
+	if v, ok := p.Args["q"].(string); ok && v != "" {
+		columns := model.Fields{}
+
+		if c, ok := p.Args["columns"].([]interface{}); ok {
+			for _, name := range c {
+				columns = append(columns, name.(string))
+			}
+
+			err = columns.Check(d.Header)
+
+			if err != nil {
+				return q, err
+			}
+		}
+
+		q.Search(v, columns, d.Header)
+	}
+
+	if q.Cursor != nil && q.Ranked() {
+		return q, errors.New("search results ranked by relevance are paged with offsets, not cursors")
+	}
+
+	q.Fields = d.fields(p, "rows", "data")
+	q.Count = containsField(selectedFields(p, "pageInfo"), "total")
+
+	return q, nil
+}
+
+// Columns of the data fields selected under the path, so rows are read with
+// only the columns asked for
+func (d *document) fields(p graphql.ResolveParams, path ...string) model.Fields {
+	var fields model.Fields
+
+	for _, name := range selectedFields(p, path...) {
+		for _, c := range d.Headers {
+			if c.Field == name {
+				fields = append(fields, c.Name)
+			}
+		}
+	}
+
+	return fields
+}
+
+// Error of a row write, carrying the details of schema violations and
+// duplicate keys as extensions
+type rowWriteError struct {
+	error
+	extensions map[string]interface{}
+}
+
+func (e *rowWriteError) Extensions() map[string]interface{} {
+	return e.extensions
+}
+
+func writeError(err error) error {
+	var schemaErr *model.SchemaError
+
+	if errors.As(err, &schemaErr) {
+		return &rowWriteError{error: err, extensions: map[string]interface{}{"violations": schemaErr.Violations}}
+	}
+
+	var duplicateErr *model.DuplicateKeyError
+
+	if errors.As(err, &duplicateErr) {
+		return &rowWriteError{error: err, extensions: map[string]interface{}{"duplicate": duplicateErr}}
+	}
+
+	return err
+}
+
+// Row data of a mutation's data argument, keyed by column
+func (d *document) inputData(arg interface{}) model.JSONB {
+	input, _ := arg.(map[string]interface{})
+	data := model.JSONB{}
+
+	for _, c := range d.Headers {
+		if v, ok := input[c.Field]; ok {
+			data[c.Name] = v
+		}
+	}
+
+	return data
+}
+
+// Names the data fields of headers, making column names valid GraphQL names
+func columns(headers []model.Header) []column {
+	columns := make([]column, len(headers))
+	used := map[string]bool{}
+
+	for i, h := range headers {
+		base := fieldName(h.Name)
+		name := base
+
+		for n := 2; used[name]; n++ {
+			name = base + "_" + strconv.Itoa(n)
+		}
+
+		used[name] = true
+		columns[i] = column{Header: h, Field: name}
+	}
+
+	return columns
+}
+
+// Makes a field name of a column name, replacing characters GraphQL names
+// cannot hold with underscores, such as unit_price for "unit price"
+func fieldName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return r
+		}
+
+		return '_'
+	}, name)
+
+	// Names starting with two underscores are reserved
+	name = strings.TrimLeft(name, "_")
+
+	if name == "" || unicode.IsDigit(rune(name[0])) {
+		name = "_" + name
+	}
+
+	return name
+}
+
+func lowerFirst(s string) string {
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+// GraphQL type of the values of a column type
+func columnType(t string) graphql.Output {
+	switch t {
+	case model.TypeInteger:
+		return Long
+	case model.TypeFloat:
+		return graphql.Float
+	case model.TypeBoolean:
+		return graphql.Boolean
+	case model.TypeDateTime:
+		return DateTime
+	}
+
+	return graphql.String
+}
+
+// Converts a value read from row data to the type of its column, or nil when
+// it does not hold one
+func columnValue(t string, v interface{}) interface{} {
+	switch t {
+	case model.TypeInteger:
+		return toLong(v)
+	case model.TypeFloat:
+		if n, ok := v.(json.Number); ok {
+			f, err := n.Float64()
+
+			if err == nil {
+				return f
+			}
+		}
+
+		return nil
+	case model.TypeBoolean:
+		if b, ok := v.(bool); ok {
+			return b
+		}
+
+		return nil
+	}
+
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+
+	return nil
+}
+
+// Row being resolved, listed rows being values and others pointers
+func sourceRow(p graphql.ResolveParams) *model.Row {
+	if row, ok := p.Source.(model.Row); ok {
+		return &row
+	}
+
+	return p.Source.(*model.Row)
+}
+
+// Decodes the data of a row keeping numbers as written
+func rowData(row *model.Row) (map[string]interface{}, error) {
+	data := map[string]interface{}{}
+	dec := json.NewDecoder(bytes.NewReader(row.Data))
+	dec.UseNumber()
+
+	err := dec.Decode(&data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// Names of the fields selected below the field being resolved through the
+// path of fields, following fragments
+func selectedFields(p graphql.ResolveParams, path ...string) []string {
+	sets := make([]*ast.SelectionSet, 0, len(p.Info.FieldASTs))
+
+	for _, f := range p.Info.FieldASTs {
+		sets = append(sets, f.SelectionSet)
+	}
+
+	for _, name := range path {
+		next := []*ast.SelectionSet{}
+
+		for _, f := range fieldsOf(p, sets) {
+			if f.Name.Value == name {
+				next = append(next, f.SelectionSet)
+			}
+		}
+
+		sets = next
+	}
+
+	names := []string{}
+
+	for _, f := range fieldsOf(p, sets) {
+		names = append(names, f.Name.Value)
+	}
+
+	return names
+}
+
+// Fields of selection sets, including those of their fragments
+func fieldsOf(p graphql.ResolveParams, sets []*ast.SelectionSet) []*ast.Field {
+	fields := []*ast.Field{}
+
+	for _, set := range sets {
+		if set == nil {
+			continue
+		}
+
+		for _, selection := range set.Selections {
+			switch s := selection.(type) {
+			case *ast.Field:
+				fields = append(fields, s)
+			case *ast.InlineFragment:
+				fields = append(fields, fieldsOf(p, []*ast.SelectionSet{s.SelectionSet})...)
+			case *ast.FragmentSpread:
+				if fragment, ok := p.Info.Fragments[s.Name.Value].(*ast.FragmentDefinition); ok {
+					fields = append(fields, fieldsOf(p, []*ast.SelectionSet{fragment.SelectionSet})...)
+				}
+			}
+		}
+	}
+
+	return fields
+}
+
+func containsField(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,7 +1,10 @@
 package helper
 
 import (
+	"sort"
 	"strconv"
+	"strings"
+	"unicode"
 
 	"github.com/phankanp/csv-to-json/model"
 )
@@ -38,3 +41,64 @@ func CompareHeaders(newHeaders model.JSONB, oldHeaders []model.Header) bool {
 	}
 	return true
 }
+
+// Makes a type name of a document title, such as Sales2020Csv for
+// "sales 2020.csv". Names start with a letter so they are valid identifiers
+// in generated clients.
+func TypeName(title string) string {
+	// Letters outside ASCII are dropped rather than splitting words
+	title = strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII {
+			return -1
+		}
+
+		return r
+	}, title)
+
+	var b strings.Builder
+
+	for _, word := range strings.FieldsFunc(title, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+	}
+
+	name := b.String()
+
+	if name == "" || unicode.IsDigit(rune(name[0])) {
+		name = "Document" + name
+	}
+
+	return name
+}
+
+// Names documents by their titles, by document id. Documents are named in
+// order of title so names do not change with the order they are read in, and
+// a number is added to names already taken.
+func TypeNames(docs []model.Document) map[string]string {
+	sorted := append([]model.Document(nil), docs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Title != sorted[j].Title {
+			return sorted[i].Title < sorted[j].Title
+		}
+
+		return sorted[i].ID.String() < sorted[j].ID.String()
+	})
+
+	names := make(map[string]string, len(docs))
+	used := map[string]bool{}
+
+	for _, d := range sorted {
+		base := TypeName(d.Title)
+		name := base
+
+		for i := 2; used[name]; i++ {
+			name = base + strconv.Itoa(i)
+		}
+
+		used[name] = true
+		names[d.ID.String()] = name
+	}
+
+	return names
+}
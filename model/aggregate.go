@@ -0,0 +1,267 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/phankanp/csv-to-json/query"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Aggregate functions
+const (
+	AggregateCount = "count"
+	AggregateSum   = "sum"
+	AggregateAvg   = "avg"
+	AggregateMin   = "min"
+	AggregateMax   = "max"
+)
+
+// Most groups a single aggregation may return
+const MaxAggregateGroups = 10000
+
+// Column of a document with its type
+type Column struct {
+	Name string
+	Type string
+}
+
+// Aggregate function over a column, or over rows for a count without a column
+type Aggregate struct {
+	Func   string
+	Column Column
+}
+
+// Name of the aggregate in results, such as sum(price)
+func (a Aggregate) Name() string {
+	if a.Column.Name == "" {
+		return a.Func
+	}
+
+	return a.Func + "(" + a.Column.Name + ")"
+}
+
+// Options for aggregating the rows of a document
+type AggregateQuery struct {
+	// Rows aggregated, only their conditions are used
+	Rows RowQuery
+	// Columns rows are grouped by
+	Group []Column
+	// Aggregates computed for each group
+	Aggregates []Aggregate
+}
+
+// Groups rows by a comma separated list of columns
+func (q *AggregateQuery) GroupBy(spec string, headers []Header) error {
+	types := headerTypes(headers)
+
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		t, ok := types[name]
+
+		if !ok {
+			return fmt.Errorf("cannot group by unknown column %q", name)
+		}
+
+		q.Group = append(q.Group, Column{Name: name, Type: t})
+	}
+
+	return nil
+}
+
+// Adds aggregates from a comma separated list such as count,sum:price,max:date.
+// Sum and avg need a numeric column, min and max a numeric or date column.
+func (q *AggregateQuery) Compute(spec string, headers []Header) error {
+	types := headerTypes(headers)
+
+	for _, part := range strings.Split(spec, ",") {
+		fn, name := strings.TrimSpace(part), ""
+
+		if i := strings.Index(fn, ":"); i >= 0 {
+			fn, name = strings.TrimSpace(fn[:i]), strings.TrimSpace(fn[i+1:])
+		}
+
+		a := Aggregate{Func: strings.ToLower(fn), Column: Column{Name: name}}
+
+		if name != "" {
+			t, ok := types[name]
+
+			if !ok {
+				return fmt.Errorf("cannot aggregate unknown column %q", name)
+			}
+
+			a.Column.Type = t
+		}
+
+		numeric := a.Column.Type == TypeInteger || a.Column.Type == TypeFloat
+
+		switch a.Func {
+		case AggregateCount:
+		case AggregateSum, AggregateAvg:
+			if !numeric {
+				return fmt.Errorf("%s needs a numeric column", a.Func)
+			}
+		case AggregateMin, AggregateMax:
+			if !numeric && a.Column.Type != TypeDateTime {
+				return fmt.Errorf("%s needs a numeric or datetime column", a.Func)
+			}
+		default:
+			return fmt.Errorf("unknown aggregate function %q, expected count, sum, avg, min or max", fn)
+		}
+
+		q.Aggregates = append(q.Aggregates, a)
+	}
+
+	return nil
+}
+
+// Groups and aggregates in the result of an aggregation, one row per group
+type AggregateResult struct {
+	Columns []string
+	Rows    [][]interface{}
+}
+
+// Writes each group as an object keyed by column name
+func (a *AggregateResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.Groups())
+}
+
+// Gets each group as an object keyed by column name
+func (a *AggregateResult) Groups() []map[string]interface{} {
+	groups := make([]map[string]interface{}, len(a.Rows))
+
+	for i, row := range a.Rows {
+		groups[i] = make(map[string]interface{}, len(a.Columns))
+
+		for j, column := range a.Columns {
+			groups[i][column] = row[j]
+		}
+	}
+
+	return groups
+}
+
+// Aggregates the rows of a document matching the query in Postgres, ordered
+// by the group columns
+func (d *Document) Aggregate(db *gorm.DB, q AggregateQuery) (*AggregateResult, error) {
+	if len(q.Aggregates) == 0 {
+		q.Aggregates = []Aggregate{{Func: AggregateCount}}
+	}
+
+	result := &AggregateResult{}
+	selects := make([]string, 0, len(q.Group)+len(q.Aggregates))
+	groups := make([]string, 0, len(q.Group))
+	args := make([]interface{}, 0)
+
+	for i, c := range q.Group {
+		field := query.Field("data", c.Name, c.Type)
+		selects = append(selects, field.Text)
+		args = append(args, field.Args...)
+		result.Columns = append(result.Columns, c.Name)
+
+		// Grouping by position, as Postgres does not see expressions with
+		// different parameters as the same
+		groups = append(groups, strconv.Itoa(i+1))
+	}
+
+	for _, a := range q.Aggregates {
+		if a.Column.Name == "" {
+			selects = append(selects, "COUNT(*)")
+		} else {
+			field := query.Field("data", a.Column.Name, a.Column.Type)
+			selects = append(selects, strings.ToUpper(a.Func)+"("+field.Text+")")
+			args = append(args, field.Args...)
+		}
+
+		result.Columns = append(result.Columns, a.Name())
+	}
+
+	tx := db.Model(&Row{}).Clauses(clause.Select{Expression: clause.Expr{SQL: strings.Join(selects, ", "), Vars: args}}).
+		Where("document_id = ?", d.ID)
+
+	for _, condition := range q.Rows.conditions {
+		tx = condition(tx)
+	}
+
+	if len(groups) > 0 {
+		order := strings.Join(groups, ", ")
+		tx = tx.Group(order).Order(order).Limit(MaxAggregateGroups + 1)
+	}
+
+	rows, err := tx.Rows()
+
+	if err != nil {
+		return &AggregateResult{}, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		values := make([]interface{}, len(result.Columns))
+		pointers := make([]interface{}, len(values))
+
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+
+		err = rows.Scan(pointers...)
+
+		if err != nil {
+			return &AggregateResult{}, err
+		}
+
+		for i, v := range values {
+			values[i] = scannedValue(v, aggregateNumeric(q, i))
+		}
+
+		result.Rows = append(result.Rows, values)
+	}
+
+	err = rows.Err()
+
+	if err != nil {
+		return &AggregateResult{}, err
+	}
+
+	if len(result.Rows) > MaxAggregateGroups {
+		return &AggregateResult{}, fmt.Errorf("more than %d groups, group by fewer columns or filter the rows", MaxAggregateGroups)
+	}
+
+	return result, nil
+}
+
+// Converts a value scanned from Postgres to the value returned to clients.
+// Numerics are read as text to keep their precision.
+func scannedValue(v interface{}, numeric bool) interface{} {
+	if b, ok := v.([]byte); ok {
+		v = string(b)
+	}
+
+	if s, ok := v.(string); ok && numeric {
+		return json.Number(s)
+	}
+
+	return v
+}
+
+// Checks if the i-th result column holds numbers
+func aggregateNumeric(q AggregateQuery, i int) bool {
+	t := ""
+
+	if i < len(q.Group) {
+		t = q.Group[i].Type
+	} else {
+		a := q.Aggregates[i-len(q.Group)]
+
+		if a.Func == AggregateCount {
+			return true
+		}
+
+		t = a.Column.Type
+	}
+
+	return t == TypeInteger || t == TypeFloat
+}
@@ -0,0 +1,318 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// How the headers of a file appended to a document are matched against the
+// document's headers
+type HeaderMode string
+
+const (
+	// The file must have exactly the document's headers, in any order
+	HeaderModeStrict HeaderMode = "strict"
+	// The file may leave out document headers, their values are stored as null
+	HeaderModeSubset HeaderMode = "subset"
+	// Headers the document does not have are added to it
+	HeaderModeExtend HeaderMode = "extend"
+)
+
+// Parses a header mode, defaulting to strict when empty
+func ParseHeaderMode(s string) (HeaderMode, error) {
+	switch HeaderMode(s) {
+	case "":
+		return HeaderModeStrict, nil
+	case HeaderModeStrict, HeaderModeSubset, HeaderModeExtend:
+		return HeaderMode(s), nil
+	}
+
+	return "", errors.New("invalid header mode, expected strict, subset or extend")
+}
+
+// Describes the headers of an appended file that do not fit the document
+type HeaderMismatchError struct {
+	Missing    []string `json:"missing,omitempty"`
+	Unexpected []string `json:"unexpected,omitempty"`
+	Duplicate  []string `json:"duplicate,omitempty"`
+}
+
+func (e *HeaderMismatchError) Error() string {
+	parts := make([]string, 0, 3)
+
+	if len(e.Missing) > 0 {
+		parts = append(parts, "missing "+strings.Join(e.Missing, ", "))
+	}
+
+	if len(e.Unexpected) > 0 {
+		parts = append(parts, "unexpected "+strings.Join(e.Unexpected, ", "))
+	}
+
+	if len(e.Duplicate) > 0 {
+		parts = append(parts, "duplicate "+strings.Join(e.Duplicate, ", "))
+	}
+
+	return "headers do not match document: " + strings.Join(parts, "; ")
+}
+
+// Outcome of appending a file to a document
+type AppendResult struct {
+	// Rows inserted, and existing rows updated by upserting
+	RowsAppended int64      `json:"rows_appended"`
+	RowsUpdated  int64      `json:"rows_updated"`
+	AddedHeaders []string   `json:"added_headers,omitempty"`
+	Headers      []Header   `json:"headers"`
+	Rejected     []RowError `json:"rejected_rows,omitempty"`
+}
+
+// Appends the rows of a csv file to a document. Dialect settings left unset
+// are taken from the document, and the file's headers are matched against the
+// document's according to mode. Rows whose key already exists are updated when
+// upserting, keeping the values of columns the file does not give, and
+// rejected otherwise. Rows are written in a single transaction,
+// so a failed append leaves the document unchanged.
+func (d *Document) AppendRows(file io.Reader, db *gorm.DB, opts IngestOptions, mode HeaderMode) (*AppendResult, error) {
+	dialect, input, err := opts.Dialect.withDefaults(d.Dialect).Detect(file)
+
+	if err != nil {
+		return &AppendResult{}, err
+	}
+
+	src := csvSource{dialect.newReader(input)}
+	result := &AppendResult{}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		headers, err := d.GetDocumentHeaders(tx)
+
+		if err != nil {
+			return err
+		}
+
+		result, err = appendRecords(src, d, tx, opts, mode, dialect.HasHeader, headers)
+
+		if err != nil {
+			return err
+		}
+
+		return touchDocument(tx, d.ID)
+	})
+
+	if err != nil {
+		return &AppendResult{}, err
+	}
+
+	return result, nil
+}
+
+// Reads records from src into an existing document with the given headers.
+// Without a header row, columns are matched to the document's by position.
+func appendRecords(src recordSource, d *Document, db *gorm.DB, opts IngestOptions, mode HeaderMode, hasHeader bool, headers []Header) (*AppendResult, error) {
+	result := &AppendResult{Headers: headers}
+	first, err := firstRecord(src, false)
+
+	if err == io.EOF {
+		return result, nil
+	}
+
+	if err != nil {
+		return &AppendResult{}, err
+	}
+
+	fileHeaders := make([]string, len(first))
+
+	for i := range fileHeaders {
+		switch {
+		case hasHeader && first[i] != nil:
+			fileHeaders[i] = fmt.Sprint(first[i])
+		case !hasHeader && i < len(headers):
+			fileHeaders[i] = headers[i].Name
+		default:
+			fileHeaders[i] = fmt.Sprintf("column_%d", i+1)
+		}
+	}
+
+	err = matchHeaders(fileHeaders, headers, mode, d.KeyColumn)
+
+	if err != nil {
+		return &AppendResult{}, err
+	}
+
+	records := &recordStream{src: src, width: len(first), opts: opts, doc: d}
+
+	if !hasHeader {
+		records.pushBack(first)
+	}
+
+	sample, err := records.sample()
+
+	if err != nil {
+		return &AppendResult{}, err
+	}
+
+	index := make(map[string]int, len(headers))
+
+	for i, h := range headers {
+		index[h.Name] = i
+	}
+
+	newNames := make([]string, 0)
+	newTypes := make([]columnType, 0)
+	types := inferColumnTypes(fileHeaders, sample, opts.Types)
+
+	for i, name := range fileHeaders {
+		if _, ok := index[name]; !ok {
+			// Rows already in the document have no value for the new column
+			types[i].Nullable = true
+			newNames = append(newNames, name)
+			newTypes = append(newTypes, types[i])
+		}
+	}
+
+	added, err := d.CreateHeaders(db, newNames, newTypes)
+
+	if err != nil {
+		return &AppendResult{}, err
+	}
+
+	for _, h := range added {
+		index[h.Name] = len(headers)
+		headers = append(headers, h)
+	}
+
+	positions := make([]int, len(fileHeaders))
+
+	for i, name := range fileHeaders {
+		positions[i] = index[name]
+	}
+
+	w := newRowWriter(db, d.ID, headers, opts)
+
+	given := make([]bool, len(headers))
+
+	for _, p := range positions {
+		given[p] = true
+	}
+
+	for i, h := range headers {
+		if !given[i] {
+			w.missing = append(w.missing, h.Name)
+		}
+	}
+
+	// Only the columns added by the file had their types inferred from it
+	w.inferred = make([]bool, len(headers))
+
+	for i, inferred := range inferredColumns(added, opts.Types) {
+		w.inferred[len(headers)-len(added)+i] = inferred
+	}
+
+	err = w.enforceKey(d)
+
+	if err != nil {
+		return &AppendResult{}, err
+	}
+
+	err = w.enforceUnique(d)
+
+	if err != nil {
+		return &AppendResult{}, err
+	}
+
+	write := func(rec sourceRecord) error {
+		values := make([]interface{}, len(headers))
+
+		for i, v := range rec.values {
+			values[positions[i]] = v
+		}
+
+		err := w.write(sourceRecord{values: values, line: rec.line, raw: rec.raw})
+
+		if rowErr, ok := err.(*RowError); ok {
+			return opts.reject(d, rowErr)
+		}
+
+		return err
+	}
+
+	for _, rec := range sample {
+		if err = write(rec); err != nil {
+			return &AppendResult{}, err
+		}
+	}
+
+	for {
+		rec, err := records.next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return &AppendResult{}, err
+		}
+
+		if err = write(rec); err != nil {
+			return &AppendResult{}, err
+		}
+	}
+
+	err = w.flush()
+
+	if err != nil {
+		return &AppendResult{}, err
+	}
+
+	err = w.updateNullable()
+
+	if err != nil {
+		return &AppendResult{}, err
+	}
+
+	result.RowsAppended = w.written - w.updated
+	result.RowsUpdated = w.updated
+	result.AddedHeaders = newNames
+	result.Headers = headers
+	result.Rejected = d.Rejected
+
+	return result, nil
+}
+
+// Checks the headers of an appended file against the document's headers. The
+// key column, when the document has one, is required in every mode.
+func matchHeaders(fileHeaders []string, headers []Header, mode HeaderMode, key string) error {
+	mismatch := &HeaderMismatchError{}
+	seen := make(map[string]bool, len(fileHeaders))
+	known := make(map[string]bool, len(headers))
+
+	for _, h := range headers {
+		known[h.Name] = true
+	}
+
+	for _, name := range fileHeaders {
+		if seen[name] {
+			mismatch.Duplicate = append(mismatch.Duplicate, name)
+		}
+
+		seen[name] = true
+
+		if !known[name] && mode != HeaderModeExtend {
+			mismatch.Unexpected = append(mismatch.Unexpected, name)
+		}
+	}
+
+	for _, h := range headers {
+		if !seen[h.Name] && (mode == HeaderModeStrict || h.Name == key) {
+			mismatch.Missing = append(mismatch.Missing, h.Name)
+		}
+	}
+
+	if len(mismatch.Missing) == 0 && len(mismatch.Unexpected) == 0 && len(mismatch.Duplicate) == 0 {
+		return nil
+	}
+
+	return mismatch
+}
@@ -0,0 +1,81 @@
+package model
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pborman/uuid"
+	"gorm.io/gorm"
+)
+
+func TestAppendUpsertKeepsMissingColumns(t *testing.T) {
+	var statements []string
+
+	db := dryRunDB(t, func([]Row) {})
+	err := db.Callback().Create().After("gorm:create").Register("test:sql", func(tx *gorm.DB) {
+		statements = append(statements, tx.Dialector.Explain(tx.Statement.SQL.String(), tx.Statement.Vars...))
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Document{ID: uuid.NewRandom(), KeyColumn: "sku"}
+	headers := []Header{
+		{Name: "sku", Type: TypeString},
+		{Name: "price", Type: TypeInteger},
+		{Name: "note", Type: TypeString, Nullable: true},
+	}
+
+	src := csvSource{DefaultDialect().newReader(strings.NewReader("price,sku\n1,a\n2,b\n"))}
+	result, err := appendRecords(src, d, db, IngestOptions{Upsert: true}, HeaderModeSubset, true, headers)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(statements) != 1 || !strings.Contains(statements[0], `DO UPDATE SET "data"=rows.data || (excluded.data - 'note')`) {
+		t.Errorf("got statements %q, want data merged without note", statements)
+	}
+
+	// Nothing is stored in a dry run, so every row counts as inserted
+	if result.RowsAppended != 2 || result.RowsUpdated != 0 {
+		t.Errorf("got %d appended and %d updated, want 2 and 0", result.RowsAppended, result.RowsUpdated)
+	}
+}
+
+func TestAppendUpsertPostgres(t *testing.T) {
+	db := postgresDB(t)
+
+	d := &Document{}
+	_, err := d.CreateDocument(strings.NewReader("sku,price,note\na,1,first\nb,2,second\n"), "append", db, &User{ID: uuid.NewRandom()}, IngestOptions{Key: "sku"})
+
+	defer dropDocument(db, d)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := d.AppendRows(strings.NewReader("sku,price\nb,5\nc,3\n"), db, IngestOptions{Upsert: true}, HeaderModeSubset)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.RowsAppended != 1 || result.RowsUpdated != 1 {
+		t.Errorf("got %d appended and %d updated, want 1 and 1", result.RowsAppended, result.RowsUpdated)
+	}
+
+	row := &Row{}
+	updated, err := row.GetRowByKey(db, d.ID, "b")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := rowData(t, []Row{*updated})[0]
+
+	if data["price"] != 5.0 || data["note"] != "second" {
+		t.Errorf("got row %v, want price 5 with its note kept", data)
+	}
+}
@@ -0,0 +1,207 @@
+package model
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// Reads csv records while keeping track of the line each record starts on
+// and its raw text, so malformed rows can be reported back to the uploader.
+type csvReader struct {
+	r *bufio.Reader
+
+	// Field delimiter
+	Comma rune
+	// Quote character, zero disables quoting
+	Quote rune
+	// Allows quotes to appear in unquoted fields and unescaped in quoted fields
+	LazyQuotes bool
+	// Lines starting with this character are ignored, zero disables comments
+	Comment rune
+
+	line  int
+	start int
+	raw   strings.Builder
+}
+
+func newCSVReader(r io.Reader) *csvReader {
+	return &csvReader{
+		r:     bufio.NewReader(r),
+		Comma: ',',
+		Quote: '"',
+	}
+}
+
+// Line number the last record read started on
+func (c *csvReader) Line() int {
+	return c.start
+}
+
+// Raw text of the last record read, without its trailing line break
+func (c *csvReader) Raw() string {
+	return trimEOL(c.raw.String())
+}
+
+// Reads the next record. Malformed records are returned as *RowError and the
+// reader can keep reading after them; io.EOF is returned at the end of input.
+func (c *csvReader) Read() ([]string, error) {
+	for {
+		line, err := c.readLine()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if c.Comment != 0 && strings.HasPrefix(line, string(c.Comment)) {
+			continue
+		}
+
+		if trimEOL(line) == "" {
+			continue
+		}
+
+		c.start = c.line
+		c.raw.Reset()
+		c.raw.WriteString(line)
+
+		record, reason := c.parseRecord(line)
+
+		if reason != "" {
+			return nil, &RowError{Line: c.start, Raw: c.Raw(), Reason: reason}
+		}
+
+		return record, nil
+	}
+}
+
+// Reads one physical line including its line break
+func (c *csvReader) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+
+	if len(line) > 0 {
+		c.line++
+		return line, nil
+	}
+
+	return "", err
+}
+
+// Splits a record into fields, reading further lines for quoted fields that
+// span line breaks. Returns a non-empty reason when the record is malformed.
+func (c *csvReader) parseRecord(line string) ([]string, string) {
+	comma := string(c.Comma)
+	quote := ""
+	if c.Quote != 0 {
+		quote = string(c.Quote)
+	}
+
+	fields := make([]string, 0)
+	pos := 0
+
+	for {
+		if quote != "" && strings.HasPrefix(line[pos:], quote) {
+			var field strings.Builder
+			pos += len(quote)
+
+		quoted:
+			for {
+				i := strings.Index(line[pos:], quote)
+
+				if i < 0 {
+					field.WriteString(line[pos:])
+
+					next, err := c.readLine()
+
+					if err != nil {
+						if c.LazyQuotes {
+							fields = append(fields, trimEOL(field.String()))
+							return fields, ""
+						}
+						return nil, "extraneous or missing " + quote + " in quoted-field"
+					}
+
+					c.raw.WriteString(next)
+					line = next
+					pos = 0
+					continue
+				}
+
+				field.WriteString(line[pos : pos+i])
+				pos += i + len(quote)
+				rest := line[pos:]
+
+				switch {
+				case strings.HasPrefix(rest, quote):
+					field.WriteString(quote)
+					pos += len(quote)
+				case strings.HasPrefix(rest, comma):
+					fields = append(fields, normalizeEOL(field.String()))
+					pos += len(comma)
+					break quoted
+				case trimEOL(rest) == "":
+					fields = append(fields, normalizeEOL(field.String()))
+					return fields, ""
+				case c.LazyQuotes:
+					field.WriteString(quote)
+				default:
+					return nil, "extraneous or missing " + quote + " in quoted-field"
+				}
+			}
+
+			continue
+		}
+
+		i := strings.Index(line[pos:], comma)
+
+		var field string
+		if i < 0 {
+			field = trimEOL(line[pos:])
+		} else {
+			field = line[pos : pos+i]
+		}
+
+		if quote != "" && !c.LazyQuotes && strings.Contains(field, quote) {
+			return nil, "bare " + quote + " in non-quoted-field"
+		}
+
+		fields = append(fields, field)
+
+		if i < 0 {
+			return fields, ""
+		}
+
+		pos += i + len(comma)
+	}
+}
+
+func trimEOL(s string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(s, "\n"), "\r")
+}
+
+func normalizeEOL(s string) string {
+	return strings.Replace(s, "\r\n", "\n", -1)
+}
+
+// Adapts a csv reader to a record source
+type csvSource struct {
+	r *csvReader
+}
+
+func (s csvSource) Read() ([]interface{}, error) {
+	record, err := s.r.Read()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return stringValues(record), nil
+}
+
+func (s csvSource) Line() int {
+	return s.r.Line()
+}
+
+func (s csvSource) Raw() string {
+	return s.r.Raw()
+}
@@ -0,0 +1,134 @@
+package model
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type csvRead struct {
+	record []string
+	line   int
+	raw    string
+	reason string
+}
+
+func TestCSVReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		setup   func(*csvReader)
+		records []csvRead
+	}{
+		{
+			name:  "plain",
+			input: "a,b,c\n1,2,3\n",
+			records: []csvRead{
+				{record: []string{"a", "b", "c"}, line: 1, raw: "a,b,c"},
+				{record: []string{"1", "2", "3"}, line: 2, raw: "1,2,3"},
+			},
+		},
+		{
+			name:  "crlf without final line break",
+			input: "a,b\r\n1,\r\n\r\n2,x",
+			records: []csvRead{
+				{record: []string{"a", "b"}, line: 1, raw: "a,b"},
+				{record: []string{"1", ""}, line: 2, raw: "1,"},
+				{record: []string{"2", "x"}, line: 4, raw: "2,x"},
+			},
+		},
+		{
+			name:  "quoted fields",
+			input: "\"a,b\",\"say \"\"hi\"\"\",\"\"\n\"two\r\nlines\",x\ny\n",
+			records: []csvRead{
+				{record: []string{"a,b", `say "hi"`, ""}, line: 1, raw: `"a,b","say ""hi""",""`},
+				{record: []string{"two\nlines", "x"}, line: 2, raw: "\"two\r\nlines\",x"},
+				{record: []string{"y"}, line: 4, raw: "y"},
+			},
+		},
+		{
+			name:  "malformed rows are skipped",
+			input: "a,b\n1,x\"y\n\"open,2\n3,4\n",
+			records: []csvRead{
+				{record: []string{"a", "b"}, line: 1, raw: "a,b"},
+				{line: 2, raw: `1,x"y`, reason: `bare " in non-quoted-field`},
+				{line: 3, raw: "\"open,2\n3,4", reason: `extraneous or missing " in quoted-field`},
+			},
+		},
+		{
+			name:  "text after a closing quote",
+			input: "\"a\"b,c\nd\n",
+			records: []csvRead{
+				{line: 1, raw: `"a"b,c`, reason: `extraneous or missing " in quoted-field`},
+				{record: []string{"d"}, line: 2, raw: "d"},
+			},
+		},
+		{
+			name:  "lazy quotes",
+			input: "1,x\"y\n\"a\"b\",c\n\"open\n",
+			setup: func(c *csvReader) { c.LazyQuotes = true },
+			records: []csvRead{
+				{record: []string{"1", `x"y`}, line: 1, raw: `1,x"y`},
+				{record: []string{`a"b`, "c"}, line: 2, raw: `"a"b",c`},
+				{record: []string{"open"}, line: 3, raw: `"open`},
+			},
+		},
+		{
+			name:  "dialect",
+			input: "# note\n'a;b';c\n#x;y\n",
+			setup: func(c *csvReader) { c.Comma = ';'; c.Quote = '\''; c.Comment = '#' },
+			records: []csvRead{
+				{record: []string{"a;b", "c"}, line: 2, raw: "'a;b';c"},
+			},
+		},
+		{
+			name:  "no quoting",
+			input: "\"a\"\t\"b\n",
+			setup: func(c *csvReader) { c.Comma = '\t'; c.Quote = 0 },
+			records: []csvRead{
+				{record: []string{`"a"`, `"b`}, line: 1, raw: "\"a\"\t\"b"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newCSVReader(strings.NewReader(tt.input))
+
+			if tt.setup != nil {
+				tt.setup(r)
+			}
+
+			for _, want := range tt.records {
+				record, err := r.Read()
+
+				var rowErr *RowError
+
+				switch {
+				case want.reason != "":
+					if !errors.As(err, &rowErr) || rowErr.Reason != want.reason || rowErr.Line != want.line || rowErr.Raw != want.raw {
+						t.Fatalf("got %v, %v, want row error %+v", record, err, want)
+					}
+
+					continue
+				case err != nil:
+					t.Fatalf("got %v, want %q", err, want.record)
+				}
+
+				if !reflect.DeepEqual(record, want.record) {
+					t.Errorf("got %q, want %q", record, want.record)
+				}
+
+				if r.Line() != want.line || r.Raw() != want.raw {
+					t.Errorf("got line %d %q, want %d %q", r.Line(), r.Raw(), want.line, want.raw)
+				}
+			}
+
+			if record, err := r.Read(); err != io.EOF {
+				t.Errorf("got %q, %v, want EOF", record, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package model
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	textunicode "golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// Writes csv records in a document's dialect, so exports are read back the
+// way the document was imported
+type CSVWriter struct {
+	w *bufio.Writer
+	// Encodes the output when the dialect is not UTF-8
+	encoder io.WriteCloser
+
+	comma   rune
+	quote   rune
+	comment rune
+	header  bool
+}
+
+// Starts csv output in a dialect. Documents stored without a dialect are
+// written as standard csv.
+func NewCSVWriter(w io.Writer, d Dialect) (*CSVWriter, error) {
+	if d.Delimiter == "" {
+		d = DefaultDialect()
+	}
+
+	c := &CSVWriter{header: d.HasHeader}
+	c.comma = dialectRune(d.Delimiter)
+	c.quote = dialectRune(d.Quote)
+	c.comment = dialectRune(d.Comment)
+
+	enc, err := exportEncoding(d.Encoding)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if enc != nil {
+		c.encoder = transform.NewWriter(w, enc.NewEncoder())
+		w = c.encoder
+	}
+
+	c.w = bufio.NewWriter(w)
+
+	return c, nil
+}
+
+// Reports whether the dialect starts with a record of the column names
+func (c *CSVWriter) HasHeader() bool {
+	return c.header
+}
+
+// Writes a record. Without a quote character, fields holding the delimiter or
+// a line break cannot be written and return an error.
+func (c *CSVWriter) Write(record []string) error {
+	for i, field := range record {
+		if i > 0 {
+			c.w.WriteRune(c.comma)
+		}
+
+		if c.quote == 0 && c.ambiguous(field, i == 0) {
+			return fmt.Errorf("value %q cannot be written without a quote character", field)
+		}
+
+		if c.quote == 0 || !c.needsQuotes(field, i == 0) {
+			c.w.WriteString(field)
+			continue
+		}
+
+		q := string(c.quote)
+		c.w.WriteString(q)
+		c.w.WriteString(strings.Replace(field, q, q+q, -1))
+		_, err := c.w.WriteString(q)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := c.w.WriteString("\n")
+
+	return err
+}
+
+// Writes any buffered output and ends the encoding
+func (c *CSVWriter) Flush() error {
+	err := c.w.Flush()
+
+	if err != nil {
+		return err
+	}
+
+	if c.encoder != nil {
+		return c.encoder.Close()
+	}
+
+	return nil
+}
+
+// Reports whether a field would be read back differently unless quoted
+func (c *CSVWriter) needsQuotes(field string, first bool) bool {
+	if c.ambiguous(field, first) || strings.ContainsRune(field, c.quote) {
+		return true
+	}
+
+	r, _ := utf8.DecodeRuneInString(field)
+
+	return field != "" && unicode.IsSpace(r)
+}
+
+// Reports whether a field holds a delimiter or line break, or would be taken
+// for a comment, which only quoting can tell apart
+func (c *CSVWriter) ambiguous(field string, first bool) bool {
+	if strings.ContainsRune(field, c.comma) || strings.ContainsAny(field, "\r\n") {
+		return true
+	}
+
+	return first && c.comment != 0 && strings.HasPrefix(field, string(c.comment))
+}
+
+// Character of a dialect setting, zero when unset
+func dialectRune(s string) rune {
+	if s == "" || s == QuoteNone {
+		return 0
+	}
+
+	r, _ := utf8.DecodeRuneInString(s)
+
+	return r
+}
+
+// Encoder of an export encoding, nil for UTF-8. UTF-16 output starts with a
+// byte order mark so it is detected when uploaded again.
+func exportEncoding(name string) (encoding.Encoding, error) {
+	switch canonicalEncoding(name) {
+	case "":
+		return nil, nil
+	case EncodingUTF16LE:
+		return textunicode.UTF16(textunicode.LittleEndian, textunicode.UseBOM), nil
+	case EncodingUTF16BE:
+		return textunicode.UTF16(textunicode.BigEndian, textunicode.UseBOM), nil
+	}
+
+	return lookupEncoding(name)
+}
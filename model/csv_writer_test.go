@@ -0,0 +1,136 @@
+package model
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestCSVWriterRoundTrip(t *testing.T) {
+	records := [][]string{
+		{"name", "note", "price"},
+		{"Widget", "a; b, c", "1.5"},
+		{"#hash", `say "hi"`, ""},
+		{" padded", "two\nlines", "3"},
+		{"'single'", "|pipe|", "4"},
+	}
+
+	tests := []struct {
+		name    string
+		dialect Dialect
+	}{
+		{"standard", DefaultDialect()},
+		{"semicolon", Dialect{Delimiter: ";", Quote: `"`, HasHeader: true, Encoding: EncodingUTF8}},
+		{"single quotes", Dialect{Delimiter: ",", Quote: "'", HasHeader: true, Encoding: EncodingUTF8}},
+		{"pipe with comments", Dialect{Delimiter: "|", Quote: `"`, Comment: "#", HasHeader: true, Encoding: EncodingUTF8}},
+		{"tab in latin-1", Dialect{Delimiter: "\t", Quote: `"`, HasHeader: true, Encoding: EncodingLatin1}},
+		{"utf-16", Dialect{Delimiter: ",", Quote: `"`, HasHeader: true, Encoding: EncodingUTF16LE}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			w, err := NewCSVWriter(&buf, tt.dialect)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, record := range records {
+				if err := w.Write(record); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			d, input, err := tt.dialect.Options().Detect(&buf)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := d.newReader(input)
+
+			for i, want := range records {
+				got, err := r.Read()
+
+				if err != nil {
+					t.Fatalf("record %d: %v", i, err)
+				}
+
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("record %d: got %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCSVWriterWithoutQuotes(t *testing.T) {
+	dialect := Dialect{Delimiter: ",", HasHeader: true, Encoding: EncodingUTF8}
+
+	tests := []struct {
+		record []string
+		want   string
+		fails  bool
+	}{
+		{[]string{"a", `"b"`, " c"}, "a,\"b\", c\n", false},
+		{[]string{"a,b"}, "", true},
+		{[]string{"a\nb"}, "", true},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+
+		w, err := NewCSVWriter(&buf, dialect)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = w.Write(tt.record)
+
+		if tt.fails {
+			if err == nil {
+				t.Errorf("%q: expected an error", tt.record)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%q: %v", tt.record, err)
+		}
+
+		w.Flush()
+
+		if buf.String() != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.record, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestCSVWriterDefaultsToStandardCSV(t *testing.T) {
+	var buf bytes.Buffer
+
+	w, err := NewCSVWriter(&buf, Dialect{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !w.HasHeader() {
+		t.Error("expected a header for documents without a dialect")
+	}
+
+	w.Write([]string{"a", "b,c"})
+	w.Flush()
+
+	if buf.String() != "a,\"b,c\"\n" {
+		t.Errorf("got %q", buf.String())
+	}
+}
@@ -0,0 +1,435 @@
+package model
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// Character encodings accepted for uploads
+const (
+	EncodingUTF8        = "utf-8"
+	EncodingUTF16LE     = "utf-16le"
+	EncodingUTF16BE     = "utf-16be"
+	EncodingLatin1      = "iso-8859-1"
+	EncodingWindows1252 = "windows-1252"
+)
+
+// Quote value that disables quoting
+const QuoteNone = "none"
+
+// Number of bytes inspected when detecting a dialect
+const sniffSize = 8192
+
+// Delimiters tried when detecting a dialect, most common first
+var sniffDelimiters = []string{",", ";", "\t", "|"}
+
+// CSV parsing settings of a document
+type Dialect struct {
+	Delimiter  string `gorm:"size:4" json:"delimiter"`
+	Quote      string `gorm:"size:4" json:"quote"`
+	LazyQuotes bool   `json:"lazy_quotes"`
+	Comment    string `gorm:"size:4" json:"comment"`
+	HasHeader  bool   `json:"has_header"`
+	Encoding   string `gorm:"size:32" json:"encoding"`
+}
+
+// Dialect used for documents that were not imported from csv, so they are
+// exported as standard csv
+func DefaultDialect() Dialect {
+	return Dialect{Delimiter: ",", Quote: `"`, HasHeader: true, Encoding: EncodingUTF8}
+}
+
+// Dialect settings given with an upload. Empty delimiter, quote and encoding
+// and a nil HasHeader are detected from the file.
+type DialectOptions struct {
+	Delimiter  string `json:"delimiter,omitempty"`
+	Quote      string `json:"quote,omitempty"`
+	LazyQuotes bool   `json:"lazy_quotes,omitempty"`
+	Comment    string `json:"comment,omitempty"`
+	HasHeader  *bool  `json:"has_header,omitempty"`
+	Encoding   string `json:"encoding,omitempty"`
+}
+
+// Options that reproduce a stored dialect exactly
+func (d Dialect) Options() DialectOptions {
+	hasHeader := d.HasHeader
+
+	quote := d.Quote
+	if quote == "" {
+		quote = QuoteNone
+	}
+
+	return DialectOptions{
+		Delimiter:  d.Delimiter,
+		Quote:      quote,
+		LazyQuotes: d.LazyQuotes,
+		Comment:    d.Comment,
+		HasHeader:  &hasHeader,
+		Encoding:   d.Encoding,
+	}
+}
+
+// Fills settings left unset from a stored dialect, so files added to an
+// existing document are read the way it was imported. The encoding is still
+// detected for each file.
+func (o DialectOptions) withDefaults(d Dialect) DialectOptions {
+	if d.Delimiter == "" {
+		return o
+	}
+
+	stored := d.Options()
+
+	if o.Delimiter == "" {
+		o.Delimiter = stored.Delimiter
+	}
+
+	if o.Quote == "" {
+		o.Quote = stored.Quote
+	}
+
+	if o.Comment == "" {
+		o.Comment = stored.Comment
+	}
+
+	if o.HasHeader == nil {
+		o.HasHeader = stored.HasHeader
+	}
+
+	o.LazyQuotes = o.LazyQuotes || stored.LazyQuotes
+
+	return o
+}
+
+// Checks dialect settings given with an upload
+func (o DialectOptions) Validate() error {
+	if o.Delimiter != "" && utf8.RuneCountInString(o.Delimiter) != 1 {
+		return errors.New("delimiter must be a single character")
+	}
+
+	if o.Quote != "" && o.Quote != QuoteNone && utf8.RuneCountInString(o.Quote) != 1 {
+		return errors.New("quote must be a single character or none")
+	}
+
+	if o.Comment != "" && utf8.RuneCountInString(o.Comment) != 1 {
+		return errors.New("comment must be a single character")
+	}
+
+	if o.Delimiter != "" && (o.Delimiter == o.Quote || o.Delimiter == o.Comment) {
+		return errors.New("delimiter must differ from quote and comment characters")
+	}
+
+	if o.Encoding != "" {
+		if _, err := lookupEncoding(o.Encoding); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Normalises an encoding name, returning the decoder for it
+func lookupEncoding(name string) (encoding.Encoding, error) {
+	switch strings.ToLower(name) {
+	case EncodingUTF8, "utf8":
+		return nil, nil
+	case EncodingUTF16LE:
+		return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), nil
+	case EncodingUTF16BE:
+		return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM), nil
+	case EncodingLatin1, "latin-1", "latin1":
+		return charmap.ISO8859_1, nil
+	case EncodingWindows1252, "cp1252":
+		return charmap.Windows1252, nil
+	}
+
+	return nil, fmt.Errorf("unsupported encoding %q", name)
+}
+
+func canonicalEncoding(name string) string {
+	switch strings.ToLower(name) {
+	case "utf8":
+		return EncodingUTF8
+	case "latin-1", "latin1":
+		return EncodingLatin1
+	case "cp1252":
+		return EncodingWindows1252
+	}
+	return strings.ToLower(name)
+}
+
+// Resolves the dialect of an upload from the given options, sniffing the
+// start of the file for anything left unset. Returns the UTF-8 decoded input
+// with any byte order mark removed.
+func (o DialectOptions) Detect(file io.Reader) (Dialect, io.Reader, error) {
+	br := bufio.NewReaderSize(file, sniffSize)
+	head, err := br.Peek(sniffSize)
+
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return Dialect{}, nil, err
+	}
+
+	d := Dialect{
+		Delimiter:  o.Delimiter,
+		Quote:      o.Quote,
+		LazyQuotes: o.LazyQuotes,
+		Comment:    o.Comment,
+		Encoding:   canonicalEncoding(o.Encoding),
+	}
+
+	bom := 0
+
+	switch {
+	case bytes.HasPrefix(head, []byte{0xEF, 0xBB, 0xBF}):
+		bom = 3
+		if d.Encoding == "" {
+			d.Encoding = EncodingUTF8
+		}
+	case bytes.HasPrefix(head, []byte{0xFF, 0xFE}):
+		bom = 2
+		if d.Encoding == "" {
+			d.Encoding = EncodingUTF16LE
+		}
+	case bytes.HasPrefix(head, []byte{0xFE, 0xFF}):
+		bom = 2
+		if d.Encoding == "" {
+			d.Encoding = EncodingUTF16BE
+		}
+	}
+
+	if bom > 0 {
+		br.Discard(bom)
+		head = head[bom:]
+	}
+
+	if d.Encoding == "" {
+		d.Encoding = EncodingUTF8
+		if !validUTF8Prefix(head) {
+			d.Encoding = EncodingWindows1252
+		}
+	}
+
+	enc, err := lookupEncoding(d.Encoding)
+
+	if err != nil {
+		return Dialect{}, nil, err
+	}
+
+	var input io.Reader = br
+	text := string(head)
+
+	if enc != nil {
+		input = transform.NewReader(br, enc.NewDecoder())
+		decoded, _, _ := transform.Bytes(enc.NewDecoder(), head)
+		text = string(decoded)
+	}
+
+	lines := sniffLines(text, d.Comment)
+
+	if d.Quote == "" {
+		d.Quote = sniffQuote(lines)
+	} else if d.Quote == QuoteNone {
+		d.Quote = ""
+	}
+
+	if d.Delimiter == "" {
+		d.Delimiter = sniffDelimiter(lines, d.Quote)
+	}
+
+	if o.HasHeader != nil {
+		d.HasHeader = *o.HasHeader
+	} else {
+		d.HasHeader = sniffHeader(text, d)
+	}
+
+	return d, input, nil
+}
+
+// Creates a csv reader using the dialect's settings
+func (d Dialect) newReader(r io.Reader) *csvReader {
+	c := newCSVReader(r)
+	c.Comma, _ = utf8.DecodeRuneInString(d.Delimiter)
+	c.Quote, _ = utf8.DecodeRuneInString(d.Quote)
+	c.Comment, _ = utf8.DecodeRuneInString(d.Comment)
+	c.LazyQuotes = d.LazyQuotes
+
+	if d.Quote == "" {
+		c.Quote = 0
+	}
+
+	if d.Comment == "" {
+		c.Comment = 0
+	}
+
+	return c
+}
+
+// Checks if b is valid UTF-8, allowing a rune cut off at the end
+func validUTF8Prefix(b []byte) bool {
+	for i := 0; i < utf8.UTFMax && len(b) > 0; i++ {
+		if utf8.Valid(b) {
+			return true
+		}
+		b = b[:len(b)-1]
+	}
+	return utf8.Valid(b)
+}
+
+// Complete, non-comment lines from the sniffed text
+func sniffLines(text string, comment string) []string {
+	lines := strings.Split(text, "\n")
+
+	// The last line may be cut off by the sniff window
+	if len(lines) > 1 {
+		lines = lines[:len(lines)-1]
+	}
+
+	result := make([]string, 0, len(lines))
+
+	for _, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+
+		if line == "" || (comment != "" && strings.HasPrefix(line, comment)) {
+			continue
+		}
+
+		result = append(result, line)
+	}
+
+	return result
+}
+
+// Picks the quote character that most often opens a field
+func sniffQuote(lines []string) string {
+	best, bestCount := `"`, 0
+
+	for _, q := range []string{`"`, "'"} {
+		count := 0
+
+		for _, line := range lines {
+			if strings.HasPrefix(line, q) {
+				count++
+			}
+
+			for _, delim := range sniffDelimiters {
+				count += strings.Count(line, delim+q)
+			}
+		}
+
+		if count > bestCount {
+			best, bestCount = q, count
+		}
+	}
+
+	return best
+}
+
+// Picks the delimiter that appears the same, non-zero number of times on the
+// most lines, ignoring delimiters inside quoted text
+func sniffDelimiter(lines []string, quote string) string {
+	best, bestScore, bestMode := ",", 0, 0
+
+	for _, delim := range sniffDelimiters {
+		freq := make(map[int]int)
+
+		for _, line := range lines {
+			freq[countOutsideQuotes(line, delim, quote)]++
+		}
+
+		mode, score := 0, 0
+		for count, lines := range freq {
+			if count > 0 && (lines > score || (lines == score && count > mode)) {
+				mode, score = count, lines
+			}
+		}
+
+		if score > bestScore || (score == bestScore && mode > bestMode) {
+			best, bestScore, bestMode = delim, score, mode
+		}
+	}
+
+	return best
+}
+
+func countOutsideQuotes(line string, delim string, quote string) int {
+	if quote == "" {
+		return strings.Count(line, delim)
+	}
+
+	count := 0
+	quoted := false
+
+	for _, part := range strings.Split(line, quote) {
+		if !quoted {
+			count += strings.Count(part, delim)
+		}
+		quoted = !quoted
+	}
+
+	return count
+}
+
+// Guesses whether the first record is a header: columns whose later values
+// all share a non-string type vote for a header when the first value does
+// not fit that type, and against when it does
+func sniffHeader(text string, d Dialect) bool {
+	r := d.newReader(strings.NewReader(text))
+	records := make([][]string, 0)
+
+	for len(records) < 20 {
+		record, err := r.Read()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			continue
+		}
+
+		records = append(records, record)
+	}
+
+	// Without complete data rows there is nothing to compare against
+	if len(records) < 3 {
+		return true
+	}
+
+	// The last record may be cut off by the sniff window
+	records = records[:len(records)-1]
+	first := records[0]
+	votes := 0
+
+	for i := range first {
+		candidates := newTypeCandidates()
+
+		for _, record := range records[1:] {
+			if i < len(record) {
+				candidates.observe(record[i])
+			}
+		}
+
+		t := candidates.result().Type
+
+		if t == TypeString {
+			continue
+		}
+
+		if _, err := ConvertValue(t, first[i]); err != nil {
+			votes++
+		} else {
+			votes--
+		}
+	}
+
+	return votes >= 0
+}
@@ -1,13 +1,11 @@
 package model
 
 import (
-	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"gorm.io/datatypes"
 	"gorm.io/gorm"
 	"io"
-	"log"
-	"mime/multipart"
 	"strings"
 	"time"
 
@@ -19,22 +17,35 @@ type JSONB map[string]interface{}
 
 // CSV file model
 type Document struct {
-	ID        uuid.UUID `gorm:"primary_key;" json:"id"`
-	UserID    uuid.UUID `json:"-"`
-	Title     string    `gorm:"size:255;not null" json:"title"`
-	Header    []Header  `gorm:"not null" json:"headers"`
-	Row       []Row     `gorm:"OnDelete:SET NULL;" json:"rows"`
-	CreatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"-"`
-	UpdatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"-"`
+	ID        uuid.UUID  `gorm:"primary_key;" json:"id"`
+	UserID    uuid.UUID  `json:"-"`
+	Title     string     `gorm:"size:255;not null" json:"title"`
+	Header    []Header   `gorm:"not null" json:"headers,omitempty"`
+	Row       []Row      `gorm:"OnDelete:SET NULL;" json:"rows,omitempty"`
+	CreatedAt time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"-"`
+	UpdatedAt time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"-"`
+	Format    string     `gorm:"size:16;not null;default:'csv'" json:"format"`
+	Dialect   Dialect    `gorm:"embedded;embeddedPrefix:dialect_" json:"dialect"`
+	KeyColumn string     `gorm:"size:255" json:"key_column,omitempty"`
+	Rejected  []RowError `gorm:"-" json:"rejected_rows,omitempty"`
+	// Rows written and rejected by the upload that created the document
+	RowsIngested int64 `gorm:"-" json:"rows_ingested,omitempty"`
+	RowsRejected int   `gorm:"-" json:"rows_rejected,omitempty"`
+	// Rules of the headers being replaced, by name, for the new headers of
+	// the same name
+	keptRules map[string]Rules
 }
 
 // CSV row model
 type Row struct {
 	ID         uint           `gorm:"primary_key;auto_increment" json:"id"`
-	DocumentID uuid.UUID      `gorm:"not null" json:"-"`
+	DocumentID uuid.UUID      `gorm:"not null;uniqueIndex:idx_rows_document_key" json:"-"`
+	Key        *string        `gorm:"uniqueIndex:idx_rows_document_key" json:"-"`
 	Data       datatypes.JSON `type:"jsonb not null default '{}'::jsonb" json:"data"`
 	CreatedAt  time.Time      `gorm:"default:CURRENT_TIMESTAMP" json:"-"`
 	UpdatedAt  time.Time      `gorm:"default:CURRENT_TIMESTAMP" json:"-"`
+	// Matching values of a full text search, by column
+	Highlights map[string]string `gorm:"-" json:"highlights,omitempty"`
 }
 
 // CSV header model
@@ -42,6 +53,9 @@ type Header struct {
 	ID         uint      `gorm:"primary_key;auto_increment" json:"-"`
 	DocumentID uuid.UUID `gorm:"not null" json:"-"`
 	Name       string    `gorm:"not null" json:"name"`
+	Type       string    `gorm:"not null;default:'string'" json:"type"`
+	Nullable   bool      `gorm:"not null;default:false" json:"nullable"`
+	Rules      Rules     `gorm:"type:jsonb;not null;default:'{}'" json:"rules"`
 }
 
 // Assign data to document model
@@ -62,116 +76,151 @@ func (r *Row) PrepareRow(docID uuid.UUID, data datatypes.JSON) {
 }
 
 // Assign data to header model
-func (h *Header) PrepareHeader(docID uuid.UUID, name string) {
+func (h *Header) PrepareHeader(docID uuid.UUID, name string, t columnType) {
 	h.DocumentID = docID
 	h.Name = name
+	h.Type = t.Type
+	h.Nullable = t.Nullable
 }
 
-// Creates a document in database
-func (d *Document) CreateDocument(file multipart.File, fname string, db *gorm.DB, authenticatedUser *User) (*Document, error) {
-	var err error
-
+// Creates a document in database from an uploaded file in the format given by
+// the options. The document, its headers and rows are written in a single
+// transaction so a failed upload leaves nothing behind. The returned document
+// holds its headers and the counts of written and rejected rows, not the rows.
+func (d *Document) CreateDocument(file io.Reader, fname string, db *gorm.DB, authenticatedUser *User, opts IngestOptions) (*Document, error) {
 	d.PrepareDocument(fname, authenticatedUser.ID)
+	d.KeyColumn = strings.TrimSpace(opts.Key)
 
-	err = db.Create(&d).Error
+	ingest, cleanup, err := d.ingester(file, opts)
 
 	if err != nil {
 		return &Document{}, err
 	}
 
-	err = CSV2Map(file, d, db)
+	defer cleanup()
 
-	if err != nil {
-		return &Document{}, err
-	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(&d).Error
 
-	rows := []Row{}
+		if err != nil {
+			return err
+		}
 
-	err = db.Model(&Row{}).Where("document_id = ?", d.ID).Find(&rows).Error
+		return ingest(tx)
+	})
 
 	if err != nil {
 		return &Document{}, err
 	}
 
-	d.Row = rows
+	d.RowsRejected = len(d.Rejected)
 
 	return d, nil
 }
 
-// Converts csv rows to JSONB map and creates document headers
-func CSV2Map(file multipart.File, d *Document, db *gorm.DB) error {
-	r := csv.NewReader(file)
+// Prepares to read an uploaded file in the format given by the options into
+// the document, setting its format and dialect. The returned cleanup function
+// releases any temporary file.
+func (d *Document) ingester(file io.Reader, opts IngestOptions) (func(tx *gorm.DB) error, func(), error) {
+	switch opts.Format {
+	case FormatXLSX:
+		ra, size, cleanup, err := readerAt(file)
 
-	var docHeaders []string
-
-	for {
-		record, err := r.Read()
-		if err == io.EOF {
-			break
-		}
 		if err != nil {
-			log.Fatal(err)
+			return nil, nil, err
 		}
-		if docHeaders == nil {
-			docHeaders = record
-		} else {
-			dict := JSONB{}
-			for i := range docHeaders {
-				dict[docHeaders[i]] = record[i]
-			}
 
-			j, err := json.Marshal(dict)
+		d.Format = FormatXLSX
+		d.Dialect = DefaultDialect()
 
-			if err != nil {
-				return err
-			}
+		return func(tx *gorm.DB) error {
+			return XLSX2Map(ra, size, d, tx, opts)
+		}, cleanup, nil
+	case FormatJSON, FormatNDJSON:
+		ra, size, cleanup, err := readerAt(file)
 
-			rows := Row{}
-
-			rows.PrepareRow(d.ID, j)
+		if err != nil {
+			return nil, nil, err
+		}
 
-			err = db.Create(&rows).Error
+		d.Format = opts.Format
+		d.Dialect = DefaultDialect()
 
-			if err != nil {
-				return err
-			}
-		}
+		return func(tx *gorm.DB) error {
+			return JSON2Map(ra, size, d, tx, opts)
+		}, cleanup, nil
 	}
 
-	headers, err := d.CreateHeaders(db, docHeaders)
+	dialect, input, err := opts.Dialect.Detect(file)
 
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	d.Header = headers
+	d.Format = FormatCSV
+	d.Dialect = dialect
 
-	return nil
+	return func(tx *gorm.DB) error {
+		return CSV2Map(input, d, tx, opts)
+	}, func() {}, nil
+}
+
+// Streams csv rows parsed with the document's dialect into the database in
+// batches and creates document headers. Column types are inferred from the
+// leading rows before any row is written. Rows rejected under the skip or pad
+// error policies are recorded on the document.
+func CSV2Map(file io.Reader, d *Document, db *gorm.DB, opts IngestOptions) error {
+	r := d.Dialect.newReader(file)
+
+	return ingestRecords(csvSource{r}, d, db, opts, d.Dialect.HasHeader, false)
 }
 
 // Creates document headers in database
-func (d *Document) CreateHeaders(db *gorm.DB, docHeaders []string) ([]Header, error) {
-	headers := make([]Header, 0)
+func (d *Document) CreateHeaders(db *gorm.DB, docHeaders []string, types []columnType) ([]Header, error) {
+	headers := make([]Header, len(docHeaders))
 
-	for _, s := range docHeaders {
-		h := Header{}
-		h.PrepareHeader(d.ID, s)
-		err := db.Create(&h).Error
+	for i, s := range docHeaders {
+		headers[i].PrepareHeader(d.ID, s, types[i])
 
-		if err != nil {
-			return []Header{}, err
+		if r, ok := d.keptRules[s]; ok {
+			if r, err := headers[i].CheckRules(r); err == nil {
+				headers[i].Rules = r
+			}
 		}
+	}
+
+	if len(headers) == 0 {
+		return headers, nil
+	}
 
-		headers = append(headers, h)
+	err := db.Create(&headers).Error
+
+	if err != nil {
+		return []Header{}, err
 	}
+
 	return headers, nil
 }
 
-// Gets all document for a user
-func (d *Document) GetDocuments(db *gorm.DB, uid uuid.UUID) (*[]Document, error) {
+// Keeps headers and rows in the order they appear in the source file
+func orderByID(db *gorm.DB) *gorm.DB {
+	return db.Order("id")
+}
+
+// Gets all document for a user, with their rows projected to the fields when
+// withRows is set
+func (d *Document) GetDocuments(db *gorm.DB, uid uuid.UUID, withRows bool, fields Fields) (*[]Document, error) {
 	documents := []Document{}
 
-	err := db.Model(&Document{}).Where("user_id = ?", uid).Preload("Row").Preload("Header").Find(&documents).Error
+	tx := db.Model(&Document{}).Where("user_id = ?", uid).Preload("Header", orderByID)
+
+	if withRows {
+		tx = tx.Preload("Row", func(db *gorm.DB) *gorm.DB {
+			return fields.selectRows(orderByID(db))
+		})
+	}
+
+	err := tx.Find(&documents).Error
 
 	if err != nil {
 		return &[]Document{}, err
@@ -180,11 +229,11 @@ func (d *Document) GetDocuments(db *gorm.DB, uid uuid.UUID) (*[]Document, error)
 	return &documents, nil
 }
 
-// Gets a document by id
+// Gets a document by id with its headers
 func (d *Document) GetDocumentByID(db *gorm.DB, docID uuid.UUID) (*Document, error) {
 	var err error
 
-	err = db.Model(&Document{}).Where("id = ?", docID).Preload("Row").Take(&d).Error
+	err = db.Model(&Document{}).Where("id = ?", docID).Preload("Header", orderByID).Take(&d).Error
 
 	if err != nil {
 		return &Document{}, err
@@ -222,7 +271,7 @@ func (d *Document) DeleteDocument(db *gorm.DB, docID uuid.UUID) (int64, error) {
 func (d *Document) GetDocumentHeaders(db *gorm.DB) ([]Header, error) {
 	headers := []Header{}
 
-	err := db.Model(&Header{}).Where("document_id = ?", d.ID).Find(&headers).Error
+	err := db.Model(&Header{}).Where("document_id = ?", d.ID).Order("id").Find(&headers).Error
 
 	if err != nil {
 		return []Header{}, err
@@ -231,11 +280,11 @@ func (d *Document) GetDocumentHeaders(db *gorm.DB) ([]Header, error) {
 	return headers, nil
 }
 
-// Gets all rows for a document
-func (r *Row) GetAllRowsByDocument(db *gorm.DB, docID uuid.UUID) (*[]Row, error) {
+// Gets all rows for a document, projected to the fields
+func (r *Row) GetAllRowsByDocument(db *gorm.DB, docID uuid.UUID, fields Fields) (*[]Row, error) {
 	rows := []Row{}
 
-	err := db.Model(&Row{}).Where("document_id = ?", docID).Find(&rows).Error
+	err := fields.selectRows(db.Model(&Row{})).Where("document_id = ?", docID).Order("id").Find(&rows).Error
 
 	if err != nil {
 		return &[]Row{}, err
@@ -255,6 +304,104 @@ func (r *Row) GetRowByID(db *gorm.DB, docID uuid.UUID, rowID uint) (*Row, error)
 	return r, nil
 }
 
+// Gets the row of a document with the given key column value
+func (r *Row) GetRowByKey(db *gorm.DB, docID uuid.UUID, key string) (*Row, error) {
+	err := db.Model(&Row{}).Where("document_id = ? AND key = ?", docID, key).Take(&r).Error
+
+	if err != nil {
+		return &Row{}, err
+	}
+
+	return r, nil
+}
+
+// Returns the key of a row for the document's key column, or nil when the
+// document has no key column
+func (d *Document) RowKey(rowData JSONB) (*string, error) {
+	if d.KeyColumn == "" {
+		return nil, nil
+	}
+
+	key, ok := keyValue(rowData[d.KeyColumn])
+
+	if !ok {
+		return nil, &SchemaError{Violations: []Violation{{
+			Path:     pointer(d.KeyColumn),
+			Expected: "a value for the key column",
+			Got:      describeValue(rowData[d.KeyColumn]),
+		}}}
+	}
+
+	return &key, nil
+}
+
+// Sets the row's key from its data for the document's key column. Returns a
+// *DuplicateKeyError when another row of the document has the same key.
+func (r *Row) AssignKey(db *gorm.DB, d *Document, rowData JSONB) error {
+	key, err := d.RowKey(rowData)
+
+	if err != nil {
+		return err
+	}
+
+	r.Key = key
+
+	if key == nil {
+		return nil
+	}
+
+	existing := &Row{}
+	err = db.Model(&Row{}).Where("document_id = ? AND key = ? AND id <> ?", d.ID, *key, r.ID).Take(existing).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return &DuplicateKeyError{Column: d.KeyColumn, Value: *key, RowID: existing.ID}
+}
+
+// Writes row data to the document once it matches the document schema and
+// its key and unique values are free. A row without an ID is created, or with
+// upsert the row already holding its key is updated, and a row with an ID is
+// updated. Returns a *SchemaError or *DuplicateKeyError when the data is
+// rejected.
+func (d *Document) WriteRow(db *gorm.DB, row *Row, rowData JSONB, upsert bool) (*Row, error) {
+	err := d.ValidateRow(rowData)
+
+	if err != nil {
+		return &Row{}, err
+	}
+
+	err = row.AssignKey(db, d, rowData)
+
+	var duplicateErr *DuplicateKeyError
+
+	if errors.As(err, &duplicateErr) && upsert && row.ID == 0 {
+		row = &Row{ID: duplicateErr.RowID, Key: row.Key}
+		err = nil
+	}
+
+	if err != nil {
+		return &Row{}, err
+	}
+
+	err = d.CheckUnique(db, rowData, row.ID)
+
+	if err != nil {
+		return &Row{}, err
+	}
+
+	if row.ID == 0 {
+		return row.CreateRow(db, d.ID, rowData)
+	}
+
+	return row.UpdateRow(db, rowData)
+}
+
 // Creates a new row in a document
 func (r *Row) CreateRow(db *gorm.DB, docID uuid.UUID, rowData JSONB) (*Row, error) {
 	j, err := json.Marshal(rowData)
@@ -271,6 +418,12 @@ func (r *Row) CreateRow(db *gorm.DB, docID uuid.UUID, rowData JSONB) (*Row, erro
 		return &Row{}, err
 	}
 
+	err = touchDocument(db, docID)
+
+	if err != nil {
+		return &Row{}, err
+	}
+
 	return r, nil
 }
 
@@ -282,7 +435,13 @@ func (r *Row) UpdateRow(db *gorm.DB, rowData JSONB) (*Row, error) {
 		return &Row{}, err
 	}
 
-	err = db.Model(&Row{}).Where("id = ?", r.ID).Updates(Row{Data: j, UpdatedAt: time.Now()}).Error
+	err = db.Model(&Row{}).Where("id = ?", r.ID).Updates(Row{Data: j, Key: r.Key, UpdatedAt: time.Now()}).Error
+
+	if err != nil {
+		return &Row{}, err
+	}
+
+	err = db.Model(&Document{}).Where("id IN (SELECT document_id FROM rows WHERE id = ?)", r.ID).Update("updated_at", time.Now()).Error
 
 	if err != nil {
 		return &Row{}, err
@@ -301,18 +460,40 @@ func (r *Row) DeleteRow(db *gorm.DB, docID uuid.UUID, rowID uint) (int64, error)
 		return 0, db.Error
 	}
 
+	err := touchDocument(db, docID)
+
+	if err != nil {
+		return 0, err
+	}
+
 	return db.RowsAffected, nil
 }
 
-// Searches rows in a documents and return rows matching specified parameters
-func (r *Row) SearchRows(db *gorm.DB, docID uuid.UUID, headerInput string, dataInput string) (*[]Row, error) {
-	rows := []Row{}
+// Deletes the row of a document with the given key column value
+func (r *Row) DeleteRowByKey(db *gorm.DB, docID uuid.UUID, key string) (int64, error) {
+	dbRow := db.Model(&Row{}).Where("document_id = ? AND key = ?", docID, key).Take(&Row{}).Delete(&Row{})
 
-	err := db.Model(&Row{}).Where("document_id = ?", docID).Find(&rows, datatypes.JSONQuery("data").Equals(dataInput, headerInput)).Error
+	if dbRow.Error != nil {
+		return 0, dbRow.Error
+	}
+
+	err := touchDocument(db, docID)
 
 	if err != nil {
-		return &[]Row{}, err
+		return 0, err
 	}
 
-	return &rows, nil
+	return dbRow.RowsAffected, nil
+}
+
+// Marks a document as changed, so results computed from its rows are redone
+func touchDocument(db *gorm.DB, docID uuid.UUID) error {
+	return db.Model(&Document{}).Where("id = ?", docID).Update("updated_at", time.Now()).Error
+}
+
+// Searches rows in a documents and return a page of rows matching specified parameters
+func (r *Row) SearchRows(db *gorm.DB, docID uuid.UUID, headerInput string, dataInput string, q RowQuery) (*RowList, error) {
+	q.WhereEquals(headerInput, dataInput)
+
+	return r.ListRows(db, docID, q)
 }
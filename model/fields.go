@@ -0,0 +1,111 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/phankanp/csv-to-json/query"
+	"gorm.io/gorm"
+)
+
+// Headers row data is projected to. Rows keep all their data when empty.
+type Fields []string
+
+// Parses a comma separated list of header names
+func ParseFields(spec string) Fields {
+	fields := Fields{}
+
+	for _, name := range strings.Split(spec, ",") {
+		fields = append(fields, strings.TrimSpace(name))
+	}
+
+	return fields
+}
+
+// Checks that every field is one of the headers
+func (f Fields) Check(headers []Header) error {
+	types := headerTypes(headers)
+
+	for _, name := range f {
+		if _, ok := types[name]; !ok {
+			return fmt.Errorf("unknown field %q", name)
+		}
+	}
+
+	return nil
+}
+
+func (f Fields) has(name string) bool {
+	for _, field := range f {
+		if field == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Expression projecting the data of a row to the fields
+func (f Fields) projection() query.SQL {
+	return query.SQL{
+		Text: "(SELECT COALESCE(jsonb_object_agg(f.name, f.value), '{}'::jsonb) FROM jsonb_each(data) AS f(name, value) WHERE f.name IN ?)",
+		Args: []interface{}{[]string(f)},
+	}
+}
+
+// Selects rows with their data projected to the fields by the database
+func (f Fields) selectRows(db *gorm.DB) *gorm.DB {
+	if len(f) == 0 {
+		return db
+	}
+
+	projection := f.projection()
+
+	return db.Select("id, document_id, key, created_at, updated_at, "+projection.Text+" AS data", projection.Args...)
+}
+
+// Projects the data of a row already read to the fields
+func (f Fields) Project(r *Row) error {
+	if len(f) == 0 {
+		return nil
+	}
+
+	data := map[string]json.RawMessage{}
+	err := json.Unmarshal(r.Data, &data)
+
+	if err != nil {
+		return err
+	}
+
+	projected := make(map[string]json.RawMessage, len(f))
+
+	for _, name := range f {
+		if v, ok := data[name]; ok {
+			projected[name] = v
+		}
+	}
+
+	j, err := json.Marshal(projected)
+
+	if err != nil {
+		return err
+	}
+
+	r.Data = j
+
+	return nil
+}
+
+// Projects the data of each row to the fields
+func (f Fields) ProjectRows(rows []Row) error {
+	for i := range rows {
+		err := f.Project(&rows[i])
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
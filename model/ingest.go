@@ -0,0 +1,880 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pborman/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Upload file formats
+const (
+	FormatCSV    = "csv"
+	FormatXLSX   = "xlsx"
+	FormatJSON   = "json"
+	FormatNDJSON = "ndjson"
+)
+
+// Guesses the format of an uploaded file from its name, defaulting to csv
+func DetectFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".xlsx", ".xlsm":
+		return FormatXLSX
+	case ".json":
+		return FormatJSON
+	case ".ndjson", ".jsonl":
+		return FormatNDJSON
+	}
+
+	return FormatCSV
+}
+
+// Checks if f is a known upload format
+func ValidFormat(f string) bool {
+	switch f {
+	case FormatCSV, FormatXLSX, FormatJSON, FormatNDJSON:
+		return true
+	}
+	return false
+}
+
+// How rows that cannot be ingested are handled
+type ErrorPolicy string
+
+const (
+	// Reject the whole upload on the first bad row
+	ErrorPolicyAbort ErrorPolicy = "abort"
+	// Skip bad rows and report them
+	ErrorPolicySkip ErrorPolicy = "skip"
+	// Pad short rows and truncate long rows, skipping rows that cannot be parsed
+	ErrorPolicyPad ErrorPolicy = "pad"
+)
+
+// Parses an error policy, defaulting to abort when empty
+func ParseErrorPolicy(s string) (ErrorPolicy, error) {
+	switch ErrorPolicy(s) {
+	case "":
+		return ErrorPolicyAbort, nil
+	case ErrorPolicyAbort, ErrorPolicySkip, ErrorPolicyPad:
+		return ErrorPolicy(s), nil
+	}
+
+	return "", errors.New("invalid error policy, expected abort, skip or pad")
+}
+
+// Describes a csv row that could not be ingested
+type RowError struct {
+	Line   int    `json:"line"`
+	Raw    string `json:"raw"`
+	Reason string `json:"reason"`
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Reason)
+}
+
+// Options controlling how an uploaded file is ingested
+type IngestOptions struct {
+	// Number of rows written per INSERT statement, at most MaxBatchSize
+	BatchSize int `json:"batch_size"`
+	// How malformed and ragged rows are handled
+	ErrorPolicy ErrorPolicy `json:"error_policy"`
+	// Number of leading rows sampled to infer column types
+	SampleSize int `json:"sample_size"`
+	// Column types that override inference, keyed by header name
+	Types map[string]string `json:"types,omitempty"`
+	// CSV dialect settings, anything unset is detected from the file
+	Dialect DialectOptions `json:"dialect"`
+	// Format of the uploaded file, csv when empty
+	Format string `json:"format,omitempty"`
+	// Spreadsheet sheet to import, the first sheet when empty
+	Sheet string `json:"sheet,omitempty"`
+	// Separator joining the keys of nested json objects into header names
+	FlattenSeparator string `json:"flatten_separator,omitempty"`
+	// Header used as the document's key column, whose values must be unique
+	Key string `json:"key,omitempty"`
+	// Update rows whose key already exists instead of rejecting them
+	Upsert bool `json:"upsert,omitempty"`
+	// Called with the number of rows written so far after every batch
+	Progress func(rows int64) `json:"-"`
+}
+
+// Default number of rows written per INSERT statement
+const DefaultBatchSize = 1000
+
+// Most parameters Postgres binds in one statement
+const maxBindParameters = 65535
+
+// Most parameters bound for each row inserted: its document id, key, data
+// and, when set, timestamps
+const rowParameters = 5
+
+// Most rows written per INSERT statement, as larger batches would bind more
+// parameters than Postgres allows
+const MaxBatchSize = maxBindParameters / rowParameters
+
+// Default number of leading rows sampled to infer column types
+const DefaultSampleSize = 1000
+
+func (o IngestOptions) batchSize() int {
+	if o.BatchSize <= 0 {
+		return DefaultBatchSize
+	}
+	if o.BatchSize > MaxBatchSize {
+		return MaxBatchSize
+	}
+	return o.BatchSize
+}
+
+func (o IngestOptions) sampleSize() int {
+	if o.SampleSize <= 0 {
+		return DefaultSampleSize
+	}
+	return o.SampleSize
+}
+
+func (o IngestOptions) progress(rows int64) {
+	if o.Progress != nil {
+		o.Progress(rows)
+	}
+}
+
+func (o IngestOptions) errorPolicy() ErrorPolicy {
+	if o.ErrorPolicy == "" {
+		return ErrorPolicyAbort
+	}
+	return o.ErrorPolicy
+}
+
+// Applies the error policy to a record whose field count does not match the
+// headers. Returns the record to store, or nil when the row is rejected.
+func (o IngestOptions) fitRecord(record []interface{}, width int) []interface{} {
+	if o.errorPolicy() != ErrorPolicyPad {
+		return nil
+	}
+
+	return resizeRecord(record, width)
+}
+
+// Pads a record with empty values or truncates it to width
+func resizeRecord(record []interface{}, width int) []interface{} {
+	if len(record) > width {
+		return record[:width]
+	}
+
+	for len(record) < width {
+		record = append(record, nil)
+	}
+
+	return record
+}
+
+// Records a rejected row on the document, or returns it as an error when the
+// upload should be aborted
+func (o IngestOptions) reject(d *Document, rowErr *RowError) error {
+	if o.errorPolicy() == ErrorPolicyAbort {
+		return rowErr
+	}
+
+	d.Rejected = append(d.Rejected, *rowErr)
+
+	return nil
+}
+
+// Record read from an uploaded file along with where it came from
+type sourceRecord struct {
+	values []interface{}
+	line   int
+	raw    string
+}
+
+// Source of tabular records read from an uploaded file
+type recordSource interface {
+	// Reads the next record. Records that cannot be parsed are returned as
+	// *RowError, and io.EOF after the last record.
+	Read() ([]interface{}, error)
+	// Line or row number the last record started on
+	Line() int
+	// Raw text of the last record
+	Raw() string
+}
+
+// Reads records from a source, applying the error policy to malformed and
+// ragged rows
+type recordStream struct {
+	src   recordSource
+	width int
+	opts  IngestOptions
+	doc   *Document
+	// Pads short rows and drops empty rows regardless of the error policy,
+	// for formats that omit trailing empty cells
+	ragged  bool
+	pending []sourceRecord
+}
+
+// Queues an already read record to be returned by the next call to next
+func (s *recordStream) pushBack(values []interface{}) {
+	s.pending = append(s.pending, sourceRecord{values: values, line: s.src.Line(), raw: s.src.Raw()})
+}
+
+// Returns the next record that can be ingested, or io.EOF
+func (s *recordStream) next() (sourceRecord, error) {
+	if len(s.pending) > 0 {
+		rec := s.pending[0]
+		s.pending = s.pending[1:]
+		return rec, nil
+	}
+
+	for {
+		record, err := s.src.Read()
+
+		if err == io.EOF {
+			return sourceRecord{}, err
+		}
+
+		if rowErr, ok := err.(*RowError); ok {
+			if err = s.opts.reject(s.doc, rowErr); err != nil {
+				return sourceRecord{}, err
+			}
+			continue
+		}
+
+		if err != nil {
+			return sourceRecord{}, err
+		}
+
+		if s.ragged {
+			record = trimTrailingNils(record, s.width)
+
+			if len(record) == 0 {
+				continue
+			}
+
+			if len(record) < s.width {
+				record = resizeRecord(record, s.width)
+			}
+		}
+
+		if len(record) != s.width {
+			fitted := s.opts.fitRecord(record, s.width)
+
+			if fitted == nil {
+				rowErr := &RowError{
+					Line:   s.src.Line(),
+					Raw:    s.src.Raw(),
+					Reason: fmt.Sprintf("expected %d fields, got %d", s.width, len(record)),
+				}
+
+				if err = s.opts.reject(s.doc, rowErr); err != nil {
+					return sourceRecord{}, err
+				}
+				continue
+			}
+
+			record = fitted
+		}
+
+		return sourceRecord{values: record, line: s.src.Line(), raw: s.src.Raw()}, nil
+	}
+}
+
+// Drops empty values past width from the end of a record, and returns an
+// empty record when every value is empty
+func trimTrailingNils(record []interface{}, width int) []interface{} {
+	end := len(record)
+
+	for end > 0 && record[end-1] == nil {
+		end--
+	}
+
+	if end == 0 {
+		return record[:0]
+	}
+
+	if end < width {
+		end = width
+	}
+
+	if end > len(record) {
+		return record
+	}
+
+	return record[:end]
+}
+
+// Reads records from src into the document: the first record names the
+// headers unless hasHeader is false, column types are inferred from the
+// leading records, and rows are written in batches
+func ingestRecords(src recordSource, d *Document, db *gorm.DB, opts IngestOptions, hasHeader bool, ragged bool) error {
+	first, err := firstRecord(src, ragged)
+
+	if err == io.EOF {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	docHeaders := make([]string, len(first))
+	records := &recordStream{src: src, width: len(first), opts: opts, doc: d, ragged: ragged}
+
+	for i := range docHeaders {
+		if hasHeader && first[i] != nil {
+			docHeaders[i] = fmt.Sprint(first[i])
+		} else {
+			docHeaders[i] = fmt.Sprintf("column_%d", i+1)
+		}
+	}
+
+	if !hasHeader {
+		records.pushBack(first)
+	}
+
+	sample, err := records.sample()
+
+	if err != nil {
+		return err
+	}
+
+	types := inferColumnTypes(docHeaders, sample, opts.Types)
+
+	headers, err := d.CreateHeaders(db, docHeaders, types)
+
+	if err != nil {
+		return err
+	}
+
+	d.Header = headers
+
+	w := newRowWriter(db, d.ID, headers, opts)
+	w.inferred = inferredColumns(headers, opts.Types)
+	err = w.enforceKey(d)
+
+	if err != nil {
+		return err
+	}
+
+	err = w.enforceUnique(d)
+
+	if err != nil {
+		return err
+	}
+
+	write := func(rec sourceRecord) error {
+		err := w.write(rec)
+
+		if rowErr, ok := err.(*RowError); ok {
+			return opts.reject(d, rowErr)
+		}
+
+		return err
+	}
+
+	for _, rec := range sample {
+		if err = write(rec); err != nil {
+			return err
+		}
+	}
+
+	for {
+		rec, err := records.next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err = write(rec); err != nil {
+			return err
+		}
+	}
+
+	err = w.flush()
+
+	if err != nil {
+		return err
+	}
+
+	d.RowsIngested = w.written
+
+	return w.updateNullable()
+}
+
+// Reads the first non-empty record of a source, or io.EOF when there is none
+func firstRecord(src recordSource, ragged bool) ([]interface{}, error) {
+	for {
+		record, err := src.Read()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if ragged {
+			record = trimTrailingNils(record, 0)
+		}
+
+		if len(record) > 0 {
+			return record, nil
+		}
+	}
+}
+
+// Reads the leading records used to infer column types
+func (s *recordStream) sample() ([]sourceRecord, error) {
+	sample := make([]sourceRecord, 0)
+
+	for len(sample) < s.opts.sampleSize() {
+		rec, err := s.next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		sample = append(sample, rec)
+	}
+
+	return sample, nil
+}
+
+func stringValues(record []string) []interface{} {
+	values := make([]interface{}, len(record))
+
+	for i := range record {
+		values[i] = record[i]
+	}
+
+	return values
+}
+
+// Converts records to typed rows and writes them to the database in batches
+type rowWriter struct {
+	db      *gorm.DB
+	docID   uuid.UUID
+	headers []Header
+	opts    IngestOptions
+	batch   []Row
+	written int64
+	// Rows written that updated a row with the same key, when upserting
+	updated int64
+	// Columns the file does not give, left as they are on upserted rows
+	missing []string
+	// Columns that received a null value
+	nulls []bool
+	// Position of the key column, or -1 when the document has none
+	keyIndex int
+	// Key values already taken
+	keys map[string]bool
+	// Position of each key in the batch, when upserting
+	batchKeys map[string]int
+	// Values taken in the columns whose rules require unique values
+	uniques []*uniqueColumn
+	// Columns whose type was inferred from the sampled records, which change
+	// type when a later value does not fit
+	inferred []bool
+}
+
+func newRowWriter(db *gorm.DB, docID uuid.UUID, headers []Header, opts IngestOptions) *rowWriter {
+	return &rowWriter{
+		db:       db,
+		docID:    docID,
+		headers:  headers,
+		opts:     opts,
+		batch:    make([]Row, 0, opts.batchSize()),
+		nulls:    make([]bool, len(headers)),
+		keyIndex: -1,
+	}
+}
+
+// Enforces unique values in the document's key column. Keys already stored
+// for the document count as taken unless rows are upserted.
+func (w *rowWriter) enforceKey(d *Document) error {
+	if d.KeyColumn == "" {
+		return nil
+	}
+
+	for i, h := range w.headers {
+		if h.Name == d.KeyColumn {
+			w.keyIndex = i
+		}
+	}
+
+	if w.keyIndex < 0 {
+		return &HeaderMismatchError{Missing: []string{d.KeyColumn}}
+	}
+
+	w.keys = make(map[string]bool)
+	w.batchKeys = make(map[string]int)
+
+	if w.opts.Upsert {
+		return nil
+	}
+
+	keys := []string{}
+
+	err := w.db.Model(&Row{}).Where("document_id = ? AND key IS NOT NULL", d.ID).Pluck("key", &keys).Error
+
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		w.keys[k] = true
+	}
+
+	return nil
+}
+
+// Enforces unique values in the columns whose rules require them, counting
+// the values stored for the document as taken
+func (w *rowWriter) enforceUnique(d *Document) error {
+	for i, h := range w.headers {
+		if !h.Rules.Unique {
+			continue
+		}
+
+		u, err := loadUniqueColumn(w.db, d, h, i)
+
+		if err != nil {
+			return err
+		}
+
+		w.uniques = append(w.uniques, u)
+	}
+
+	return nil
+}
+
+// Queues a record for insertion. Returns a *RowError when a value does not
+// fit its column type or breaks one of its rules.
+func (w *rowWriter) write(rec sourceRecord) error {
+	dict := JSONB{}
+
+	for i, h := range w.headers {
+		v, err := ConvertValue(h.Type, rec.values[i])
+
+		if err != nil && i < len(w.inferred) && w.inferred[i] {
+			err = w.demote(i, rec.values[i])
+
+			if err != nil {
+				return err
+			}
+
+			h = w.headers[i]
+			v, err = ConvertValue(h.Type, rec.values[i])
+		}
+
+		if err != nil {
+			return &RowError{
+				Line:   rec.line,
+				Raw:    rec.raw,
+				Reason: fmt.Sprintf("column %q: %s", h.Name, err),
+			}
+		}
+
+		if violation, ok := h.checkRules(v); !ok {
+			return &RowError{
+				Line:   rec.line,
+				Raw:    rec.raw,
+				Reason: fmt.Sprintf("column %q: expected %s, got %s", h.Name, violation.Expected, violation.Got),
+			}
+		}
+
+		if v == nil {
+			w.nulls[i] = true
+		}
+
+		dict[h.Name] = v
+	}
+
+	j, err := json.Marshal(dict)
+
+	if err != nil {
+		return err
+	}
+
+	row := Row{}
+	row.PrepareRow(w.docID, j)
+	key := ""
+
+	if w.keyIndex >= 0 {
+		name := w.headers[w.keyIndex].Name
+		k, ok := keyValue(dict[name])
+
+		if !ok {
+			return &RowError{Line: rec.line, Raw: rec.raw, Reason: fmt.Sprintf("key column %q must have a value", name)}
+		}
+
+		if !w.opts.Upsert && w.keys[k] {
+			return &RowError{Line: rec.line, Raw: rec.raw, Reason: fmt.Sprintf("duplicate value %s in key column %q", k, name)}
+		}
+
+		key = k
+	}
+
+	err = w.holdUnique(rec, dict, key)
+
+	if err != nil {
+		return err
+	}
+
+	if w.keyIndex >= 0 {
+		if w.opts.Upsert {
+			// A later row with the same key replaces the queued one
+			if i, ok := w.batchKeys[key]; ok {
+				w.batch[i].Data = j
+				return nil
+			}
+
+			w.batchKeys[key] = len(w.batch)
+		} else {
+			w.keys[key] = true
+		}
+
+		row.Key = &key
+	}
+
+	w.batch = append(w.batch, row)
+
+	if len(w.batch) == cap(w.batch) {
+		return w.flush()
+	}
+
+	return nil
+}
+
+// Changes the type of an inferred column to one that holds a value read after
+// the sample, so the upload goes on instead of failing. Rows already written
+// hold their values as strings when the column becomes a string column.
+// Rules that no longer apply to the column are dropped.
+func (w *rowWriter) demote(i int, v interface{}) error {
+	h := &w.headers[i]
+	t := demotedType(h.Type, v)
+
+	err := w.flush()
+
+	if err != nil {
+		return err
+	}
+
+	rules, err := Header{Name: h.Name, Type: t, Nullable: h.Nullable}.CheckRules(h.Rules)
+
+	if err != nil {
+		rules = Rules{}
+	}
+
+	err = w.db.Model(&Header{}).Where("id = ?", h.ID).Updates(map[string]interface{}{"type": t, "rules": rules}).Error
+
+	if err != nil {
+		return err
+	}
+
+	if t == TypeString {
+		err = w.db.Model(&Row{}).
+			Where("document_id = ? AND jsonb_typeof(data->?) IN ('number', 'boolean')", w.docID, h.Name).
+			Update("data", gorm.Expr("jsonb_set(data, ARRAY[?]::text[], to_jsonb(data->>?))", h.Name, h.Name)).Error
+
+		if err != nil {
+			return err
+		}
+	}
+
+	h.Type = t
+	h.Rules = rules
+
+	return nil
+}
+
+// Columns of the headers whose types are inferred rather than given with the
+// upload
+func inferredColumns(headers []Header, overrides map[string]string) []bool {
+	inferred := make([]bool, len(headers))
+
+	for i, h := range headers {
+		_, overridden := overrides[h.Name]
+		inferred[i] = !overridden
+	}
+
+	return inferred
+}
+
+// Takes the values of a row in unique columns. Returns a *RowError when
+// another row holds one of them.
+func (w *rowWriter) holdUnique(rec sourceRecord, dict JSONB, key string) error {
+	values := make([]string, len(w.uniques))
+
+	for i, u := range w.uniques {
+		h := w.headers[u.index]
+		v := dict[h.Name]
+
+		if v == nil {
+			continue
+		}
+
+		values[i] = uniqueValue(h.Type, v)
+
+		if !u.free(values[i], key, w.opts.Upsert) {
+			return &RowError{Line: rec.line, Raw: rec.raw, Reason: fmt.Sprintf("duplicate value %s in unique column %q", describeValue(v), h.Name)}
+		}
+	}
+
+	for i, u := range w.uniques {
+		switch {
+		case dict[w.headers[u.index].Name] != nil:
+			u.hold(values[i], key)
+		case key != "":
+			u.release(key)
+		}
+	}
+
+	return nil
+}
+
+// Inserts queued rows
+func (w *rowWriter) flush() error {
+	if len(w.batch) == 0 {
+		return nil
+	}
+
+	db := w.db
+
+	if w.keyIndex >= 0 && w.opts.Upsert {
+		keys := make([]string, len(w.batch))
+
+		for i, row := range w.batch {
+			keys[i] = *row.Key
+		}
+
+		var existing int64
+		err := db.Model(&Row{}).Where("document_id = ? AND key IN ?", w.docID, keys).Count(&existing).Error
+
+		if err != nil {
+			return err
+		}
+
+		w.updated += existing
+
+		// Values are merged into the stored data, so columns the file does
+		// not give keep their values
+		merge := "rows.data || (excluded.data" + strings.Repeat(" - ?", len(w.missing)) + ")"
+		args := make([]interface{}, len(w.missing))
+
+		for i, name := range w.missing {
+			args[i] = name
+		}
+
+		db = db.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "document_id"}, {Name: "key"}},
+			DoUpdates: clause.Set{
+				{Column: clause.Column{Name: "data"}, Value: gorm.Expr(merge, args...)},
+				{Column: clause.Column{Name: "updated_at"}, Value: gorm.Expr("excluded.updated_at")},
+			},
+		})
+
+		w.batchKeys = make(map[string]int)
+	}
+
+	err := db.Create(&w.batch).Error
+
+	if err != nil {
+		return err
+	}
+
+	w.written += int64(len(w.batch))
+	w.opts.progress(w.written)
+	w.batch = w.batch[:0]
+
+	return nil
+}
+
+// Marks headers nullable when a written row left them null
+func (w *rowWriter) updateNullable() error {
+	for i := range w.headers {
+		if !w.nulls[i] || w.headers[i].Nullable {
+			continue
+		}
+
+		err := w.db.Model(&Header{}).Where("id = ?", w.headers[i].ID).Update("nullable", true).Error
+
+		if err != nil {
+			return err
+		}
+
+		w.headers[i].Nullable = true
+	}
+
+	return nil
+}
+
+// Text stored as the key of a row for a key column value, false when the value
+// is empty
+func keyValue(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, v != ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case json.Number:
+		return v.String(), true
+	}
+
+	return fmt.Sprint(v), true
+}
+
+// Returns random access to an uploaded file along with its size, spooling it
+// to a temporary file when it cannot be read at arbitrary offsets. The
+// returned function releases any temporary file.
+func readerAt(file io.Reader) (io.ReaderAt, int64, func(), error) {
+	if f, ok := file.(interface {
+		io.ReaderAt
+		io.Seeker
+	}); ok {
+		size, err := f.Seek(0, io.SeekEnd)
+
+		if err != nil {
+			return nil, 0, nil, err
+		}
+
+		return f, size, func() {}, nil
+	}
+
+	tmp, err := ioutil.TempFile("", "csv2api-")
+
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+
+	size, err := io.Copy(tmp, file)
+
+	if err != nil {
+		cleanup()
+		return nil, 0, nil, err
+	}
+
+	return tmp, size, cleanup, nil
+}
@@ -0,0 +1,601 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/phankanp/csv-to-json/xlsx"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+)
+
+// Opens a database that builds statements without running them, calling
+// created with every batch of rows inserted
+func dryRunDB(t testing.TB, created func(rows []Row)) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(postgres.Open("host=localhost"), &gorm.Config{
+		DryRun:               true,
+		DisableAutomaticPing: true,
+		Logger:               logger.Default.LogMode(logger.Silent),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Callback().Create().After("gorm:create").Register("test:rows", func(tx *gorm.DB) {
+		if batch, ok := tx.Statement.Dest.(*[]Row); ok {
+			created(*batch)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+// Ingests an uploaded file into a new document
+func ingestFile(t *testing.T, content string, opts IngestOptions) (*Document, []Row, error) {
+	t.Helper()
+
+	return ingestReader(t, strings.NewReader(content), opts)
+}
+
+// Ingests an uploaded file into a new document, collecting the rows inserted
+func ingestReader(t *testing.T, file io.Reader, opts IngestOptions) (*Document, []Row, error) {
+	t.Helper()
+
+	rows := make([]Row, 0)
+	db := dryRunDB(t, func(batch []Row) {
+		rows = append(rows, batch...)
+	})
+
+	d := &Document{}
+	d.PrepareDocument("test", nil)
+
+	ingest, cleanup, err := d.ingester(file, opts)
+
+	if err != nil {
+		return d, nil, err
+	}
+
+	defer cleanup()
+
+	err = ingest(db)
+
+	return d, rows, err
+}
+
+// Decodes the data of rows
+func rowData(t *testing.T, rows []Row) []map[string]interface{} {
+	t.Helper()
+
+	data := make([]map[string]interface{}, len(rows))
+
+	for i, r := range rows {
+		err := json.Unmarshal(r.Data, &data[i])
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return data
+}
+
+func TestInferColumnTypes(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []interface{}
+		want   columnType
+	}{
+		{"integers", []interface{}{"1", "-20", " 3 "}, columnType{Type: TypeInteger}},
+		{"floats", []interface{}{"1", "2.5", "-0.5"}, columnType{Type: TypeFloat}},
+		{"zero", []interface{}{"0", "0.0"}, columnType{Type: TypeFloat}},
+		{"zero padded codes", []interface{}{"01234", "5678"}, columnType{Type: TypeString}},
+		{"zero padded decimals", []interface{}{"00.5"}, columnType{Type: TypeString}},
+		{"booleans", []interface{}{"true", "false"}, columnType{Type: TypeBoolean}},
+		{"datetimes", []interface{}{"2020-01-02", "2020-01-02T03:04:05Z"}, columnType{Type: TypeDateTime}},
+		{"mixed", []interface{}{"1", "abc"}, columnType{Type: TypeString}},
+		{"nulls", []interface{}{"1", "", nil}, columnType{Type: TypeInteger, Nullable: true}},
+		{"empty", []interface{}{"", nil}, columnType{Type: TypeString, Nullable: true}},
+		{"json numbers", []interface{}{json.Number("1"), json.Number("2")}, columnType{Type: TypeInteger}},
+		{"json booleans", []interface{}{true, false}, columnType{Type: TypeBoolean}},
+		{"large integers", []interface{}{"1", "12345678901234567890123"}, columnType{Type: TypeString}},
+		{"large json numbers", []interface{}{json.Number("1"), json.Number("-12345678901234567890123")}, columnType{Type: TypeString}},
+	}
+
+	for _, tt := range tests {
+		sample := make([]sourceRecord, len(tt.values))
+
+		for i, v := range tt.values {
+			sample[i] = sourceRecord{values: []interface{}{v}}
+		}
+
+		got := inferColumnTypes([]string{"c"}, sample, nil)[0]
+
+		if got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInferColumnTypesOverrides(t *testing.T) {
+	sample := []sourceRecord{{values: []interface{}{"1", "01234"}}}
+
+	got := inferColumnTypes([]string{"a", "b"}, sample, map[string]string{"a": TypeString, "b": TypeInteger})
+
+	if got[0].Type != TypeString || got[1].Type != TypeInteger {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestIngestDemotesInferredColumns(t *testing.T) {
+	content := "id,amount,code,flag\n1,10,7,true\n2,20,8,false\n3,2.5,x9,maybe\n4,40,10,true\n"
+
+	d, rows, err := ingestFile(t, content, IngestOptions{SampleSize: 2})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"id": TypeInteger, "amount": TypeFloat, "code": TypeString, "flag": TypeString}
+
+	for name, typ := range want {
+		if got := headerTypes(d.Header)[name]; got != typ {
+			t.Errorf("column %s: got type %s, want %s", name, got, typ)
+		}
+	}
+
+	data := rowData(t, rows)
+
+	if len(data) != 4 {
+		t.Fatalf("got %d rows, want 4", len(data))
+	}
+
+	if data[2]["amount"] != 2.5 || data[2]["code"] != "x9" || data[3]["code"] != "10" || data[3]["flag"] != "true" {
+		t.Errorf("got rows %v", data)
+	}
+}
+
+func TestIngestKeepsZeroPaddedCodes(t *testing.T) {
+	d, rows, err := ingestFile(t, "zip\n02134\n10001\n", IngestOptions{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if headerTypes(d.Header)["zip"] != TypeString {
+		t.Fatalf("got type %s", headerTypes(d.Header)["zip"])
+	}
+
+	if data := rowData(t, rows); data[0]["zip"] != "02134" {
+		t.Errorf("got %v", data[0]["zip"])
+	}
+}
+
+func TestIngestKeepsDigitsOfLargeIntegers(t *testing.T) {
+	d, rows, err := ingestFile(t, "id\n1\n2\n12345678901234567890123\n", IngestOptions{SampleSize: 2})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if headerTypes(d.Header)["id"] != TypeString {
+		t.Fatalf("got type %s", headerTypes(d.Header)["id"])
+	}
+
+	if data := rowData(t, rows); data[2]["id"] != "12345678901234567890123" {
+		t.Errorf("got %v", data[2]["id"])
+	}
+}
+
+func TestIngestRejectsValuesOfOverriddenTypes(t *testing.T) {
+	content := "n\n1\n2\nthree\n"
+	opts := IngestOptions{SampleSize: 1, Types: map[string]string{"n": TypeInteger}}
+
+	_, _, err := ingestFile(t, content, opts)
+
+	var rowErr *RowError
+
+	if !errors.As(err, &rowErr) || rowErr.Line != 4 {
+		t.Fatalf("got %v, want a row error on line 4", err)
+	}
+
+	opts.ErrorPolicy = ErrorPolicySkip
+
+	d, rows, err := ingestFile(t, content, opts)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != 2 || len(d.Rejected) != 1 {
+		t.Errorf("got %d rows and %d rejected, want 2 and 1", len(rows), len(d.Rejected))
+	}
+}
+
+func TestIngestCSVErrorPolicies(t *testing.T) {
+	content := "a,b\n1,x\n2\n3,y,extra\n4,\"z\n"
+
+	tests := []struct {
+		policy   ErrorPolicy
+		rows     []string
+		rejected []int
+		err      string
+	}{
+		{ErrorPolicyAbort, nil, nil, "line 3"},
+		{ErrorPolicySkip, []string{`{"a":1,"b":"x"}`}, []int{3, 4, 5}, ""},
+		{ErrorPolicyPad, []string{`{"a":1,"b":"x"}`, `{"a":2,"b":null}`, `{"a":3,"b":"y"}`}, []int{5}, ""},
+	}
+
+	for _, tt := range tests {
+		d, rows, err := ingestFile(t, content, IngestOptions{ErrorPolicy: tt.policy})
+
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got %v, want %s", tt.policy, err, tt.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", tt.policy, err)
+			continue
+		}
+
+		got := make([]string, len(rows))
+
+		for i, r := range rows {
+			got[i] = string(r.Data)
+		}
+
+		lines := make([]int, len(d.Rejected))
+
+		for i, r := range d.Rejected {
+			lines[i] = r.Line
+		}
+
+		if !reflect.DeepEqual(got, tt.rows) || !reflect.DeepEqual(lines, tt.rejected) {
+			t.Errorf("%s: got rows %s rejected %v, want %s rejected %v", tt.policy, got, lines, tt.rows, tt.rejected)
+		}
+
+		if d.RowsIngested != int64(len(tt.rows)) {
+			t.Errorf("%s: got %d rows ingested, want %d", tt.policy, d.RowsIngested, len(tt.rows))
+		}
+	}
+}
+
+func TestIngestCSVDialect(t *testing.T) {
+	content := "\uFEFFname;price\n'a;b';1,5\n'c';2\n"
+
+	d, rows, err := ingestFile(t, content, IngestOptions{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Dialect.Delimiter != ";" || d.Dialect.Quote != "'" || !d.Dialect.HasHeader {
+		t.Errorf("got dialect %+v", d.Dialect)
+	}
+
+	data := rowData(t, rows)
+
+	if len(data) != 2 || data[0]["name"] != "a;b" || data[0]["price"] != "1,5" {
+		t.Errorf("got rows %v", data)
+	}
+}
+
+func TestIngestXLSX(t *testing.T) {
+	var buf bytes.Buffer
+
+	w, err := xlsx.NewWriter(&buf, "Sales")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	for _, row := range [][]interface{}{
+		{"id", "when", "paid", "note"},
+		{1, day, true, "first"},
+		{2, nil, false},
+	} {
+		if err := w.WriteRow(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, rows, err := ingestReader(t, &buf, IngestOptions{Format: FormatXLSX, ErrorPolicy: ErrorPolicyPad})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"id": TypeInteger, "when": TypeDateTime, "paid": TypeBoolean, "note": TypeString}
+
+	if got := headerTypes(d.Header); !reflect.DeepEqual(got, want) {
+		t.Errorf("got types %v, want %v", got, want)
+	}
+
+	data := rowData(t, rows)
+
+	if len(data) != 2 || data[0]["id"] != 1.0 || data[0]["paid"] != true || data[0]["note"] != "first" || data[1]["when"] != nil {
+		t.Errorf("got rows %v", data)
+	}
+
+	if when, _ := data[0]["when"].(string); !strings.HasPrefix(when, "2020-03-04T05:06:07") {
+		t.Errorf("got date %v", data[0]["when"])
+	}
+}
+
+// Generates a csv file of rows without holding it in memory
+type generatedCSV struct {
+	rows int
+	next int
+	buf  []byte
+	// Bytes of the file read so far
+	read int64
+}
+
+func (g *generatedCSV) Read(p []byte) (int, error) {
+	for len(g.buf) < len(p) && g.next <= g.rows {
+		if g.next == 0 {
+			g.buf = append(g.buf, "id,name,price,sold,created\n"...)
+		} else {
+			g.buf = append(g.buf, fmt.Sprintf("%d,item %d,%d.%02d,%t,2020-01-%02dT10:00:00Z\n", g.next, g.next, g.next%1000, g.next%100, g.next%2 == 0, g.next%28+1)...)
+		}
+
+		g.next++
+	}
+
+	if len(g.buf) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, g.buf)
+	g.buf = g.buf[n:]
+	g.read += int64(n)
+
+	return n, nil
+}
+
+func TestBatchSize(t *testing.T) {
+	tests := []struct {
+		size int
+		want int
+	}{
+		{0, DefaultBatchSize},
+		{500, 500},
+		{MaxBatchSize, MaxBatchSize},
+		{100000, MaxBatchSize},
+	}
+
+	for _, tt := range tests {
+		if got := (IngestOptions{BatchSize: tt.size}).batchSize(); got != tt.want {
+			t.Errorf("%d: got %d, want %d", tt.size, got, tt.want)
+		}
+	}
+
+	key := "a"
+	rows := []Row{{Key: &key, Data: []byte(`{}`)}, {Data: []byte(`{}`)}}
+	tx := dryRunDB(t, func([]Row) {}).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "document_id"}, {Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"data", "updated_at"}),
+	}).Create(&rows)
+
+	if tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+
+	if got := len(tx.Statement.Vars); got > len(rows)*rowParameters {
+		t.Errorf("got %d parameters for %d rows, want at most %d each", got, len(rows), rowParameters)
+	}
+}
+
+// Streams a large upload through ingestion, checking rows are written in
+// batches without the file or its rows being held in memory
+func TestIngestLargeCSV(t *testing.T) {
+	if testing.Short() {
+		t.Skip("large upload")
+	}
+
+	const rows = 100000
+
+	var before, stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	var written int
+	var peak uint64
+
+	db := dryRunDB(t, func(batch []Row) {
+		written += len(batch)
+
+		if written%(10*DefaultBatchSize) == 0 {
+			runtime.ReadMemStats(&stats)
+
+			if stats.HeapAlloc > peak {
+				peak = stats.HeapAlloc
+			}
+		}
+	})
+
+	d := &Document{}
+	d.PrepareDocument("large", nil)
+
+	ingest, cleanup, err := d.ingester(&generatedCSV{rows: rows}, IngestOptions{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer cleanup()
+
+	start := time.Now()
+	err = ingest(db)
+	elapsed := time.Since(start)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if written != rows || d.RowsIngested != rows {
+		t.Fatalf("wrote %d rows, counted %d, want %d", written, d.RowsIngested, rows)
+	}
+
+	t.Logf("%d rows in %s, %.0f rows/s, peak heap %d KiB", rows, elapsed, rows/elapsed.Seconds(), peak/1024)
+
+	if peak > before.HeapAlloc+32<<20 {
+		t.Errorf("heap grew to %d KiB from %d KiB", peak/1024, before.HeapAlloc/1024)
+	}
+}
+
+func BenchmarkIngestCSV(b *testing.B) {
+	db := dryRunDB(b, func([]Row) {})
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		d := &Document{}
+		d.PrepareDocument("bench", nil)
+
+		ingest, cleanup, err := d.ingester(&generatedCSV{rows: 10000}, IngestOptions{})
+
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		err = ingest(db)
+		cleanup()
+
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Opens the Postgres database named by TEST_DATABASE_URL, skipping the test
+// when it is unset
+func postgresDB(t testing.TB) *gorm.DB {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+
+	if dsn == "" {
+		t.Skip("set TEST_DATABASE_URL to a Postgres database to run")
+	}
+
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AutoMigrate(&Document{}, &Row{}, &Header{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+// Removes a document created by a test with its rows and headers
+func dropDocument(db *gorm.DB, d *Document) {
+	db.Where("document_id = ?", d.ID).Delete(&Row{})
+	db.Where("document_id = ?", d.ID).Delete(&Header{})
+	db.Delete(d)
+}
+
+// Least rows per second a 100 MiB upload must be written to Postgres at
+const minIngestRate = 5000
+
+// Uploads a file of our typical size, about 100 MiB, into Postgres, checking
+// every row lands and rows are written at an acceptable rate
+func TestIngestTypicalUploadPostgres(t *testing.T) {
+	if testing.Short() {
+		t.Skip("large upload")
+	}
+
+	db := postgresDB(t)
+
+	const rows = 2000000
+
+	file := &generatedCSV{rows: rows}
+	d := &Document{}
+
+	start := time.Now()
+	created, err := d.CreateDocument(file, "typical", db, &User{ID: uuid.NewRandom()}, IngestOptions{})
+	elapsed := time.Since(start)
+
+	defer dropDocument(db, d)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var count int64
+	err = db.Model(&Row{}).Where("document_id = ?", created.ID).Count(&count).Error
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != rows || created.RowsIngested != rows {
+		t.Fatalf("stored %d rows, counted %d, want %d", count, created.RowsIngested, rows)
+	}
+
+	rate := rows / elapsed.Seconds()
+	t.Logf("%d MiB, %d rows in %s, %.0f rows/s, %.1f MiB/s", file.read>>20, rows, elapsed, rate, float64(file.read)/(1<<20)/elapsed.Seconds())
+
+	if file.read < 100<<20 {
+		t.Errorf("generated %d MiB, want at least 100", file.read>>20)
+	}
+
+	if rate < minIngestRate {
+		t.Errorf("wrote %.0f rows/s, want at least %d", rate, minIngestRate)
+	}
+}
+
+func BenchmarkIngestCSVPostgres(b *testing.B) {
+	db := postgresDB(b)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		file := &generatedCSV{rows: 100000}
+		d := &Document{}
+
+		_, err := d.CreateDocument(file, "bench", db, &User{ID: uuid.NewRandom()}, IngestOptions{})
+		b.SetBytes(file.read)
+
+		b.StopTimer()
+		dropDocument(db, d)
+		b.StartTimer()
+
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
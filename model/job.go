@@ -0,0 +1,270 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pborman/uuid"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// Job and job file states
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+)
+
+// Background upload job model
+type Job struct {
+	ID        uuid.UUID      `gorm:"primary_key" json:"id"`
+	UserID    uuid.UUID      `gorm:"not null" json:"-"`
+	Status    string         `gorm:"not null" json:"status"`
+	Options   datatypes.JSON `json:"-"`
+	Files     []JobFile      `json:"files"`
+	CreatedAt time.Time      `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	UpdatedAt time.Time      `gorm:"default:CURRENT_TIMESTAMP" json:"updated_at"`
+}
+
+// Uploaded file processed by a background job
+type JobFile struct {
+	ID           uint           `gorm:"primary_key;auto_increment" json:"-"`
+	JobID        uuid.UUID      `gorm:"not null" json:"-"`
+	Title        string         `gorm:"not null" json:"title"`
+	Path         string         `gorm:"not null" json:"-"`
+	Format       string         `json:"format"`
+	Sheet        string         `json:"sheet,omitempty"`
+	Status       string         `gorm:"not null" json:"status"`
+	RowsIngested int64          `json:"rows_ingested"`
+	Error        string         `json:"error,omitempty"`
+	Rejected     datatypes.JSON `json:"rejected_rows,omitempty"`
+	DocumentID   uuid.UUID      `json:"document_id,omitempty"`
+	UpdatedAt    time.Time      `gorm:"default:CURRENT_TIMESTAMP" json:"-"`
+}
+
+// Assign data to job model
+func (j *Job) PrepareJob(uid uuid.UUID, opts IngestOptions) error {
+	o, err := json.Marshal(opts)
+
+	if err != nil {
+		return err
+	}
+
+	j.ID = uuid.NewRandom()
+	j.UserID = uid
+	j.Status = JobPending
+	j.Options = o
+	j.CreatedAt = time.Now()
+	j.UpdatedAt = time.Now()
+
+	return nil
+}
+
+// Ingest options the job was submitted with
+func (j *Job) IngestOptions() (IngestOptions, error) {
+	opts := IngestOptions{}
+
+	if len(j.Options) == 0 {
+		return opts, nil
+	}
+
+	err := json.Unmarshal(j.Options, &opts)
+
+	return opts, err
+}
+
+// Creates a job and its files in database
+func (j *Job) CreateJob(db *gorm.DB) (*Job, error) {
+	for i := range j.Files {
+		j.Files[i].JobID = j.ID
+		j.Files[i].Status = JobPending
+		j.Files[i].UpdatedAt = time.Now()
+	}
+
+	err := db.Create(&j).Error
+
+	if err != nil {
+		return &Job{}, err
+	}
+
+	return j, nil
+}
+
+// Gets a job and its files by id
+func (j *Job) GetJobByID(db *gorm.DB, jobID uuid.UUID) (*Job, error) {
+	err := db.Model(&Job{}).Where("id = ?", jobID).Preload("Files").Take(&j).Error
+
+	if err != nil {
+		return &Job{}, err
+	}
+
+	return j, nil
+}
+
+// Gets files of unfinished jobs, resetting files interrupted mid-run so they are
+// processed again. Partially ingested documents were rolled back with their transaction.
+func (f *JobFile) GetUnfinishedJobFiles(db *gorm.DB) ([]JobFile, error) {
+	files := []JobFile{}
+
+	err := db.Model(&JobFile{}).Where("status IN ?", []string{JobPending, JobRunning}).Order("id").Find(&files).Error
+
+	if err != nil {
+		return []JobFile{}, err
+	}
+
+	for i := range files {
+		files[i].Status = JobPending
+		files[i].RowsIngested = 0
+	}
+
+	err = db.Model(&JobFile{}).Where("status = ?", JobRunning).Updates(map[string]interface{}{
+		"status":        JobPending,
+		"rows_ingested": 0,
+	}).Error
+
+	if err != nil {
+		return []JobFile{}, err
+	}
+
+	return files, nil
+}
+
+// Ingests the spooled upload into a new document, recording progress and the
+// outcome on the job file. The spooled upload is removed once processed.
+func (f *JobFile) Process(db *gorm.DB) error {
+	job := &Job{}
+	err := db.Model(&Job{}).Where("id = ?", f.JobID).Take(job).Error
+
+	if err != nil {
+		return err
+	}
+
+	opts, err := job.IngestOptions()
+
+	if err != nil {
+		return f.finish(db, nil, err)
+	}
+
+	user := &User{}
+	err = db.Model(&User{}).Where("id = ?", job.UserID).Take(user).Error
+
+	if err != nil {
+		return f.finish(db, nil, err)
+	}
+
+	err = f.update(db, map[string]interface{}{"status": JobRunning})
+
+	if err != nil {
+		return err
+	}
+
+	err = db.Model(&Job{}).Where("id = ? AND status = ?", f.JobID, JobPending).Updates(map[string]interface{}{
+		"status":     JobRunning,
+		"updated_at": time.Now(),
+	}).Error
+
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(f.Path)
+
+	if os.IsNotExist(err) {
+		err = fmt.Errorf("the uploaded file is no longer in the spool directory at %s, upload it again", f.Path)
+	}
+
+	if err != nil {
+		return f.finish(db, nil, err)
+	}
+
+	defer file.Close()
+
+	if f.Format != "" {
+		opts.Format = f.Format
+	}
+
+	opts.Sheet = f.Sheet
+	opts.Progress = func(rows int64) {
+		f.update(db, map[string]interface{}{"rows_ingested": rows})
+	}
+
+	doc := Document{}
+	data, err := doc.CreateDocument(file, f.Title, db, user, opts)
+
+	return f.finish(db, data, err)
+}
+
+// Records the outcome of processing a file and settles the job status once
+// every file is done
+func (f *JobFile) finish(db *gorm.DB, d *Document, ingestErr error) error {
+	values := map[string]interface{}{"status": JobCompleted}
+
+	if ingestErr != nil {
+		values["status"] = JobFailed
+		values["error"] = ingestErr.Error()
+
+		if rowErr, ok := ingestErr.(*RowError); ok {
+			rejected, err := json.Marshal([]RowError{*rowErr})
+
+			if err != nil {
+				return err
+			}
+
+			values["rejected"] = datatypes.JSON(rejected)
+		}
+	} else {
+		values["document_id"] = d.ID
+
+		if len(d.Rejected) > 0 {
+			rejected, err := json.Marshal(d.Rejected)
+
+			if err != nil {
+				return err
+			}
+
+			values["rejected"] = datatypes.JSON(rejected)
+		}
+	}
+
+	err := f.update(db, values)
+
+	if err != nil {
+		return err
+	}
+
+	os.Remove(f.Path)
+
+	var remaining, failed int64
+
+	err = db.Model(&JobFile{}).Where("job_id = ? AND status IN ?", f.JobID, []string{JobPending, JobRunning}).Count(&remaining).Error
+
+	if err != nil || remaining > 0 {
+		return err
+	}
+
+	err = db.Model(&JobFile{}).Where("job_id = ? AND status = ?", f.JobID, JobFailed).Count(&failed).Error
+
+	if err != nil {
+		return err
+	}
+
+	status := JobCompleted
+	if failed > 0 {
+		status = JobFailed
+	}
+
+	return db.Model(&Job{}).Where("id = ?", f.JobID).Updates(map[string]interface{}{
+		"status":     status,
+		"updated_at": time.Now(),
+	}).Error
+}
+
+func (f *JobFile) update(db *gorm.DB, values map[string]interface{}) error {
+	values["updated_at"] = time.Now()
+
+	return db.Model(&JobFile{}).Where("id = ?", f.ID).Updates(values).Error
+}
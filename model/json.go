@@ -0,0 +1,418 @@
+package model
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Default separator joining the keys of nested objects into header names
+const DefaultFlattenSeparator = "."
+
+// Field of a decoded json object
+type jsonField struct {
+	key   string
+	value interface{}
+}
+
+// Json object decoded with its keys in source order
+type jsonObject []jsonField
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+
+	for i, f := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+
+		key, err := json.Marshal(f.key)
+
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := json.Marshal(f.value)
+
+		if err != nil {
+			return nil, err
+		}
+
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+
+	b.WriteByte('}')
+
+	return b.Bytes(), nil
+}
+
+// Decodes the next json value, keeping object keys in order and numbers as json.Number
+func decodeJSONValue(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+
+	if err != nil {
+		return nil, err
+	}
+
+	delim, ok := tok.(json.Delim)
+
+	if !ok {
+		return tok, nil
+	}
+
+	switch delim {
+	case '{':
+		obj := jsonObject{}
+
+		for dec.More() {
+			keyTok, err := dec.Token()
+
+			if err != nil {
+				return nil, err
+			}
+
+			value, err := decodeJSONValue(dec)
+
+			if err != nil {
+				return nil, err
+			}
+
+			obj = append(obj, jsonField{key: keyTok.(string), value: value})
+		}
+
+		_, err = dec.Token()
+
+		return obj, err
+	case '[':
+		arr := make([]interface{}, 0)
+
+		for dec.More() {
+			value, err := decodeJSONValue(dec)
+
+			if err != nil {
+				return nil, err
+			}
+
+			arr = append(arr, value)
+		}
+
+		_, err = dec.Token()
+
+		return arr, err
+	}
+
+	return nil, fmt.Errorf("unexpected %v", delim)
+}
+
+// Flattens nested objects into a single level, joining keys with sep. Arrays
+// are kept as their json text.
+func flattenJSON(obj jsonObject, prefix string, sep string, out jsonObject) (jsonObject, error) {
+	for _, f := range obj {
+		key := f.key
+
+		if prefix != "" {
+			key = prefix + sep + f.key
+		}
+
+		switch v := f.value.(type) {
+		case jsonObject:
+			var err error
+			out, err = flattenJSON(v, key, sep, out)
+
+			if err != nil {
+				return nil, err
+			}
+		case []interface{}:
+			text, err := json.Marshal(v)
+
+			if err != nil {
+				return nil, err
+			}
+
+			out = append(out, jsonField{key: key, value: string(text)})
+		default:
+			out = append(out, jsonField{key: key, value: v})
+		}
+	}
+
+	return out, nil
+}
+
+// Reads json objects one at a time
+type objectReader interface {
+	// Reads the next object. Values that are not objects or cannot be parsed
+	// are returned as *RowError where reading can continue, and io.EOF after
+	// the last object.
+	Read() (jsonObject, error)
+	// Line, or position in the top level array, of the last object
+	Line() int
+	// Raw text of the last object
+	Raw() string
+}
+
+// Reads newline delimited json, one object per line
+type ndjsonReader struct {
+	r    *bufio.Reader
+	line int
+	raw  string
+}
+
+func (n *ndjsonReader) Read() (jsonObject, error) {
+	for {
+		text, err := n.r.ReadString('\n')
+
+		if text == "" && err != nil {
+			return nil, err
+		}
+
+		n.line++
+		n.raw = strings.TrimSpace(text)
+
+		if n.line == 1 {
+			n.raw = strings.TrimPrefix(n.raw, "\uFEFF")
+		}
+
+		if n.raw == "" {
+			continue
+		}
+
+		dec := json.NewDecoder(strings.NewReader(n.raw))
+		dec.UseNumber()
+
+		value, err := decodeJSONValue(dec)
+
+		if err == nil && dec.More() {
+			err = errors.New("unexpected data after object")
+		}
+
+		if err != nil {
+			return nil, &RowError{Line: n.line, Raw: n.raw, Reason: "invalid json: " + err.Error()}
+		}
+
+		obj, ok := value.(jsonObject)
+
+		if !ok {
+			return nil, &RowError{Line: n.line, Raw: n.raw, Reason: "expected a json object"}
+		}
+
+		return obj, nil
+	}
+}
+
+func (n *ndjsonReader) Line() int {
+	return n.line
+}
+
+func (n *ndjsonReader) Raw() string {
+	return n.raw
+}
+
+// Reads the objects of a top level json array, or a stream of concatenated
+// objects when the input does not start with an array. Syntax errors end the
+// read since the decoder cannot resynchronise. Line is the object's position.
+type jsonArrayReader struct {
+	dec   *json.Decoder
+	array bool
+	index int
+	raw   string
+}
+
+func newJSONArrayReader(r io.Reader) (*jsonArrayReader, error) {
+	br := bufio.NewReader(r)
+
+	for {
+		c, err := br.ReadByte()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' && c != 0xEF && c != 0xBB && c != 0xBF {
+			br.UnreadByte()
+			break
+		}
+	}
+
+	head, _ := br.Peek(1)
+	a := &jsonArrayReader{dec: json.NewDecoder(br), array: len(head) == 1 && head[0] == '['}
+	a.dec.UseNumber()
+
+	if a.array {
+		if _, err := a.dec.Token(); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+func (a *jsonArrayReader) Read() (jsonObject, error) {
+	if !a.dec.More() {
+		if a.array {
+			if _, err := a.dec.Token(); err != nil {
+				return nil, fmt.Errorf("invalid json: %s", err)
+			}
+			a.array = false
+		}
+		return nil, io.EOF
+	}
+
+	value, err := decodeJSONValue(a.dec)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid json: %s", err)
+	}
+
+	a.index++
+	text, _ := json.Marshal(value)
+	a.raw = string(text)
+
+	obj, ok := value.(jsonObject)
+
+	if !ok {
+		return nil, &RowError{Line: a.index, Raw: a.raw, Reason: "expected a json object"}
+	}
+
+	return obj, nil
+}
+
+func (a *jsonArrayReader) Line() int {
+	return a.index
+}
+
+func (a *jsonArrayReader) Raw() string {
+	return a.raw
+}
+
+// Opens an object reader for the given json format
+func newObjectReader(r io.Reader, format string) (objectReader, error) {
+	if format == FormatNDJSON {
+		return &ndjsonReader{r: bufio.NewReader(r)}, nil
+	}
+
+	return newJSONArrayReader(r)
+}
+
+// Adapts flattened json objects to a record source. The first record holds
+// the header names, followed by one record per object with values in header
+// order and nil for missing keys.
+type jsonSource struct {
+	objects objectReader
+	headers []string
+	index   map[string]int
+	sep     string
+	started bool
+}
+
+func (s *jsonSource) Read() ([]interface{}, error) {
+	if !s.started {
+		s.started = true
+		return stringValues(s.headers), nil
+	}
+
+	obj, err := s.objects.Read()
+
+	if err != nil {
+		return nil, err
+	}
+
+	flat, err := flattenJSON(obj, "", s.sep, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]interface{}, len(s.headers))
+
+	for _, f := range flat {
+		if i, ok := s.index[f.key]; ok {
+			values[i] = f.value
+		}
+	}
+
+	return values, nil
+}
+
+func (s *jsonSource) Line() int {
+	return s.objects.Line()
+}
+
+func (s *jsonSource) Raw() string {
+	return s.objects.Raw()
+}
+
+// Streams json array or newline delimited json objects into the database in
+// batches. Headers are the union of the flattened keys of every object in
+// order of first appearance, found with a first pass over the file.
+func JSON2Map(file io.ReaderAt, size int64, d *Document, db *gorm.DB, opts IngestOptions) error {
+	sep := opts.FlattenSeparator
+
+	if sep == "" {
+		sep = DefaultFlattenSeparator
+	}
+
+	objects, err := newObjectReader(io.NewSectionReader(file, 0, size), opts.Format)
+
+	if err != nil {
+		return err
+	}
+
+	headers := make([]string, 0)
+	index := make(map[string]int)
+
+	for {
+		obj, err := objects.Read()
+
+		if err == io.EOF {
+			break
+		}
+
+		if _, ok := err.(*RowError); ok {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		flat, err := flattenJSON(obj, "", sep, nil)
+
+		if err != nil {
+			return err
+		}
+
+		for _, f := range flat {
+			if _, ok := index[f.key]; !ok {
+				index[f.key] = len(headers)
+				headers = append(headers, f.key)
+			}
+		}
+	}
+
+	if len(headers) == 0 {
+		return nil
+	}
+
+	objects, err = newObjectReader(io.NewSectionReader(file, 0, size), opts.Format)
+
+	if err != nil {
+		return err
+	}
+
+	src := &jsonSource{objects: objects, headers: headers, index: index, sep: sep}
+
+	return ingestRecords(src, d, db, opts, true, false)
+}
@@ -0,0 +1,212 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type jsonRead struct {
+	object string
+	line   int
+	reason string
+}
+
+func TestObjectReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		input   string
+		objects []jsonRead
+		err     string
+	}{
+		{
+			name:   "array",
+			format: FormatJSON,
+			input:  "\uFEFF [{\"b\":1,\"a\":{\"c\":1.50}}, 2, {}]",
+			objects: []jsonRead{
+				{object: `{"b":1,"a":{"c":1.50}}`, line: 1},
+				{line: 2, reason: "expected a json object"},
+				{object: `{}`, line: 3},
+			},
+		},
+		{
+			name:   "concatenated objects",
+			format: FormatJSON,
+			input:  "{\"a\":1}\n{\"a\":2}",
+			objects: []jsonRead{
+				{object: `{"a":1}`, line: 1},
+				{object: `{"a":2}`, line: 2},
+			},
+		},
+		{
+			name:   "syntax error",
+			format: FormatJSON,
+			input:  `[{"a":1}, {"a":]`,
+			objects: []jsonRead{
+				{object: `{"a":1}`, line: 1},
+			},
+			err: "invalid json",
+		},
+		{
+			name:   "unterminated array",
+			format: FormatJSON,
+			input:  `[{"a":1}`,
+			objects: []jsonRead{
+				{object: `{"a":1}`, line: 1},
+			},
+			err: "invalid json",
+		},
+		{
+			name:   "ndjson",
+			format: FormatNDJSON,
+			input:  "\uFEFF{\"a\":1}\n\n[1]\n{\"a\":\n{\"a\":2} {}\n  {\"a\":null}  \r\n",
+			objects: []jsonRead{
+				{object: `{"a":1}`, line: 1},
+				{line: 3, reason: "expected a json object"},
+				{line: 4, reason: "invalid json: EOF"},
+				{line: 5, reason: "invalid json: unexpected data after object"},
+				{object: `{"a":null}`, line: 6},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := newObjectReader(strings.NewReader(tt.input), tt.format)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, want := range tt.objects {
+				obj, err := r.Read()
+
+				var rowErr *RowError
+
+				if want.reason != "" {
+					if !errors.As(err, &rowErr) || rowErr.Reason != want.reason || rowErr.Line != want.line {
+						t.Fatalf("got %v, want row error %+v", err, want)
+					}
+
+					continue
+				}
+
+				if err != nil {
+					t.Fatalf("got %v, want %s", err, want.object)
+				}
+
+				text, _ := json.Marshal(obj)
+
+				if string(text) != want.object || r.Line() != want.line {
+					t.Errorf("got %s on line %d, want %s on line %d", text, r.Line(), want.object, want.line)
+				}
+			}
+
+			_, err = r.Read()
+
+			if tt.err == "" && err != io.EOF {
+				t.Errorf("got %v, want EOF", err)
+			}
+
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("got %v, want %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestFlattenJSON(t *testing.T) {
+	dec := json.NewDecoder(strings.NewReader(`{"z":1,"a":{"b":{"c":"x"},"d":[1,{"e":2}]},"f":{},"g":null}`))
+	dec.UseNumber()
+
+	value, err := decodeJSONValue(dec)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		sep  string
+		want jsonObject
+	}{
+		{".", jsonObject{{"z", json.Number("1")}, {"a.b.c", "x"}, {"a.d", `[1,{"e":2}]`}, {"g", nil}}},
+		{"__", jsonObject{{"z", json.Number("1")}, {"a__b__c", "x"}, {"a__d", `[1,{"e":2}]`}, {"g", nil}}},
+	}
+
+	for _, tt := range tests {
+		got, err := flattenJSON(value.(jsonObject), "", tt.sep, nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.sep, got, tt.want)
+		}
+	}
+}
+
+func TestIngestJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		opts    IngestOptions
+		headers []string
+		rows    []string
+	}{
+		{
+			name:    "array",
+			content: `[{"id":1,"name":{"first":"a"}},{"name":{"last":"b"},"tags":["x"],"id":2}]`,
+			opts:    IngestOptions{Format: FormatJSON},
+			headers: []string{"id", "name.first", "name.last", "tags"},
+			rows: []string{
+				`{"id":1,"name.first":"a","name.last":null,"tags":null}`,
+				`{"id":2,"name.first":null,"name.last":"b","tags":"[\"x\"]"}`,
+			},
+		},
+		{
+			name:    "ndjson with separator",
+			content: "{\"a\":{\"b\":true}}\nnot json\n{\"a\":{\"b\":false},\"c\":\"01\"}\n",
+			opts:    IngestOptions{Format: FormatNDJSON, FlattenSeparator: "_", ErrorPolicy: ErrorPolicySkip},
+			headers: []string{"a_b", "c"},
+			rows: []string{
+				`{"a_b":true,"c":null}`,
+				`{"a_b":false,"c":"01"}`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, rows, err := ingestFile(t, tt.content, tt.opts)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			headers := make([]string, len(d.Header))
+
+			for i, h := range d.Header {
+				headers[i] = h.Name
+			}
+
+			if !reflect.DeepEqual(headers, tt.headers) {
+				t.Errorf("got headers %q, want %q", headers, tt.headers)
+			}
+
+			if len(rows) != len(tt.rows) {
+				t.Fatalf("got %d rows, want %d", len(rows), len(tt.rows))
+			}
+
+			for i, want := range tt.rows {
+				if string(rows[i].Data) != want {
+					t.Errorf("row %d: got %s, want %s", i, rows[i].Data, want)
+				}
+			}
+		})
+	}
+}
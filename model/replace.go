@@ -0,0 +1,306 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pborman/uuid"
+	"gorm.io/gorm"
+)
+
+// Summary of the changes made by replacing a document's contents. Without a
+// key column rows are compared by their whole contents, so an edited row
+// counts as one removed and one added.
+type ContentDiff struct {
+	Key            string     `json:"key,omitempty"`
+	Added          int64      `json:"added"`
+	Removed        int64      `json:"removed"`
+	Changed        int64      `json:"changed"`
+	Unchanged      int64      `json:"unchanged"`
+	AddedHeaders   []string   `json:"added_headers,omitempty"`
+	RemovedHeaders []string   `json:"removed_headers,omitempty"`
+	Headers        []Header   `json:"headers"`
+	Rejected       []RowError `json:"rejected_rows,omitempty"`
+}
+
+// Reports a value that appears in more than one row of a key column
+type DuplicateKeyError struct {
+	Column string `json:"column"`
+	Value  string `json:"value"`
+	// Existing row holding the value, when known
+	RowID uint `json:"row_id,omitempty"`
+}
+
+func (e *DuplicateKeyError) Error() string {
+	return fmt.Sprintf("duplicate value %s in key column %q", e.Value, e.Column)
+}
+
+// Replaces the headers and rows of a document with those of an uploaded file
+// while keeping its id. The swap happens in a single transaction, so readers
+// see either the old or the new contents. Rows are matched by the key column
+// given in the options, or the document's key column; a given key becomes
+// the document's key column. Matched rows are updated in place, keeping their
+// ids, and only rows the diff finds added or removed are inserted or deleted.
+// Without a key every row is replaced and rows are counted by their contents.
+// The new rows are written to a staging document first and compared with the
+// old ones in the database, so neither are loaded. Columns keep their
+// validation rules when the new contents have a column of the same name the
+// rules still apply to.
+func (d *Document) ReplaceContent(file io.Reader, db *gorm.DB, opts IngestOptions) (*ContentDiff, error) {
+	key := strings.TrimSpace(opts.Key)
+
+	if key == "" {
+		key = d.KeyColumn
+	}
+
+	d.KeyColumn = key
+
+	if opts.Format == FormatCSV && d.Format == FormatCSV {
+		opts.Dialect = opts.Dialect.withDefaults(d.Dialect)
+	}
+
+	ingest, cleanup, err := d.ingester(file, opts)
+
+	if err != nil {
+		return &ContentDiff{}, err
+	}
+
+	defer cleanup()
+
+	diff := &ContentDiff{Key: key}
+	d.Rejected = nil
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		oldHeaders, err := d.GetDocumentHeaders(tx)
+
+		if err != nil {
+			return err
+		}
+
+		err = tx.Where("document_id = ?", d.ID).Delete(&Header{}).Error
+
+		if err != nil {
+			return err
+		}
+
+		err = tx.Model(&Document{}).Where("id = ?", d.ID).Updates(map[string]interface{}{
+			"format":              d.Format,
+			"dialect_delimiter":   d.Dialect.Delimiter,
+			"dialect_quote":       d.Dialect.Quote,
+			"dialect_lazy_quotes": d.Dialect.LazyQuotes,
+			"dialect_comment":     d.Dialect.Comment,
+			"dialect_has_header":  d.Dialect.HasHeader,
+			"dialect_encoding":    d.Dialect.Encoding,
+			"key_column":          d.KeyColumn,
+			"updated_at":          time.Now(),
+		}).Error
+
+		if err != nil {
+			return err
+		}
+
+		d.Header = nil
+		d.keptRules = make(map[string]Rules, len(oldHeaders))
+
+		for _, h := range oldHeaders {
+			d.keptRules[h.Name] = h.Rules
+		}
+
+		staging := &Document{ID: uuid.NewRandom(), UserID: d.UserID, Title: d.Title, Format: d.Format, Dialect: d.Dialect}
+		err = tx.Create(staging).Error
+
+		if err != nil {
+			return err
+		}
+
+		// Rows and headers are written to the staging document, then moved
+		docID := d.ID
+		d.ID = staging.ID
+		err = ingest(tx)
+		d.ID = docID
+		d.keptRules = nil
+
+		if err != nil {
+			return err
+		}
+
+		for i := range d.Header {
+			d.Header[i].DocumentID = d.ID
+		}
+
+		err = tx.Model(&Header{}).Where("document_id = ?", staging.ID).Update("document_id", d.ID).Error
+
+		if err != nil {
+			return err
+		}
+
+		diff.AddedHeaders, diff.RemovedHeaders = diffHeaders(oldHeaders, d.Header)
+
+		if key == "" {
+			err = diff.replaceRows(tx, d.ID, staging.ID)
+		} else {
+			err = diff.mergeRows(tx, d.ID, staging.ID, key)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return tx.Where("id = ?", staging.ID).Delete(&Document{}).Error
+	})
+
+	if err != nil {
+		return &ContentDiff{}, err
+	}
+
+	diff.Headers = d.Header
+	diff.Rejected = d.Rejected
+	d.Row = nil
+
+	return diff, nil
+}
+
+// Replaces every row of a document with the rows of the staging document,
+// counting rows by their whole contents as a multiset
+func (diff *ContentDiff) replaceRows(tx *gorm.DB, docID uuid.UUID, stagingID uuid.UUID) error {
+	var oldRows, newRows int64
+
+	err := tx.Raw(`SELECT
+			(SELECT COUNT(*) FROM rows WHERE document_id = ?),
+			(SELECT COUNT(*) FROM rows WHERE document_id = ?),
+			(SELECT COALESCE(SUM(LEAST(o.count, n.count)), 0)
+				FROM (SELECT md5(data::text) AS hash, COUNT(*) AS count FROM rows WHERE document_id = ? GROUP BY 1) o
+				JOIN (SELECT md5(data::text) AS hash, COUNT(*) AS count FROM rows WHERE document_id = ? GROUP BY 1) n
+				ON o.hash = n.hash)`, docID, stagingID, docID, stagingID).Row().Scan(&oldRows, &newRows, &diff.Unchanged)
+
+	if err != nil {
+		return err
+	}
+
+	diff.Added = newRows - diff.Unchanged
+	diff.Removed = oldRows - diff.Unchanged
+
+	err = tx.Where("document_id = ?", docID).Delete(&Row{}).Error
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Model(&Row{}).Where("document_id = ?", stagingID).Update("document_id", docID).Error
+}
+
+// Merges the rows of the staging document into a document by the value of a
+// key column. Each new row updates the old row holding its key, which keeps
+// its id, and is otherwise added; old rows no new row matches are removed.
+// Rows without a key value cannot be matched. When old rows share a key the
+// first matches and the others are removed.
+func (diff *ContentDiff) mergeRows(tx *gorm.DB, docID uuid.UUID, stagingID uuid.UUID, key string) error {
+	var duplicate string
+
+	// Grouping by position, as Postgres does not see expressions with
+	// different parameters as the same
+	err := tx.Raw(`SELECT (data->?)::text FROM rows
+			WHERE document_id = ? AND data->? IS NOT NULL AND data->? <> 'null'::jsonb
+			GROUP BY 1 HAVING COUNT(*) > 1 LIMIT 1`, key, stagingID, key, key).Row().Scan(&duplicate)
+
+	if err == nil {
+		return &DuplicateKeyError{Column: key, Value: duplicate}
+	}
+
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	err = tx.Exec(`CREATE TEMPORARY TABLE matched_rows ON COMMIT DROP AS
+		SELECT o.id AS old_id, n.id AS new_id, o.data = n.data AS same
+		FROM (SELECT DISTINCT ON (key) id, key
+			FROM (SELECT id, data->? AS key FROM rows WHERE document_id = ?) k
+			WHERE key IS NOT NULL AND key <> 'null'::jsonb
+			ORDER BY key, id) m
+		JOIN rows o ON o.id = m.id
+		JOIN rows n ON n.document_id = ? AND n.data->? = m.key`, key, docID, stagingID, key).Error
+
+	if err != nil {
+		return err
+	}
+
+	var oldRows, newRows int64
+
+	err = tx.Raw(`SELECT
+			(SELECT COUNT(*) FROM rows WHERE document_id = ?),
+			(SELECT COUNT(*) FROM rows WHERE document_id = ?),
+			COUNT(*) FILTER (WHERE NOT same),
+			COUNT(*) FILTER (WHERE same)
+		FROM matched_rows`, docID, stagingID).Row().Scan(&oldRows, &newRows, &diff.Changed, &diff.Unchanged)
+
+	if err != nil {
+		return err
+	}
+
+	diff.Added = newRows - diff.Changed - diff.Unchanged
+	diff.Removed = oldRows - diff.Changed - diff.Unchanged
+
+	err = tx.Exec("DELETE FROM rows WHERE document_id = ? AND id NOT IN (SELECT old_id FROM matched_rows)", docID).Error
+
+	if err != nil {
+		return err
+	}
+
+	// Keys are cleared first, as matched rows may take each other's keys when
+	// the key column changes
+	err = tx.Exec("UPDATE rows SET key = NULL WHERE document_id = ?", docID).Error
+
+	if err != nil {
+		return err
+	}
+
+	err = tx.Exec(`UPDATE rows SET data = n.data, key = n.key,
+			updated_at = CASE WHEN m.same THEN rows.updated_at ELSE n.updated_at END
+		FROM matched_rows m, rows n
+		WHERE rows.id = m.old_id AND n.id = m.new_id`).Error
+
+	if err != nil {
+		return err
+	}
+
+	err = tx.Exec("DELETE FROM rows WHERE id IN (SELECT new_id FROM matched_rows)").Error
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Model(&Row{}).Where("document_id = ?", stagingID).Update("document_id", docID).Error
+}
+
+// Names of headers only in the new headers, and only in the old headers
+func diffHeaders(oldHeaders []Header, newHeaders []Header) ([]string, []string) {
+	added := make([]string, 0)
+	removed := make([]string, 0)
+
+	for _, h := range newHeaders {
+		if !hasHeader(oldHeaders, h.Name) {
+			added = append(added, h.Name)
+		}
+	}
+
+	for _, h := range oldHeaders {
+		if !hasHeader(newHeaders, h.Name) {
+			removed = append(removed, h.Name)
+		}
+	}
+
+	return added, removed
+}
+
+func hasHeader(headers []Header, name string) bool {
+	for _, h := range headers {
+		if h.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,116 @@
+package model
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/pborman/uuid"
+	"gorm.io/gorm"
+)
+
+// Row ids of a document by the value of a column
+func rowIDs(t *testing.T, db *gorm.DB, docID uuid.UUID, column string) map[string]uint {
+	t.Helper()
+
+	rows := []Row{}
+	err := db.Where("document_id = ?", docID).Find(&rows).Error
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make(map[string]uint, len(rows))
+
+	for _, r := range rows {
+		data := map[string]interface{}{}
+
+		if err := json.Unmarshal(r.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+
+		ids[data[column].(string)] = r.ID
+	}
+
+	return ids
+}
+
+func TestReplaceContentKeepsMatchedRows(t *testing.T) {
+	db := postgresDB(t)
+	user := &User{ID: uuid.NewRandom()}
+
+	d := &Document{}
+	_, err := d.CreateDocument(strings.NewReader("sku,price\na,1\nb,2\nc,3\n"), "replace", db, user, IngestOptions{Key: "sku"})
+
+	defer dropDocument(db, d)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := rowIDs(t, db, d.ID, "sku")
+
+	diff, err := d.ReplaceContent(strings.NewReader("sku,price\na,1\nb,5\nd,4\n"), db, IngestOptions{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := [4]int64{diff.Added, diff.Removed, diff.Changed, diff.Unchanged}
+
+	if want := [4]int64{1, 1, 1, 1}; got != want {
+		t.Errorf("got added, removed, changed, unchanged %v, want %v", got, want)
+	}
+
+	after := rowIDs(t, db, d.ID, "sku")
+
+	if after["a"] != before["a"] || after["b"] != before["b"] {
+		t.Errorf("matched rows changed ids from %v to %v", before, after)
+	}
+
+	if _, ok := after["c"]; ok || len(after) != 3 {
+		t.Errorf("got rows %v, want a, b and d", after)
+	}
+
+	var documents int64
+	err = db.Model(&Document{}).Where("user_id = ?", user.ID).Count(&documents).Error
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if documents != 1 {
+		t.Errorf("got %d documents, want the staging document removed", documents)
+	}
+}
+
+func TestReplaceContentWithoutKey(t *testing.T) {
+	db := postgresDB(t)
+
+	d := &Document{}
+	_, err := d.CreateDocument(strings.NewReader("name\na\na\nb\n"), "replace", db, &User{ID: uuid.NewRandom()}, IngestOptions{})
+
+	defer dropDocument(db, d)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := d.ReplaceContent(strings.NewReader("name\na\nc\n"), db, IngestOptions{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := [4]int64{diff.Added, diff.Removed, diff.Changed, diff.Unchanged}
+
+	if want := [4]int64{1, 2, 0, 1}; got != want {
+		t.Errorf("got added, removed, changed, unchanged %v, want %v", got, want)
+	}
+
+	ids := rowIDs(t, db, d.ID, "name")
+
+	if len(ids) != 2 {
+		t.Errorf("got rows %v, want a and c", ids)
+	}
+}
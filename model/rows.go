@@ -0,0 +1,530 @@
+package model
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pborman/uuid"
+	"github.com/phankanp/csv-to-json/query"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Number of rows returned when a listing gives no limit
+const DefaultRowLimit = 100
+
+// Largest number of rows returned by a single listing
+const MaxRowLimit = 1000
+
+// Position in a row listing. Cursors are handed to clients as opaque strings.
+type Cursor struct {
+	// Row the page starts after, or ends before when Before is set
+	ID     uint `json:"id"`
+	Before bool `json:"before,omitempty"`
+	// Sort the cursor was made for and the row's values of its columns
+	Sort   string        `json:"sort,omitempty"`
+	Values []interface{} `json:"values,omitempty"`
+}
+
+// Encodes the cursor as an opaque string
+func (c Cursor) Encode() string {
+	b, _ := json.Marshal(c)
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Decodes a cursor given by a client
+func DecodeCursor(s string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+
+	c := &Cursor{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	err = dec.Decode(c)
+
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+
+	return c, nil
+}
+
+// Column a row listing is sorted by
+type SortKey struct {
+	Column string
+	Type   string
+	Desc   bool
+}
+
+// Options for listing the rows of a document
+type RowQuery struct {
+	// Number of rows per page
+	Limit int
+	// Rows skipped before the page, when no cursor is given
+	Offset int
+	// Position of the page, taking precedence over offset
+	Cursor *Cursor
+	// Count the rows matching the query
+	Count bool
+	// Columns rows are sorted by before their id
+	Sort []SortKey
+	// Headers row data is projected to
+	Fields Fields
+	// Full text search rows must match
+	search *textSearch
+	// Conditions rows must match
+	conditions []func(db *gorm.DB) *gorm.DB
+}
+
+// Adds a condition rows must match
+func (q *RowQuery) Where(query interface{}, args ...interface{}) {
+	q.conditions = append(q.conditions, func(db *gorm.DB) *gorm.DB {
+		return db.Where(query, args...)
+	})
+}
+
+// Restricts rows to those with a column equal to the value
+func (q *RowQuery) WhereEquals(column string, value string) {
+	q.Where(datatypes.JSONQuery("data").Equals(value, column))
+}
+
+// Restricts rows to those matching a filter expression, comparing values
+// using the types of the document's headers
+func (q *RowQuery) Filter(expr string, headers []Header) error {
+	node, err := query.Parse(expr)
+
+	if err != nil {
+		return err
+	}
+
+	compiled, err := query.Compile(node, "data", headerTypes(headers), ConvertValue)
+
+	if err != nil {
+		return err
+	}
+
+	q.Where(compiled.Text, compiled.Args...)
+
+	return nil
+}
+
+// Sorts rows by a comma separated list of columns, each prefixed with - for
+// descending order. Values compare by column type with nulls last.
+func (q *RowQuery) SortBy(spec string, headers []Header) error {
+	types := headerTypes(headers)
+
+	for _, column := range strings.Split(spec, ",") {
+		key := SortKey{Column: strings.TrimSpace(column)}
+
+		if strings.HasPrefix(key.Column, "-") {
+			key.Column = key.Column[1:]
+			key.Desc = true
+		}
+
+		t, ok := types[key.Column]
+
+		if !ok {
+			return fmt.Errorf("cannot sort by unknown column %q", key.Column)
+		}
+
+		key.Type = t
+		q.Sort = append(q.Sort, key)
+	}
+
+	return nil
+}
+
+// Sort in the form given to SortBy
+func (q RowQuery) sortSpec() string {
+	columns := make([]string, len(q.Sort))
+
+	for i, key := range q.Sort {
+		columns[i] = key.Column
+
+		if key.Desc {
+			columns[i] = "-" + key.Column
+		}
+	}
+
+	return strings.Join(columns, ",")
+}
+
+// Maps header names to their column types
+func headerTypes(headers []Header) map[string]string {
+	types := make(map[string]string, len(headers))
+
+	for _, h := range headers {
+		types[h.Name] = h.Type
+	}
+
+	return types
+}
+
+func (q RowQuery) limit() int {
+	if q.Limit <= 0 {
+		return DefaultRowLimit
+	}
+
+	if q.Limit > MaxRowLimit {
+		return MaxRowLimit
+	}
+
+	return q.Limit
+}
+
+// ORDER BY clause with parameters, which clause.OrderBy cannot hold
+type orderBy clause.Expr
+
+func (o orderBy) Name() string {
+	return "ORDER BY"
+}
+
+func (o orderBy) Build(builder clause.Builder) {
+	clause.Expr(o).Build(builder)
+}
+
+func (o orderBy) MergeClause(c *clause.Clause) {
+	c.Expression = o
+}
+
+// Orders rows by the sort columns then id, reversed for reading backwards
+func (q RowQuery) orderBy(backward bool) orderBy {
+	if q.Ranked() {
+		return q.search.orderBy()
+	}
+
+	columns := make([]string, 0, len(q.Sort)+1)
+	vars := make([]interface{}, 0, len(q.Sort))
+
+	for _, key := range q.Sort {
+		field := query.Field("data", key.Column, key.Type)
+		direction := " ASC NULLS LAST"
+
+		switch {
+		case key.Desc && backward:
+			direction = " ASC NULLS FIRST"
+		case key.Desc:
+			direction = " DESC NULLS LAST"
+		case backward:
+			direction = " DESC NULLS FIRST"
+		}
+
+		columns = append(columns, field.Text+direction)
+		vars = append(vars, field.Args...)
+	}
+
+	if backward {
+		columns = append(columns, "id DESC")
+	} else {
+		columns = append(columns, "id ASC")
+	}
+
+	return orderBy{SQL: strings.Join(columns, ", "), Vars: vars}
+}
+
+// Builds the condition selecting rows after a cursor in sort order, or
+// before it for a before cursor
+func (q RowQuery) after(c *Cursor) (query.SQL, error) {
+	if c.Sort != q.sortSpec() || len(c.Values) != len(q.Sort) {
+		return query.SQL{}, errors.New("cursor does not match the sort")
+	}
+
+	alternatives := make([]string, 0, len(q.Sort)+1)
+	args := make([]interface{}, 0)
+	equal := make([]string, 0, len(q.Sort)+1)
+	equalArgs := make([]interface{}, 0)
+
+	for i, key := range q.Sort {
+		field := query.Field("data", key.Column, key.Type)
+		value, err := ConvertValue(key.Type, c.Values[i])
+
+		if err != nil {
+			return query.SQL{}, errors.New("invalid cursor")
+		}
+
+		op := ">"
+
+		if key.Desc != c.Before {
+			op = "<"
+		}
+
+		// Nulls sort last, so only non-null values come before a null and
+		// nothing but nulls comes after one
+		var beyond string
+		var beyondArgs []interface{}
+
+		switch {
+		case value == nil && c.Before:
+			beyond, beyondArgs = field.Text+" IS NOT NULL", field.Args
+		case value == nil:
+		case c.Before:
+			beyond, beyondArgs = field.Text+" "+op+" ?", append(field.Args, value)
+		default:
+			beyond = "(" + field.Text + " " + op + " ? OR " + field.Text + " IS NULL)"
+			beyondArgs = append(append(append([]interface{}{}, field.Args...), value), field.Args...)
+		}
+
+		if beyond != "" {
+			alternatives = append(alternatives, "("+strings.Join(append(equal[:len(equal):len(equal)], beyond), " AND ")+")")
+			args = append(append(args, equalArgs...), beyondArgs...)
+		}
+
+		if value == nil {
+			equal = append(equal, field.Text+" IS NULL")
+			equalArgs = append(equalArgs, field.Args...)
+		} else {
+			equal = append(equal, field.Text+" = ?")
+			equalArgs = append(append(equalArgs, field.Args...), value)
+		}
+	}
+
+	if c.Before {
+		equal = append(equal, "id < ?")
+	} else {
+		equal = append(equal, "id > ?")
+	}
+
+	alternatives = append(alternatives, "("+strings.Join(equal, " AND ")+")")
+	args = append(append(args, equalArgs...), c.ID)
+
+	return query.SQL{Text: "(" + strings.Join(alternatives, " OR ") + ")", Args: args}, nil
+}
+
+// Fields read for a listing, adding the sort columns cursors are made from
+func (q RowQuery) selected() Fields {
+	if len(q.Fields) == 0 {
+		return q.Fields
+	}
+
+	fields := append(Fields{}, q.Fields...)
+
+	for _, key := range q.Sort {
+		if !fields.has(key.Column) {
+			fields = append(fields, key.Column)
+		}
+	}
+
+	return fields
+}
+
+// Cursor positioned at a row of the listing
+func (q RowQuery) cursorAt(row Row, before bool) string {
+	c := Cursor{ID: row.ID, Before: before}
+
+	if len(q.Sort) > 0 {
+		c.Sort = q.sortSpec()
+		c.Values = sortValues(row.Data, q.Sort)
+	}
+
+	return c.Encode()
+}
+
+// Reads a row's values of the sort columns
+func sortValues(data datatypes.JSON, keys []SortKey) []interface{} {
+	fields := JSONB{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	dec.Decode(&fields)
+
+	values := make([]interface{}, len(keys))
+
+	for i, key := range keys {
+		values[i] = fields[key.Column]
+	}
+
+	return values
+}
+
+// Reference to a neighbouring page of a listing
+type PageRef struct {
+	Offset int
+	Cursor string
+}
+
+// Page of a listing with references to its neighbours
+type Page struct {
+	Limit int
+	// Number of items matching the query, when counted
+	Total *int64
+	Next  *PageRef
+	Prev  *PageRef
+}
+
+// Links a page read from offset to its neighbouring offsets
+func (p *Page) offsetLinks(offset int, more bool) {
+	if more {
+		p.Next = &PageRef{Offset: offset + p.Limit}
+	}
+
+	if offset == 0 {
+		return
+	}
+
+	prev := offset - p.Limit
+
+	if prev < 0 {
+		prev = 0
+	}
+
+	p.Prev = &PageRef{Offset: prev}
+}
+
+// Page of rows from a listing
+type RowList struct {
+	Page
+	Rows []Row
+}
+
+// Lists a page of a document's rows in sort order, ties ordered by id
+func (r *Row) ListRows(db *gorm.DB, docID uuid.UUID, q RowQuery) (*RowList, error) {
+	list := &RowList{Page: Page{Limit: q.limit()}}
+
+	query := func() *gorm.DB {
+		tx := db.Model(&Row{}).Where("document_id = ?", docID)
+
+		for _, condition := range q.conditions {
+			tx = condition(tx)
+		}
+
+		return tx
+	}
+
+	if q.Count {
+		var total int64
+
+		err := query().Count(&total).Error
+
+		if err != nil {
+			return &RowList{}, err
+		}
+
+		list.Total = &total
+	}
+
+	if q.Cursor != nil && q.Ranked() {
+		return &RowList{}, errors.New("search results ranked by relevance are paged with offsets, not cursors")
+	}
+
+	backward := q.Cursor != nil && q.Cursor.Before
+	tx := q.selected().selectRows(query()).Limit(list.Limit + 1).Clauses(q.orderBy(backward))
+
+	if q.Cursor != nil {
+		after, err := q.after(q.Cursor)
+
+		if err != nil {
+			return &RowList{}, err
+		}
+
+		tx = tx.Where(after.Text, after.Args...)
+	} else {
+		tx = tx.Offset(q.Offset)
+	}
+
+	rows := []Row{}
+
+	err := tx.Find(&rows).Error
+
+	if err != nil {
+		return &RowList{}, err
+	}
+
+	more := len(rows) > list.Limit
+
+	if more {
+		rows = rows[:list.Limit]
+	}
+
+	if backward {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+
+	list.Rows = rows
+
+	// Offset listings and ranked searches link to offsets, anything else to cursors
+	if q.Ranked() || (q.Cursor == nil && q.Offset > 0) {
+		list.offsetLinks(q.Offset, more)
+	} else if len(rows) > 0 {
+		// A page reached through a cursor always has rows on the side it came from
+		if more || backward {
+			list.Next = &PageRef{Cursor: q.cursorAt(rows[len(rows)-1], false)}
+		}
+
+		if q.Cursor != nil && (more || !backward) {
+			list.Prev = &PageRef{Cursor: q.cursorAt(rows[0], true)}
+		}
+	}
+
+	// Sort columns left out of the fields were only read for the cursors
+	err = q.Fields.ProjectRows(list.Rows)
+
+	if err != nil {
+		return &RowList{}, err
+	}
+
+	if q.search != nil {
+		err = q.search.highlight(db, list.Rows)
+
+		if err != nil {
+			return &RowList{}, err
+		}
+	}
+
+	return list, nil
+}
+
+// Calls fn with each row of a document matching the query in listing order,
+// reading rows one at a time rather than a page at once. Rows are only limited
+// when the query gives a limit, and cursors are not supported.
+func (r *Row) EachRow(db *gorm.DB, docID uuid.UUID, q RowQuery, fn func(row *Row) error) error {
+	if q.Cursor != nil {
+		return errors.New("cursors page listings, read every row from an offset instead")
+	}
+
+	tx := q.Fields.selectRows(db.Model(&Row{}).Where("document_id = ?", docID))
+
+	for _, condition := range q.conditions {
+		tx = condition(tx)
+	}
+
+	tx = tx.Clauses(q.orderBy(false)).Offset(q.Offset)
+
+	if q.Limit > 0 {
+		tx = tx.Limit(q.Limit)
+	}
+
+	rows, err := tx.Rows()
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		row := Row{}
+		err = db.ScanRows(rows, &row)
+
+		if err != nil {
+			return err
+		}
+
+		err = fn(&row)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
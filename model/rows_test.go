@@ -0,0 +1,71 @@
+package model
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCursorCondition(t *testing.T) {
+	q := RowQuery{Sort: []SortKey{
+		{Column: "price", Type: TypeFloat, Desc: true},
+		{Column: "when", Type: TypeDateTime},
+		{Column: "name", Type: TypeString},
+	}}
+
+	tests := []struct {
+		name   string
+		before bool
+		values []interface{}
+	}{
+		{"after values", false, []interface{}{1.5, "2020-01-02T00:00:00Z", "a"}},
+		{"after nulls", false, []interface{}{nil, nil, nil}},
+		{"before values", true, []interface{}{1.5, "2020-01-02T00:00:00Z", "a"}},
+		{"before nulls", true, []interface{}{nil, "2020-01-02T00:00:00Z", nil}},
+	}
+
+	for _, tt := range tests {
+		c := &Cursor{ID: 7, Before: tt.before, Sort: q.sortSpec(), Values: tt.values}
+
+		sql, err := q.after(c)
+
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		if got := strings.Count(sql.Text, "?"); got != len(sql.Args) {
+			t.Errorf("%s: got %d parameters and %d args in %s", tt.name, got, len(sql.Args), sql.Text)
+		}
+	}
+}
+
+func TestWriteRowRejectsData(t *testing.T) {
+	db := dryRunDB(t, func(rows []Row) {
+		t.Errorf("wrote %d rows", len(rows))
+	})
+
+	d := &Document{KeyColumn: "sku", Header: []Header{
+		{Name: "sku", Type: TypeString, Nullable: true},
+		{Name: "price", Type: TypeInteger},
+	}}
+
+	tests := []struct {
+		data JSONB
+		path string
+	}{
+		{JSONB{"sku": "a", "price": "cheap"}, "/price"},
+		{JSONB{"sku": "a"}, "/price"},
+		{JSONB{"sku": nil, "price": 1}, "/sku"},
+	}
+
+	for _, tt := range tests {
+		_, err := d.WriteRow(db, &Row{}, tt.data, true)
+
+		var schemaErr *SchemaError
+
+		if !errors.As(err, &schemaErr) || len(schemaErr.Violations) != 1 || schemaErr.Violations[0].Path != tt.path {
+			t.Errorf("%v: got %v, want a violation at %s", tt.data, err, tt.path)
+		}
+	}
+}
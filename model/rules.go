@@ -0,0 +1,466 @@
+package model
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+// Constraints on the values of a column, checked on top of its type whenever
+// rows are written
+type Rules struct {
+	// Requires a value that is neither null nor an empty string
+	Required bool `json:"required,omitempty"`
+	// Values the column accepts
+	Enum []interface{} `json:"enum,omitempty"`
+	// Regular expression string values must match
+	Pattern string `json:"pattern,omitempty"`
+	// Inclusive bounds of integer, float and datetime values. Datetime bounds
+	// are given in RFC 3339 format.
+	Min interface{} `json:"min,omitempty"`
+	Max interface{} `json:"max,omitempty"`
+	// Most characters a string value may have
+	MaxLength *int `json:"max_length,omitempty"`
+	// Requires every row to hold a different value
+	Unique bool `json:"unique,omitempty"`
+}
+
+// Compiled patterns of rules, by pattern
+var patterns sync.Map
+
+func (r Rules) Value() (driver.Value, error) {
+	b, err := json.Marshal(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+func (r *Rules) Scan(value interface{}) error {
+	var b []byte
+
+	switch v := value.(type) {
+	case nil:
+		*r = Rules{}
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into rules", value)
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	return d.Decode(r)
+}
+
+// Reports whether the column takes null values: it is nullable and no rule
+// requires a value
+func (h Header) AcceptsNull() bool {
+	return h.Nullable && !h.Rules.Required
+}
+
+// Checks that rules apply to the column, and puts their values in the form
+// the column stores
+func (h Header) CheckRules(r Rules) (Rules, error) {
+	for i, v := range r.Enum {
+		if v == nil {
+			return Rules{}, errors.New("enum values cannot be null")
+		}
+
+		if _, ok := h.check(v); !ok {
+			return Rules{}, fmt.Errorf("enum value %s is not %s", describeValue(v), jsonType(h.Type))
+		}
+
+		c, err := ConvertValue(h.Type, v)
+
+		if err != nil {
+			return Rules{}, err
+		}
+
+		r.Enum[i] = c
+	}
+
+	if r.Pattern != "" {
+		if h.Type != TypeString {
+			return Rules{}, errors.New("pattern only applies to string columns")
+		}
+
+		_, err := regexp.Compile(r.Pattern)
+
+		if err != nil {
+			return Rules{}, fmt.Errorf("invalid pattern: %s", err)
+		}
+	}
+
+	if r.MaxLength != nil {
+		if h.Type != TypeString {
+			return Rules{}, errors.New("max_length only applies to string columns")
+		}
+
+		if *r.MaxLength < 0 {
+			return Rules{}, errors.New("max_length cannot be negative")
+		}
+	}
+
+	bounds := []*interface{}{&r.Min, &r.Max}
+
+	for i, b := range bounds {
+		if *b == nil {
+			continue
+		}
+
+		name := []string{"min", "max"}[i]
+
+		if h.Type != TypeInteger && h.Type != TypeFloat && h.Type != TypeDateTime {
+			return Rules{}, fmt.Errorf("%s only applies to integer, float and datetime columns", name)
+		}
+
+		if _, ok := h.check(*b); !ok {
+			return Rules{}, fmt.Errorf("%s %s is not %s", name, describeValue(*b), describeType(Header{Type: h.Type}))
+		}
+
+		c, err := ConvertValue(h.Type, *b)
+
+		if err != nil {
+			return Rules{}, err
+		}
+
+		*b = c
+	}
+
+	if r.Min != nil && r.Max != nil && compareValues(ruleValue(h.Type, r.Min), ruleValue(h.Type, r.Max)) > 0 {
+		return Rules{}, errors.New("min is greater than max")
+	}
+
+	return r, nil
+}
+
+// Sets the validation rules of a document column. Rules apply to rows written
+// from then on.
+func (h *Header) SetRules(db *gorm.DB, r Rules) (*Header, error) {
+	err := db.Model(&Header{}).Where("id = ?", h.ID).Update("rules", r).Error
+
+	if err != nil {
+		return &Header{}, err
+	}
+
+	err = touchDocument(db, h.DocumentID)
+
+	if err != nil {
+		return &Header{}, err
+	}
+
+	h.Rules = r
+
+	return h, nil
+}
+
+// Checks a value of the column's type against its rules, describing it when
+// it breaks one
+func (h Header) checkRules(v interface{}) (Violation, bool) {
+	r := h.Rules
+	violation := Violation{Path: pointer(h.Name), Got: describeValue(v)}
+
+	if v == nil {
+		if r.Required {
+			violation.Expected = "a value"
+			return violation, false
+		}
+
+		return Violation{}, true
+	}
+
+	value := ruleValue(h.Type, v)
+
+	if len(r.Enum) > 0 && !containsValue(h.Type, r.Enum, value) {
+		values := make([]string, len(r.Enum))
+
+		for i, e := range r.Enum {
+			values[i] = describeValue(e)
+		}
+
+		violation.Expected = "one of " + strings.Join(values, ", ")
+		return violation, false
+	}
+
+	if s, ok := v.(string); ok && h.Type == TypeString {
+		if r.Required && s == "" {
+			violation.Expected = "a non-empty string"
+			return violation, false
+		}
+
+		if r.MaxLength != nil && utf8.RuneCountInString(s) > *r.MaxLength {
+			violation.Expected = fmt.Sprintf("at most %d characters", *r.MaxLength)
+			violation.Got = fmt.Sprintf("%d characters", utf8.RuneCountInString(s))
+			return violation, false
+		}
+
+		if r.Pattern != "" && !compilePattern(r.Pattern).MatchString(s) {
+			violation.Expected = "a string matching " + r.Pattern
+			return violation, false
+		}
+	}
+
+	if r.Min != nil && compareValues(value, ruleValue(h.Type, r.Min)) < 0 {
+		violation.Expected = "at least " + describeValue(r.Min)
+		return violation, false
+	}
+
+	if r.Max != nil && compareValues(value, ruleValue(h.Type, r.Max)) > 0 {
+		violation.Expected = "at most " + describeValue(r.Max)
+		return violation, false
+	}
+
+	return Violation{}, true
+}
+
+// Checks that row data holds no value of a unique column another row of the
+// document holds. rowID is the row being written, or 0 for a new row. Returns
+// a *SchemaError listing every taken value.
+func (d *Document) CheckUnique(db *gorm.DB, rowData JSONB, rowID uint) error {
+	violations := []Violation{}
+
+	for _, h := range d.Header {
+		v := rowData[h.Name]
+
+		if !h.Rules.Unique || v == nil {
+			continue
+		}
+
+		j, err := json.Marshal(v)
+
+		if err != nil {
+			return err
+		}
+
+		holder := Row{}
+		err = db.Model(&Row{}).Select("id").
+			Where("document_id = ? AND id <> ? AND data->? = ?::jsonb", d.ID, rowID, h.Name, string(j)).
+			Limit(1).Find(&holder).Error
+
+		if err != nil {
+			return err
+		}
+
+		if holder.ID != 0 {
+			violations = append(violations, Violation{
+				Path:     pointer(h.Name),
+				Expected: "a value no other row holds",
+				Got:      fmt.Sprintf("%s, held by row %d", describeValue(v), holder.ID),
+			})
+		}
+	}
+
+	if len(violations) > 0 {
+		return &SchemaError{Violations: violations}
+	}
+
+	return nil
+}
+
+// Tracks the values rows hold in a unique column while rows are written in
+// batches
+type uniqueColumn struct {
+	index int
+	// Key of the row holding each value, empty when the document has no key
+	holders map[string]string
+	// Value held by each key
+	values map[string]string
+}
+
+// Loads the values rows of the document hold in a unique column
+func loadUniqueColumn(db *gorm.DB, d *Document, h Header, index int) (*uniqueColumn, error) {
+	u := &uniqueColumn{index: index, holders: map[string]string{}, values: map[string]string{}}
+
+	rows, err := db.Model(&Row{}).Select("key, data->?", h.Name).
+		Where("document_id = ? AND data->? IS NOT NULL AND data->? <> 'null'::jsonb", d.ID, h.Name, h.Name).Rows()
+
+	if err != nil {
+		return &uniqueColumn{}, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var key *string
+		var value string
+
+		err = rows.Scan(&key, &value)
+
+		if err != nil {
+			return &uniqueColumn{}, err
+		}
+
+		v, err := decodeNumber(value)
+
+		if err != nil {
+			return &uniqueColumn{}, err
+		}
+
+		k := ""
+
+		if key != nil {
+			k = *key
+		}
+
+		u.hold(uniqueValue(h.Type, v), k)
+	}
+
+	return u, rows.Err()
+}
+
+// Reports whether a value is free for the row with the given key. When
+// upserting, the row already holding the value under the same key is the one
+// being replaced.
+func (u *uniqueColumn) free(value string, key string, upsert bool) bool {
+	holder, ok := u.holders[value]
+
+	return !ok || (upsert && key != "" && holder == key)
+}
+
+// Records the value held by the row with the given key, releasing the value
+// the row held before
+func (u *uniqueColumn) hold(value string, key string) {
+	if key != "" {
+		u.release(key)
+		u.values[key] = value
+	}
+
+	u.holders[value] = key
+}
+
+// Releases the value held by the row with the given key
+func (u *uniqueColumn) release(key string) {
+	if old, ok := u.values[key]; ok && u.holders[old] == key {
+		delete(u.holders, old)
+	}
+
+	delete(u.values, key)
+}
+
+// Value of a column in the form unique values are compared in
+func uniqueValue(t string, v interface{}) string {
+	switch value := ruleValue(t, v).(type) {
+	case time.Time:
+		return value.UTC().Format(time.RFC3339Nano)
+	default:
+		return describeValue(value)
+	}
+}
+
+// Value of a column in the form rules compare values in: int64, float64,
+// bool, string, or time.Time for datetime columns
+func ruleValue(t string, v interface{}) interface{} {
+	c, err := ConvertValue(t, v)
+
+	if err != nil {
+		return v
+	}
+
+	if s, ok := c.(string); ok && t == TypeDateTime {
+		tm, err := time.Parse(time.RFC3339Nano, s)
+
+		if err == nil {
+			return tm
+		}
+	}
+
+	return c
+}
+
+// Orders two values of the same column
+func compareValues(a interface{}, b interface{}) int {
+	switch a := a.(type) {
+	case int64:
+		if b, ok := b.(int64); ok {
+			return compareOrdered(a < b, a > b)
+		}
+	case float64:
+		if b, ok := b.(float64); ok {
+			return compareOrdered(a < b, a > b)
+		}
+	case time.Time:
+		if b, ok := b.(time.Time); ok {
+			return compareOrdered(a.Before(b), a.After(b))
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b)
+		}
+	}
+
+	if a == b {
+		return 0
+	}
+
+	return 1
+}
+
+func compareOrdered(less bool, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+
+	return 0
+}
+
+func containsValue(t string, values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if compareValues(value, ruleValue(t, v)) == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func compilePattern(pattern string) *regexp.Regexp {
+	if re, ok := patterns.Load(pattern); ok {
+		return re.(*regexp.Regexp)
+	}
+
+	re := regexp.MustCompile(pattern)
+	patterns.Store(pattern, re)
+
+	return re
+}
+
+// Describes a value as JSON
+func describeValue(v interface{}) string {
+	b, err := json.Marshal(v)
+
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+
+	return string(b)
+}
+
+func decodeNumber(s string) (interface{}, error) {
+	var v interface{}
+
+	d := json.NewDecoder(strings.NewReader(s))
+	d.UseNumber()
+
+	err := d.Decode(&v)
+
+	return v, err
+}
@@ -0,0 +1,280 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// JSON Schema dialect document schemas are written in
+const JSONSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// JSON Schema of the data of a document's rows, or of a column's values.
+// Bounds of date-time values are given as formatMinimum and formatMaximum, and
+// columns every row must hold a different value in are marked x-unique.
+type JSONSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Type                 interface{}            `json:"type,omitempty"`
+	Format               string                 `json:"format,omitempty"`
+	Enum                 []interface{}          `json:"enum,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	MaxLength            *int                   `json:"maxLength,omitempty"`
+	Minimum              interface{}            `json:"minimum,omitempty"`
+	Maximum              interface{}            `json:"maximum,omitempty"`
+	FormatMinimum        interface{}            `json:"formatMinimum,omitempty"`
+	FormatMaximum        interface{}            `json:"formatMaximum,omitempty"`
+	Unique               bool                   `json:"x-unique,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"`
+}
+
+// Value of row data that does not fit the document schema
+type Violation struct {
+	// JSON pointer to the value, such as /price
+	Path     string `json:"path"`
+	Expected string `json:"expected"`
+	Got      string `json:"got"`
+}
+
+// Lists every value of row data that does not fit the document schema
+type SchemaError struct {
+	Violations []Violation `json:"violations"`
+}
+
+func (e *SchemaError) Error() string {
+	paths := make([]string, len(e.Violations))
+
+	for i, v := range e.Violations {
+		paths[i] = v.Path
+	}
+
+	return "row data does not match the document schema at " + strings.Join(paths, ", ")
+}
+
+// JSON Schema rows of the document must match: an object of the columns
+// holding values of their type within their rules, with every column that
+// does not accept null required
+func (d *Document) Schema() *JSONSchema {
+	closed := false
+	s := &JSONSchema{
+		Schema:               JSONSchemaDialect,
+		Title:                d.Title,
+		Type:                 "object",
+		Properties:           make(map[string]*JSONSchema, len(d.Header)),
+		Required:             []string{},
+		AdditionalProperties: &closed,
+	}
+
+	for _, h := range d.Header {
+		s.Properties[h.Name] = h.Schema()
+
+		if !h.AcceptsNull() {
+			s.Required = append(s.Required, h.Name)
+		}
+	}
+
+	return s
+}
+
+// JSON Schema of the values of a column
+func (h Header) Schema() *JSONSchema {
+	r := h.Rules
+	s := &JSONSchema{
+		Pattern:   r.Pattern,
+		MaxLength: r.MaxLength,
+		Unique:    r.Unique,
+	}
+	t := jsonType(h.Type)
+
+	if h.AcceptsNull() {
+		s.Type = []string{t, "null"}
+	} else {
+		s.Type = t
+	}
+
+	if len(r.Enum) > 0 {
+		s.Enum = append([]interface{}{}, r.Enum...)
+
+		if h.AcceptsNull() {
+			s.Enum = append(s.Enum, nil)
+		}
+	}
+
+	if r.Required && h.Type == TypeString {
+		minLength := 1
+		s.MinLength = &minLength
+	}
+
+	if h.Type == TypeDateTime {
+		s.Format = "date-time"
+		s.FormatMinimum = r.Min
+		s.FormatMaximum = r.Max
+	} else {
+		s.Minimum = r.Min
+		s.Maximum = r.Max
+	}
+
+	return s
+}
+
+// JSON type holding the values of a column type
+func jsonType(t string) string {
+	switch t {
+	case TypeInteger:
+		return "integer"
+	case TypeFloat:
+		return "number"
+	case TypeBoolean:
+		return "boolean"
+	}
+
+	return "string"
+}
+
+// Checks row data against the document schema, including the rules of its
+// columns other than unique values, which CheckUnique checks. Returns a
+// *SchemaError listing every violation when it does not match.
+func (d *Document) ValidateRow(rowData JSONB) error {
+	violations := []Violation{}
+	known := make(map[string]bool, len(d.Header))
+
+	for _, h := range d.Header {
+		known[h.Name] = true
+		v, ok := rowData[h.Name]
+
+		if !ok {
+			if !h.AcceptsNull() {
+				violations = append(violations, Violation{Path: pointer(h.Name), Expected: describeType(h), Got: "missing"})
+			}
+
+			continue
+		}
+
+		if got, ok := h.check(v); !ok {
+			violations = append(violations, Violation{Path: pointer(h.Name), Expected: describeType(h), Got: got})
+			continue
+		}
+
+		if violation, ok := h.checkRules(v); !ok {
+			violations = append(violations, violation)
+		}
+	}
+
+	unknown := []string{}
+
+	for name := range rowData {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+
+	sort.Strings(unknown)
+
+	for _, name := range unknown {
+		violations = append(violations, Violation{Path: pointer(name), Expected: "no value, the document has no such column", Got: jsonTypeOf(rowData[name])})
+	}
+
+	if len(violations) > 0 {
+		return &SchemaError{Violations: violations}
+	}
+
+	return nil
+}
+
+// Checks a value against the column, describing it when it does not fit
+func (h Header) check(v interface{}) (string, bool) {
+	got := jsonTypeOf(v)
+
+	if v == nil {
+		return got, h.AcceptsNull()
+	}
+
+	switch h.Type {
+	case TypeInteger:
+		return got, isInteger(v)
+	case TypeFloat:
+		return got, got == "number" || got == "integer"
+	case TypeBoolean:
+		return got, got == "boolean"
+	case TypeDateTime:
+		s, ok := v.(string)
+
+		if !ok {
+			return got, false
+		}
+
+		_, err := time.Parse(time.RFC3339Nano, s)
+
+		if err != nil {
+			return fmt.Sprintf("string %q", s), false
+		}
+
+		return got, true
+	}
+
+	return got, got == "string"
+}
+
+func isInteger(v interface{}) bool {
+	switch n := v.(type) {
+	case json.Number:
+		_, err := n.Int64()
+		return err == nil
+	case float64:
+		return n == math.Trunc(n) && !math.IsInf(n, 0)
+	case int, int64:
+		return true
+	}
+
+	return false
+}
+
+// Describes the values a column accepts
+func describeType(h Header) string {
+	expected := jsonType(h.Type)
+
+	if h.Type == TypeDateTime {
+		expected += " in RFC 3339 date-time format"
+	}
+
+	if h.AcceptsNull() {
+		expected += " or null"
+	}
+
+	return expected
+}
+
+// Names the JSON type of a decoded value
+func jsonTypeOf(v interface{}) string {
+	switch n := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case json.Number, float64, int, int64:
+		if isInteger(n) {
+			return "integer"
+		}
+
+		return "number"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+
+	return fmt.Sprintf("%T", v)
+}
+
+// JSON pointer to a property of the row data
+func pointer(name string) string {
+	return "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
@@ -0,0 +1,165 @@
+package model
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/phankanp/csv-to-json/query"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Text search configuration, lower casing words without stemming them so any
+// language matches
+const SearchConfig = "simple"
+
+// Kinds of JSON values searched, which leaves out keys so column names do not
+// match
+const searchedValues = `'["string", "numeric", "boolean"]'`
+
+// Full text search of the values of a document's rows
+type textSearch struct {
+	Text string
+	// Columns searched, every column when all is set
+	Columns Fields
+	all     bool
+}
+
+// Creates the full text index over row data that searches of every column use
+func CreateSearchIndex(db *gorm.DB) error {
+	return db.Exec("CREATE INDEX IF NOT EXISTS idx_rows_data_search ON rows USING GIN (" + searchVector("data") + ")").Error
+}
+
+// Restricts rows to those matching a full text search of the columns, or of
+// every column of the document when none are given, ranking the best matches
+// first unless rows are sorted. Search terms follow web search syntax: quoted
+// phrases, or, and - to exclude a word.
+func (q *RowQuery) Search(text string, columns Fields, headers []Header) {
+	s := &textSearch{Text: text, Columns: columns}
+
+	if len(columns) == 0 {
+		s.all = true
+
+		for _, h := range headers {
+			s.Columns = append(s.Columns, h.Name)
+		}
+	}
+
+	q.search = s
+
+	vector := s.vector()
+	tsquery := s.tsquery()
+	q.Where(vector.Text+" @@ "+tsquery.Text, append(vector.Args, tsquery.Args...)...)
+}
+
+// Checks if rows are ordered by search rank
+func (q RowQuery) Ranked() bool {
+	return q.search != nil && len(q.Sort) == 0
+}
+
+// Document of the searched values of a row. Searches of every column use the
+// expression of the search index.
+func (s *textSearch) vector() query.SQL {
+	if s.all {
+		return query.SQL{Text: searchVector("data")}
+	}
+
+	projection := s.Columns.projection()
+
+	return query.SQL{Text: searchVector(projection.Text), Args: projection.Args}
+}
+
+func searchVector(data string) string {
+	return "jsonb_to_tsvector('" + SearchConfig + "', " + data + ", " + searchedValues + ")"
+}
+
+func (s *textSearch) tsquery() query.SQL {
+	return query.SQL{Text: "websearch_to_tsquery('" + SearchConfig + "', ?)", Args: []interface{}{s.Text}}
+}
+
+// Orders rows by how well they match, best first
+func (s *textSearch) orderBy() orderBy {
+	vector := s.vector()
+	tsquery := s.tsquery()
+
+	return orderBy{
+		SQL:  "ts_rank(" + vector.Text + ", " + tsquery.Text + ") DESC, id ASC",
+		Vars: append(vector.Args, tsquery.Args...),
+	}
+}
+
+// Sets the highlights of rows to their matching values, with matched words
+// marked by <b> tags
+func (s *textSearch) highlight(db *gorm.DB, rows []Row) error {
+	if len(rows) == 0 || len(s.Columns) == 0 {
+		return nil
+	}
+
+	tsquery := s.tsquery()
+	parts := make([]string, 0, len(s.Columns))
+	args := make([]interface{}, 0)
+
+	for _, column := range s.Columns {
+		text := query.Field("data", column, TypeString)
+		parts = append(parts, "?::text, CASE WHEN to_tsvector('"+SearchConfig+"', COALESCE("+text.Text+", '')) @@ "+tsquery.Text+
+			" THEN ts_headline('"+SearchConfig+"', "+text.Text+", "+tsquery.Text+") END")
+		args = append(args, column)
+		args = append(args, text.Args...)
+		args = append(args, tsquery.Args...)
+		args = append(args, text.Args...)
+		args = append(args, tsquery.Args...)
+	}
+
+	ids := make([]uint, len(rows))
+	index := make(map[uint]int, len(rows))
+
+	for i, row := range rows {
+		ids[i] = row.ID
+		index[row.ID] = i
+	}
+
+	// Postgres functions take at most 100 arguments, so wide documents build
+	// their highlights from several objects
+	objects := make([]string, 0, len(parts)/50+1)
+
+	for i := 0; i < len(parts); i += 50 {
+		end := i + 50
+
+		if end > len(parts) {
+			end = len(parts)
+		}
+
+		objects = append(objects, "jsonb_build_object("+strings.Join(parts[i:end], ", ")+")")
+	}
+
+	selects := "id, jsonb_strip_nulls(" + strings.Join(objects, " || ") + ")"
+
+	result, err := db.Model(&Row{}).Clauses(clause.Select{Expression: clause.Expr{SQL: selects, Vars: args}}).
+		Where("id IN ?", ids).Rows()
+
+	if err != nil {
+		return err
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var id uint
+		var highlights []byte
+
+		err = result.Scan(&id, &highlights)
+
+		if err != nil {
+			return err
+		}
+
+		row := &rows[index[id]]
+		err = json.Unmarshal(highlights, &row.Highlights)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return result.Err()
+}
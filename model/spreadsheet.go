@@ -0,0 +1,95 @@
+package model
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/phankanp/csv-to-json/xlsx"
+	"gorm.io/gorm"
+)
+
+// Adapts the rows of a spreadsheet sheet to a record source
+type xlsxSource struct {
+	rows   *xlsx.Rows
+	values []interface{}
+}
+
+func (s *xlsxSource) Read() ([]interface{}, error) {
+	values, err := s.rows.Next()
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.values = values
+
+	return values, nil
+}
+
+func (s *xlsxSource) Line() int {
+	return s.rows.Number()
+}
+
+func (s *xlsxSource) Raw() string {
+	cells := make([]string, len(s.values))
+
+	for i, v := range s.values {
+		if v != nil {
+			cells[i] = fmt.Sprint(v)
+		}
+	}
+
+	return strings.Join(cells, ",")
+}
+
+// Names of the sheets in an xlsx workbook
+func SheetNames(file io.ReaderAt, size int64) ([]string, error) {
+	wb, err := xlsx.Open(file, size)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return wb.SheetNames(), nil
+}
+
+// Streams the rows of one sheet of an xlsx workbook into the database in
+// batches and creates document headers from its first row. The sheet named in
+// the options is used, or the first sheet when none is given. Numeric, boolean
+// and date cells keep their types.
+func XLSX2Map(file io.ReaderAt, size int64, d *Document, db *gorm.DB, opts IngestOptions) error {
+	wb, err := xlsx.Open(file, size)
+
+	if err != nil {
+		return err
+	}
+
+	sheet := opts.Sheet
+
+	if sheet == "" {
+		names := wb.SheetNames()
+
+		if len(names) == 0 {
+			return nil
+		}
+
+		sheet = names[0]
+	}
+
+	rows, err := wb.Rows(sheet)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	hasHeader := true
+
+	if opts.Dialect.HasHeader != nil {
+		hasHeader = *opts.Dialect.HasHeader
+	}
+
+	return ingestRecords(&xlsxSource{rows: rows}, d, db, opts, hasHeader, true)
+}
@@ -0,0 +1,153 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/phankanp/csv-to-json/query"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Number of most frequent values reported when no number is given
+const DefaultTopValues = 10
+
+// Largest number of most frequent values reported for a column
+const MaxTopValues = 100
+
+// Value of a column with the number of rows holding it
+type ValueCount struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// Profile of the values of a column. Min and max are given for numeric and
+// datetime columns, mean for numeric columns.
+type ColumnStats struct {
+	Column   string       `json:"column"`
+	Type     string       `json:"type"`
+	Rows     int64        `json:"rows"`
+	Nulls    int64        `json:"nulls"`
+	Empty    int64        `json:"empty"`
+	Distinct int64        `json:"distinct"`
+	Top      []ValueCount `json:"top"`
+	Min      interface{}  `json:"min,omitempty"`
+	Max      interface{}  `json:"max,omitempty"`
+	Mean     interface{}  `json:"mean,omitempty"`
+}
+
+// Profiles of every column of a document
+type DocumentStats struct {
+	Rows    int64         `json:"rows"`
+	Columns []ColumnStats `json:"columns"`
+}
+
+// Finds the header of a document with the given name
+func (d *Document) HeaderByName(name string) (Header, error) {
+	for _, h := range d.Header {
+		if h.Name == name {
+			return h, nil
+		}
+	}
+
+	return Header{}, fmt.Errorf("unknown column %q", name)
+}
+
+// Computes the profile of a column from the stored rows, with its top most
+// frequent values
+func (d *Document) ColumnStats(db *gorm.DB, h Header, top int) (*ColumnStats, error) {
+	stats := &ColumnStats{Column: h.Name, Type: h.Type, Top: []ValueCount{}}
+
+	text := query.Field("data", h.Name, TypeString)
+	typed := query.Field("data", h.Name, h.Type)
+
+	selects := []string{
+		"COUNT(*)",
+		"COUNT(*) FILTER (WHERE " + text.Text + " IS NULL)",
+		"COUNT(*) FILTER (WHERE " + text.Text + " = '')",
+		"COUNT(DISTINCT " + text.Text + ")",
+	}
+	args := append(append(append([]interface{}{}, text.Args...), text.Args...), text.Args...)
+	values := []interface{}{&stats.Rows, &stats.Nulls, &stats.Empty, &stats.Distinct}
+
+	numeric := h.Type == TypeInteger || h.Type == TypeFloat
+
+	if numeric || h.Type == TypeDateTime {
+		selects = append(selects, "MIN("+typed.Text+")", "MAX("+typed.Text+")")
+		args = append(append(args, typed.Args...), typed.Args...)
+		values = append(values, &stats.Min, &stats.Max)
+	}
+
+	if numeric {
+		selects = append(selects, "AVG("+typed.Text+")")
+		args = append(args, typed.Args...)
+		values = append(values, &stats.Mean)
+	}
+
+	err := db.Model(&Row{}).Clauses(clause.Select{Expression: clause.Expr{SQL: strings.Join(selects, ", "), Vars: args}}).
+		Where("document_id = ?", d.ID).Row().Scan(values...)
+
+	if err != nil {
+		return &ColumnStats{}, err
+	}
+
+	stats.Min = scannedValue(stats.Min, numeric)
+	stats.Max = scannedValue(stats.Max, numeric)
+	stats.Mean = scannedValue(stats.Mean, numeric)
+
+	if top <= 0 {
+		return stats, nil
+	}
+
+	rows, err := db.Model(&Row{}).Clauses(clause.Select{Expression: clause.Expr{SQL: text.Text + ", COUNT(*)", Vars: text.Args}}).
+		Where("document_id = ?", d.ID).Where(text.Text+" IS NOT NULL", text.Args...).
+		Group("1").Order("2 DESC, 1").Limit(top).Rows()
+
+	if err != nil {
+		return &ColumnStats{}, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		v := ValueCount{}
+		err = rows.Scan(&v.Value, &v.Count)
+
+		if err != nil {
+			return &ColumnStats{}, err
+		}
+
+		stats.Top = append(stats.Top, v)
+	}
+
+	err = rows.Err()
+
+	if err != nil {
+		return &ColumnStats{}, err
+	}
+
+	return stats, nil
+}
+
+// Computes the profile of every column of a document
+func (d *Document) Stats(db *gorm.DB, top int) (*DocumentStats, error) {
+	stats := &DocumentStats{Columns: []ColumnStats{}}
+
+	for _, h := range d.Header {
+		column, err := d.ColumnStats(db, h, top)
+
+		if err != nil {
+			return &DocumentStats{}, err
+		}
+
+		stats.Rows = column.Rows
+		stats.Columns = append(stats.Columns, *column)
+	}
+
+	return stats, nil
+}
+
+// Version of a document's contents, changing whenever its rows or headers do
+func (d *Document) Version() int64 {
+	return d.UpdatedAt.UnixNano()
+}
@@ -0,0 +1,289 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Column types inferred for document headers
+const (
+	TypeString   = "string"
+	TypeInteger  = "integer"
+	TypeFloat    = "float"
+	TypeBoolean  = "boolean"
+	TypeDateTime = "datetime"
+)
+
+// Layouts recognised as date/time values, most specific first
+var dateTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// Checks if t is a known column type
+func ValidType(t string) bool {
+	switch t {
+	case TypeString, TypeInteger, TypeFloat, TypeBoolean, TypeDateTime:
+		return true
+	}
+	return false
+}
+
+// Checks the per column type overrides submitted with an upload
+func ValidateTypeOverrides(types map[string]string) error {
+	for column, t := range types {
+		if !ValidType(t) {
+			return fmt.Errorf("invalid type %q for column %q, expected string, integer, float, boolean or datetime", t, column)
+		}
+	}
+	return nil
+}
+
+// Type and nullability inferred for a column
+type columnType struct {
+	Type     string
+	Nullable bool
+}
+
+// Tracks which types every value seen so far in a column fits
+type typeCandidates struct {
+	integer, float, boolean, datetime bool
+	seen, nullable                    bool
+}
+
+func newTypeCandidates() *typeCandidates {
+	return &typeCandidates{integer: true, float: true, boolean: true, datetime: true}
+}
+
+func (c *typeCandidates) observe(v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		c.nullable = true
+		return
+	case string:
+		if v == "" {
+			c.nullable = true
+			return
+		}
+	}
+
+	c.seen = true
+
+	// Codes such as 01234 lose their leading zeros as numbers, and ids too
+	// long for an integer lose digits as floats
+	if s, ok := v.(string); (ok && zeroPadded(s)) || largeInteger(v) {
+		c.integer = false
+		c.float = false
+	}
+
+	for _, t := range []string{TypeInteger, TypeFloat, TypeBoolean, TypeDateTime} {
+		if _, err := ConvertValue(t, v); err != nil {
+			switch t {
+			case TypeInteger:
+				c.integer = false
+			case TypeFloat:
+				c.float = false
+			case TypeBoolean:
+				c.boolean = false
+			case TypeDateTime:
+				c.datetime = false
+			}
+		}
+	}
+}
+
+func (c *typeCandidates) result() columnType {
+	ct := columnType{Type: TypeString, Nullable: c.nullable}
+
+	if !c.seen {
+		return ct
+	}
+
+	switch {
+	case c.integer:
+		ct.Type = TypeInteger
+	case c.float:
+		ct.Type = TypeFloat
+	case c.boolean:
+		ct.Type = TypeBoolean
+	case c.datetime:
+		ct.Type = TypeDateTime
+	}
+
+	return ct
+}
+
+// Reports whether a value is a number written with leading zeros
+func zeroPadded(s string) bool {
+	s = strings.TrimLeft(strings.TrimSpace(s), "+-")
+
+	return len(s) > 1 && s[0] == '0' && s[1] >= '0' && s[1] <= '9'
+}
+
+// Reports whether a value is an integer too large for int64
+func largeInteger(v interface{}) bool {
+	var s string
+
+	switch v := v.(type) {
+	case string:
+		s = v
+	case json.Number:
+		s = v.String()
+	default:
+		return false
+	}
+
+	_, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+
+	return errors.Is(err, strconv.ErrRange)
+}
+
+// Type a column inferred as t takes on to hold a value that does not fit it:
+// float for integer columns holding a number other than an integer past
+// int64, string otherwise
+func demotedType(t string, v interface{}) string {
+	if t != TypeInteger {
+		return TypeString
+	}
+
+	if s, ok := v.(string); (ok && zeroPadded(s)) || largeInteger(v) {
+		return TypeString
+	}
+
+	if _, err := ConvertValue(TypeFloat, v); err == nil {
+		return TypeFloat
+	}
+
+	return TypeString
+}
+
+// Infers a type for each column from sampled records. Overrides keyed by
+// column name take precedence over the inferred type.
+func inferColumnTypes(headers []string, sample []sourceRecord, overrides map[string]string) []columnType {
+	candidates := make([]*typeCandidates, len(headers))
+
+	for i := range candidates {
+		candidates[i] = newTypeCandidates()
+	}
+
+	for _, rec := range sample {
+		for i, v := range rec.values {
+			candidates[i].observe(v)
+		}
+	}
+
+	types := make([]columnType, len(headers))
+
+	for i, name := range headers {
+		types[i] = candidates[i].result()
+
+		if t, ok := overrides[name]; ok {
+			types[i].Type = t
+		}
+	}
+
+	return types
+}
+
+// Converts a cell value to the JSON value stored for a column of type t.
+// Empty strings become null for every type but string.
+func ConvertValue(t string, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	if n, ok := v.(json.Number); ok {
+		if t == TypeString {
+			return n.String(), nil
+		}
+		v = n.String()
+	}
+
+	s, isString := v.(string)
+
+	if isString && s == "" && t != TypeString {
+		return nil, nil
+	}
+
+	switch t {
+	case TypeString:
+		if isString {
+			return s, nil
+		}
+		if tm, ok := v.(time.Time); ok {
+			return tm.Format(time.RFC3339Nano), nil
+		}
+		return fmt.Sprint(v), nil
+
+	case TypeInteger:
+		switch n := v.(type) {
+		case string:
+			i, err := strconv.ParseInt(strings.TrimSpace(n), 10, 64)
+			if err == nil {
+				return i, nil
+			}
+		case int64:
+			return n, nil
+		case int:
+			return int64(n), nil
+		case float64:
+			if n == math.Trunc(n) && math.Abs(n) < 1<<53 {
+				return int64(n), nil
+			}
+		}
+
+	case TypeFloat:
+		switch n := v.(type) {
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+			if err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+				return f, nil
+			}
+		case float64:
+			return n, nil
+		case int64:
+			return float64(n), nil
+		case int:
+			return float64(n), nil
+		}
+
+	case TypeBoolean:
+		switch b := v.(type) {
+		case string:
+			switch strings.ToLower(strings.TrimSpace(b)) {
+			case "true":
+				return true, nil
+			case "false":
+				return false, nil
+			}
+		case bool:
+			return b, nil
+		}
+
+	case TypeDateTime:
+		switch tm := v.(type) {
+		case string:
+			for _, layout := range dateTimeLayouts {
+				if parsed, err := time.Parse(layout, strings.TrimSpace(tm)); err == nil {
+					return parsed.Format(time.RFC3339Nano), nil
+				}
+			}
+		case time.Time:
+			return tm.Format(time.RFC3339Nano), nil
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown type %q", t)
+	}
+
+	return nil, errors.New("expected " + t)
+}
@@ -0,0 +1,124 @@
+package model
+
+import (
+	"github.com/phankanp/csv-to-json/query"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Options for listing the distinct values of a column
+type ValueQuery struct {
+	// Page of values and the conditions of the rows they are read from
+	Rows RowQuery
+	// Start every value must have
+	Prefix string
+	// Order by how often values occur instead of by value
+	ByCount bool
+}
+
+// Page of the distinct values of a column
+type ValueList struct {
+	Page
+	Values []ValueCount
+}
+
+// Lists a page of the distinct values of a column with the number of rows
+// holding each, ordered by value using the column type. Nulls are left out.
+func (d *Document) DistinctValues(db *gorm.DB, h Header, q ValueQuery) (*ValueList, error) {
+	list := &ValueList{Page: Page{Limit: q.Rows.limit()}, Values: []ValueCount{}}
+	text := query.Field("data", h.Name, TypeString)
+
+	values := func() (*gorm.DB, error) {
+		tx := db.Model(&Row{}).Where("document_id = ?", d.ID).Where(text.Text+" IS NOT NULL", text.Args...)
+
+		for _, condition := range q.Rows.conditions {
+			tx = condition(tx)
+		}
+
+		if q.Prefix != "" {
+			prefix, err := query.Compile(query.Condition{Column: h.Name, Op: query.OpStartsWith, Value: query.Literal{Text: q.Prefix}},
+				"data", map[string]string{h.Name: h.Type}, ConvertValue)
+
+			if err != nil {
+				return nil, err
+			}
+
+			tx = tx.Where(prefix.Text, prefix.Args...)
+		}
+
+		return tx, nil
+	}
+
+	if q.Rows.Count {
+		tx, err := values()
+
+		if err != nil {
+			return &ValueList{}, err
+		}
+
+		var total int64
+
+		err = tx.Clauses(clause.Select{Expression: clause.Expr{SQL: "COUNT(DISTINCT " + text.Text + ")", Vars: text.Args}}).
+			Row().Scan(&total)
+
+		if err != nil {
+			return &ValueList{}, err
+		}
+
+		list.Total = &total
+	}
+
+	tx, err := values()
+
+	if err != nil {
+		return &ValueList{}, err
+	}
+
+	// Values are grouped as text, so typed columns are ordered through an
+	// aggregate of the typed value of each group
+	order := orderBy{SQL: "1"}
+
+	switch {
+	case q.ByCount:
+		order = orderBy{SQL: "2 DESC, 1"}
+	case h.Type == TypeInteger || h.Type == TypeFloat || h.Type == TypeDateTime:
+		typed := query.Field("data", h.Name, h.Type)
+		order = orderBy{SQL: "MIN(" + typed.Text + "), 1", Vars: typed.Args}
+	}
+
+	rows, err := tx.Clauses(clause.Select{Expression: clause.Expr{SQL: text.Text + ", COUNT(*)", Vars: text.Args}}).
+		Group("1").Clauses(order).Limit(list.Limit + 1).Offset(q.Rows.Offset).Rows()
+
+	if err != nil {
+		return &ValueList{}, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		v := ValueCount{}
+		err = rows.Scan(&v.Value, &v.Count)
+
+		if err != nil {
+			return &ValueList{}, err
+		}
+
+		list.Values = append(list.Values, v)
+	}
+
+	err = rows.Err()
+
+	if err != nil {
+		return &ValueList{}, err
+	}
+
+	more := len(list.Values) > list.Limit
+
+	if more {
+		list.Values = list.Values[:list.Limit]
+	}
+
+	list.offsetLinks(q.Rows.Offset, more)
+
+	return list, nil
+}
@@ -0,0 +1,476 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/phankanp/csv-to-json/helper"
+	"github.com/phankanp/csv-to-json/model"
+	"github.com/phankanp/csv-to-json/response"
+)
+
+// Describes the API of the documents of a user, each document a resource of
+// rows typed by its headers
+func Documents(username string, docs []model.Document) *Spec {
+	spec := baseSpec(username)
+	users := "/" + url.PathEscape(username)
+
+	spec.Paths[users+"/documents"] = &PathItem{
+		Get: &Operation{
+			OperationID: "listDocuments",
+			Summary:     "List documents",
+			Parameters: []*Parameter{
+				queryParameter("rows", "Include the rows of every document", &Schema{Type: "boolean", Default: false}),
+				queryParameter("headers", "Include the headers of every document", &Schema{Type: "boolean", Default: true}),
+				paramRef("fields"),
+			},
+			Responses: responses(jsonResponse("Documents", &Schema{Type: "array", Items: Ref("Document")}), "400", "401"),
+		},
+	}
+
+	names := helper.TypeNames(docs)
+	var latest time.Time
+
+	for _, d := range docs {
+		addDocument(spec, users+"/documents/"+d.ID.String(), names[d.ID.String()], d)
+
+		if d.UpdatedAt.After(latest) {
+			latest = d.UpdatedAt
+		}
+	}
+
+	sort.Slice(spec.Tags, func(i, j int) bool {
+		return spec.Tags[i].Name < spec.Tags[j].Name
+	})
+
+	// Changes with every document write, so clients can tell when to
+	// regenerate
+	if !latest.IsZero() {
+		spec.Info.Version = latest.UTC().Format(time.RFC3339Nano)
+	}
+
+	return spec
+}
+
+// Spec of the schemas, parameters and responses shared by every document
+func baseSpec(username string) *Spec {
+	return &Spec{
+		OpenAPI: Version,
+		Info: Info{
+			Title:       "CSV2API documents of " + username,
+			Description: "Documents uploaded by " + username + " served as REST resources, with rows typed by the inferred type of each column.",
+			Version:     "0",
+		},
+		Paths: map[string]*PathItem{},
+		Components: Components{
+			Schemas: map[string]*Schema{
+				"Error": {
+					Type: "object",
+					Properties: map[string]*Schema{
+						"error":   {Type: "string"},
+						"message": {Type: "string"},
+						"code":    {Type: "integer"},
+						"details": {Description: "Structured details of the failure"},
+					},
+					Required: []string{"error", "message", "code"},
+				},
+				"Header": {
+					Type: "object",
+					Properties: map[string]*Schema{
+						"name":     {Type: "string"},
+						"type":     {Type: "string", Enum: []interface{}{model.TypeString, model.TypeInteger, model.TypeFloat, model.TypeBoolean, model.TypeDateTime}},
+						"nullable": {Type: "boolean"},
+						"rules":    Ref("Rules"),
+					},
+					Required: []string{"name", "type", "nullable"},
+				},
+				"Rules": {
+					Type:        "object",
+					Description: "Constraints on the values of a column, checked whenever rows are written",
+					Properties: map[string]*Schema{
+						"required":   {Type: "boolean", Description: "Requires a value that is neither null nor an empty string"},
+						"enum":       {Type: "array", Description: "Values the column accepts", Items: &Schema{}},
+						"pattern":    {Type: "string", Description: "Regular expression string values must match"},
+						"min":        {Description: "Least integer, float or RFC 3339 datetime value"},
+						"max":        {Description: "Greatest integer, float or RFC 3339 datetime value"},
+						"max_length": {Type: "integer", Description: "Most characters a string value may have", Minimum: float(0)},
+						"unique":     {Type: "boolean", Description: "Requires every row to hold a different value"},
+					},
+				},
+				"Dialect": {
+					Type: "object",
+					Properties: map[string]*Schema{
+						"delimiter":   {Type: "string"},
+						"quote":       {Type: "string"},
+						"lazy_quotes": {Type: "boolean"},
+						"comment":     {Type: "string"},
+						"has_header":  {Type: "boolean"},
+						"encoding":    {Type: "string"},
+					},
+				},
+				"Document": {
+					Type: "object",
+					Properties: map[string]*Schema{
+						"id":         {Type: "string", Format: "uuid"},
+						"title":      {Type: "string"},
+						"headers":    {Type: "array", Items: Ref("Header")},
+						"rows":       {Type: "array", Items: &Schema{Type: "object", Properties: map[string]*Schema{"id": {Type: "integer"}, "data": {Type: "object"}}}},
+						"format":     {Type: "string"},
+						"dialect":    Ref("Dialect"),
+						"key_column": {Type: "string"},
+					},
+					Required: []string{"id", "title", "format", "dialect"},
+				},
+			},
+			Parameters: map[string]*Parameter{
+				"limit":   queryParameter("limit", "Most rows in a page", &Schema{Type: "integer", Minimum: float(1), Maximum: float(model.MaxRowLimit), Default: model.DefaultRowLimit}),
+				"offset":  queryParameter("offset", "Number of rows skipped", &Schema{Type: "integer", Minimum: float(0)}),
+				"cursor":  queryParameter("cursor", "Cursor of a page, from the Link header of the previous page", &Schema{Type: "string"}),
+				"count":   queryParameter("count", "Count every matching row in the X-Total-Count header", &Schema{Type: "boolean", Default: false}),
+				"filter":  queryParameter("filter", "Condition rows must match, such as price > 10 and status = 'open'", &Schema{Type: "string"}),
+				"sort":    queryParameter("sort", "Comma separated columns rows are ordered by, each descending when prefixed by -", &Schema{Type: "string"}),
+				"fields":  queryParameter("fields", "Comma separated columns rows are limited to", &Schema{Type: "string"}),
+				"q":       queryParameter("q", "Full text search of row values, in web search syntax", &Schema{Type: "string"}),
+				"columns": queryParameter("columns", "Comma separated columns searched by q, every column by default", &Schema{Type: "string"}),
+				"format":  queryParameter("format", "Output format, instead of the Accept header", formatSchema()),
+				"upsert":  queryParameter("upsert", "Update the row holding the key instead of failing", &Schema{Type: "boolean", Default: false}),
+				"rowID":   {Name: "rowID", In: "path", Required: true, Schema: &Schema{Type: "integer"}},
+				"key":     {Name: "key", In: "path", Description: "Value of the key column of the row", Required: true, Schema: &Schema{Type: "string"}},
+			},
+			Responses: map[string]*Response{
+				"400": errorResponse("The request is invalid"),
+				"401": errorResponse("The api key is invalid or the document belongs to another user"),
+				"404": errorResponse("The document or row does not exist"),
+				"409": errorResponse("A row already holds the key"),
+				"422": errorResponse("The row data does not match the document schema, with every violation in details"),
+			},
+			SecuritySchemes: map[string]*SecurityScheme{
+				"apiKey": {Type: "apiKey", Name: "key", In: "header"},
+			},
+		},
+		Security: []map[string][]string{{"apiKey": {}}},
+	}
+}
+
+// Adds the schemas and paths of a document, with schemas and operations named
+// after name
+func addDocument(spec *Spec, path string, name string, d model.Document) {
+	data := &Schema{Type: "object", Properties: map[string]*Schema{}, AdditionalProperties: false}
+
+	for _, h := range d.Header {
+		data.Properties[h.Name] = columnSchema(h)
+
+		if !h.AcceptsNull() {
+			data.Required = append(data.Required, h.Name)
+		}
+	}
+
+	spec.Components.Schemas[name+"Data"] = data
+	spec.Components.Schemas[name+"Row"] = &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"id":         {Type: "integer"},
+			"data":       Ref(name + "Data"),
+			"highlights": {Type: "object", Description: "Values matching a full text search, with matched words in <b> tags", AdditionalProperties: &Schema{Type: "string"}},
+		},
+		Required: []string{"id", "data"},
+	}
+
+	spec.Tags = append(spec.Tags, Tag{Name: name, Description: d.Title})
+	tags := []string{name}
+
+	row := jsonResponse(name+" row", Ref(name+"Row"))
+	body := &RequestBody{Required: true, Content: map[string]*MediaType{"application/json": {Schema: Ref(name + "Data")}}}
+	deleted := jsonResponse("The row was deleted", &Schema{Type: "string"})
+
+	spec.Paths[path] = &PathItem{
+		Get: &Operation{
+			OperationID: "get" + name,
+			Summary:     "Get " + d.Title,
+			Tags:        tags,
+			Parameters: []*Parameter{
+				queryParameter("rows", "Include a page of the rows", &Schema{Type: "boolean", Default: false}),
+				queryParameter("headers", "Include the headers", &Schema{Type: "boolean", Default: true}),
+				paramRef("limit"),
+				paramRef("offset"),
+				paramRef("cursor"),
+				paramRef("count"),
+				paramRef("fields"),
+				paramRef("format"),
+			},
+			Responses: responses(formatResponse("The document, or its rows in another format", Ref("Document"), name), "400", "401", "404"),
+		},
+		Delete: &Operation{
+			OperationID: "delete" + name,
+			Summary:     "Delete " + d.Title,
+			Tags:        tags,
+			Responses:   responses(jsonResponse("The document was deleted", &Schema{Type: "string"}), "401", "404"),
+		},
+	}
+
+	spec.Paths[path+".{format}"] = &PathItem{
+		Get: &Operation{
+			OperationID: "export" + name,
+			Summary:     "Export the rows of " + d.Title + " as a file",
+			Tags:        tags,
+			Parameters: append([]*Parameter{{Name: "format", In: "path", Required: true, Schema: formatSchema()}},
+				paramRefs("limit", "offset", "filter", "sort", "fields", "q", "columns")...),
+			Responses: responses(formatResponse("The rows as a file", nil, name), "400", "401", "404"),
+		},
+	}
+
+	spec.Paths[path+"/schema"] = &PathItem{
+		Get: &Operation{
+			OperationID: "get" + name + "Schema",
+			Summary:     "Get the JSON Schema rows of " + d.Title + " are validated against",
+			Tags:        tags,
+			Responses:   responses(jsonResponse("JSON Schema of the row data", &Schema{Type: "object"}), "401", "404"),
+		},
+	}
+
+	spec.Paths[path+"/columns/{name}/rules"] = &PathItem{
+		Get: &Operation{
+			OperationID: "get" + name + "ColumnRules",
+			Summary:     "Get the validation rules of a column of " + d.Title,
+			Tags:        tags,
+			Parameters:  []*Parameter{columnParameter(d)},
+			Responses:   responses(jsonResponse("Validation rules of the column", Ref("Rules")), "401", "404"),
+		},
+		Put: &Operation{
+			OperationID: "set" + name + "ColumnRules",
+			Summary:     "Replace the validation rules of a column of " + d.Title,
+			Tags:        tags,
+			Parameters:  []*Parameter{columnParameter(d)},
+			RequestBody: &RequestBody{Required: true, Content: map[string]*MediaType{"application/json": {Schema: Ref("Rules")}}},
+			Responses:   responses(jsonResponse("The column with its new rules", Ref("Header")), "400", "401", "404"),
+		},
+	}
+
+	list := formatResponse("A page of rows, linked to the next and previous pages by the Link header", nil, name)
+	list.Headers = map[string]*Header{
+		"Link":          {Description: "Links to the next and previous pages", Schema: &Schema{Type: "string"}},
+		"X-Total-Count": {Description: "Number of matching rows, when count is set", Schema: &Schema{Type: "integer"}},
+	}
+
+	spec.Paths[path+"/rows"] = &PathItem{
+		Get: &Operation{
+			OperationID: "list" + name + "Rows",
+			Summary:     "List or search the rows of " + d.Title,
+			Tags:        tags,
+			Parameters: append(paramRefs("limit", "offset", "cursor", "count", "filter", "sort", "fields", "q", "columns", "format"),
+				queryParameter("column", "Column holding data, to find rows by value", columnsSchema(d)),
+				queryParameter("data", "Value of column in the rows found", &Schema{Type: "string"})),
+			Responses: responses(list, "400", "401", "404"),
+		},
+		Post: &Operation{
+			OperationID: "create" + name + "Row",
+			Summary:     "Create a row of " + d.Title,
+			Tags:        tags,
+			Parameters:  paramRefs("fields", "upsert"),
+			RequestBody: body,
+			Responses:   responses(row, "400", "401", "404", "409", "422"),
+		},
+	}
+
+	spec.Paths[path+"/rows/{rowID}"] = &PathItem{
+		Get: &Operation{
+			OperationID: "get" + name + "Row",
+			Summary:     "Get a row of " + d.Title,
+			Tags:        tags,
+			Parameters:  paramRefs("rowID", "fields"),
+			Responses:   responses(row, "401", "404"),
+		},
+		Put: &Operation{
+			OperationID: "update" + name + "Row",
+			Summary:     "Replace the data of a row of " + d.Title,
+			Tags:        tags,
+			Parameters:  paramRefs("rowID", "fields"),
+			RequestBody: body,
+			Responses:   responses(row, "400", "401", "404", "409", "422"),
+		},
+		Delete: &Operation{
+			OperationID: "delete" + name + "Row",
+			Summary:     "Delete a row of " + d.Title,
+			Tags:        tags,
+			Parameters:  paramRefs("rowID"),
+			Responses:   responses(deleted, "401", "404"),
+		},
+	}
+
+	if d.KeyColumn == "" {
+		return
+	}
+
+	spec.Paths[path+"/rows/by-key/{key}"] = &PathItem{
+		Get: &Operation{
+			OperationID: "get" + name + "RowByKey",
+			Summary:     "Get the row of " + d.Title + " by its " + d.KeyColumn,
+			Tags:        tags,
+			Parameters:  paramRefs("key", "fields"),
+			Responses:   responses(row, "401", "404"),
+		},
+		Put: &Operation{
+			OperationID: "update" + name + "RowByKey",
+			Summary:     "Replace the data of the row of " + d.Title + " by its " + d.KeyColumn,
+			Tags:        tags,
+			Parameters:  paramRefs("key", "fields"),
+			RequestBody: body,
+			Responses:   responses(row, "400", "401", "404", "409", "422"),
+		},
+		Delete: &Operation{
+			OperationID: "delete" + name + "RowByKey",
+			Summary:     "Delete the row of " + d.Title + " by its " + d.KeyColumn,
+			Tags:        tags,
+			Parameters:  paramRefs("key"),
+			Responses:   responses(deleted, "401", "404"),
+		},
+	}
+}
+
+// Schema of the values of a column of the header's type, within its rules
+func columnSchema(h model.Header) *Schema {
+	r := h.Rules
+	s := &Schema{
+		Type:      "string",
+		Nullable:  h.AcceptsNull(),
+		Enum:      r.Enum,
+		Pattern:   r.Pattern,
+		MaxLength: r.MaxLength,
+		Minimum:   bound(r.Min),
+		Maximum:   bound(r.Max),
+	}
+
+	switch h.Type {
+	case model.TypeInteger:
+		s.Type = "integer"
+		s.Format = "int64"
+	case model.TypeFloat:
+		s.Type = "number"
+		s.Format = "double"
+	case model.TypeBoolean:
+		s.Type = "boolean"
+	case model.TypeDateTime:
+		s.Format = "date-time"
+		s.Minimum = nil
+		s.Maximum = nil
+	}
+
+	if r.Required && h.Type == model.TypeString {
+		minLength := 1
+		s.MinLength = &minLength
+	}
+
+	return s
+}
+
+// Path parameter naming a column of a document
+func columnParameter(d model.Document) *Parameter {
+	return &Parameter{Name: "name", In: "path", Description: "Name of the column", Required: true, Schema: columnsSchema(d)}
+}
+
+// Numeric bound of a rule, nil when it is not a number
+func bound(v interface{}) *float64 {
+	switch n := v.(type) {
+	case int64:
+		return float(float64(n))
+	case float64:
+		return float(n)
+	case json.Number:
+		f, err := n.Float64()
+
+		if err == nil {
+			return float(f)
+		}
+	}
+
+	return nil
+}
+
+// Schema of the name of a column of a document
+func columnsSchema(d model.Document) *Schema {
+	s := &Schema{Type: "string"}
+
+	for _, h := range d.Header {
+		s.Enum = append(s.Enum, h.Name)
+	}
+
+	return s
+}
+
+// Schema of the name of a registered output format
+func formatSchema() *Schema {
+	s := &Schema{Type: "string"}
+
+	for _, f := range response.Formats() {
+		s.Enum = append(s.Enum, f.Name)
+	}
+
+	return s
+}
+
+// Successful response holding the rows of a document in every registered
+// format, or the JSON schema when given
+func formatResponse(description string, jsonSchema *Schema, name string) *Response {
+	if jsonSchema == nil {
+		jsonSchema = &Schema{Type: "array", Items: Ref(name + "Row")}
+	}
+
+	content := map[string]*MediaType{}
+
+	for _, f := range response.Formats() {
+		switch f.Name {
+		case response.JSON.Name:
+			content[f.ContentType] = &MediaType{Schema: jsonSchema}
+		case "ndjson":
+			content[f.ContentType] = &MediaType{Schema: Ref(name + "Row")}
+		default:
+			content[f.ContentType] = &MediaType{Schema: &Schema{Type: "string", Format: "binary"}}
+		}
+	}
+
+	return &Response{Description: description, Content: content}
+}
+
+func jsonResponse(description string, schema *Schema) *Response {
+	return &Response{Description: description, Content: map[string]*MediaType{"application/json": {Schema: schema}}}
+}
+
+func errorResponse(description string) *Response {
+	return jsonResponse(description, Ref("Error"))
+}
+
+// Responses of an operation, the successful one and the shared error
+// responses of the codes
+func responses(ok *Response, codes ...string) map[string]*Response {
+	r := map[string]*Response{"200": ok}
+
+	for _, code := range codes {
+		r[code] = &Response{Ref: "#/components/responses/" + code}
+	}
+
+	return r
+}
+
+func queryParameter(name string, description string, schema *Schema) *Parameter {
+	return &Parameter{Name: name, In: "query", Description: description, Schema: schema}
+}
+
+func paramRef(name string) *Parameter {
+	return &Parameter{Ref: "#/components/parameters/" + name}
+}
+
+func paramRefs(names ...string) []*Parameter {
+	params := make([]*Parameter, len(names))
+
+	for i, name := range names {
+		params[i] = paramRef(name)
+	}
+
+	return params
+}
+
+func float(f float64) *float64 {
+	return &f
+}
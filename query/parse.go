@@ -0,0 +1,402 @@
+// Package query parses row filter expressions such as
+//
+//	price gte 10 and (status in (new, open) or name contains 'widget')
+//
+// and compiles them to parameterized Postgres conditions on a JSONB column.
+package query
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Comparison operators
+const (
+	OpEq         = "eq"
+	OpNe         = "ne"
+	OpGt         = "gt"
+	OpGte        = "gte"
+	OpLt         = "lt"
+	OpLte        = "lte"
+	OpIn         = "in"
+	OpContains   = "contains"
+	OpStartsWith = "startswith"
+	OpRegex      = "regex"
+	OpIsNull     = "is-null"
+)
+
+// Symbols accepted in place of operator names
+var opAliases = map[string]string{
+	"=":  OpEq,
+	"==": OpEq,
+	"!=": OpNe,
+	"<>": OpNe,
+	">":  OpGt,
+	">=": OpGte,
+	"<":  OpLt,
+	"<=": OpLte,
+	"~":  OpRegex,
+}
+
+var operators = map[string]bool{
+	OpEq: true, OpNe: true, OpGt: true, OpGte: true, OpLt: true, OpLte: true,
+	OpIn: true, OpContains: true, OpStartsWith: true, OpRegex: true, OpIsNull: true,
+}
+
+// Most conditions a single filter may contain
+const MaxConditions = 100
+
+// Node of a parsed filter
+type Node interface {
+	node()
+}
+
+// Conditions combined with "and" or "or"
+type Group struct {
+	Or    bool
+	Nodes []Node
+}
+
+// Negated node
+type Not struct {
+	Node Node
+}
+
+// Comparison of a column with a value. In conditions have a list of values,
+// is-null conditions a true or false value.
+type Condition struct {
+	Column string
+	Op     string
+	Value  Literal
+	List   []Literal
+}
+
+func (Group) node()     {}
+func (Not) node()       {}
+func (Condition) node() {}
+
+// Value written in a filter
+type Literal struct {
+	Text string
+	// Unquoted null
+	Null bool
+}
+
+// Describes why a filter could not be parsed
+type Error struct {
+	Pos     int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("invalid filter at position %d: %s", e.Pos+1, e.Message)
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenString
+	tokenIdent
+	tokenOpen
+	tokenClose
+	tokenComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// Splits a filter into tokens. Strings are quoted with ' or " and column
+// names containing spaces or punctuation with `.
+func tokenize(s string) ([]token, error) {
+	tokens := make([]token, 0)
+	runes := []rune(s)
+
+	for i := 0; i < len(runes); {
+		c := runes[i]
+
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(' || c == '[':
+			tokens = append(tokens, token{kind: tokenOpen, text: string(c), pos: i})
+			i++
+		case c == ')' || c == ']':
+			tokens = append(tokens, token{kind: tokenClose, text: string(c), pos: i})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{kind: tokenComma, text: ",", pos: i})
+			i++
+		case c == '\'' || c == '"' || c == '`':
+			start := i
+			var b strings.Builder
+			i++
+
+			for ; i < len(runes) && runes[i] != c; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				b.WriteRune(runes[i])
+			}
+
+			if i == len(runes) {
+				return nil, &Error{Pos: start, Message: "unterminated quote"}
+			}
+
+			i++
+			kind := tokenString
+
+			if c == '`' {
+				kind = tokenIdent
+			}
+
+			tokens = append(tokens, token{kind: kind, text: b.String(), pos: start})
+		default:
+			start := i
+
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune("()[],'\"`", runes[i]) {
+				i++
+			}
+
+			tokens = append(tokens, token{kind: tokenWord, text: string(runes[start:i]), pos: start})
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: len(runes)}), nil
+}
+
+type parser struct {
+	tokens     []token
+	pos        int
+	conditions int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+
+	return t
+}
+
+// Checks if the next token is the given keyword, consuming it when it is
+func (p *parser) keyword(word string) bool {
+	t := p.peek()
+
+	if t.kind == tokenWord && strings.EqualFold(t.text, word) {
+		p.pos++
+		return true
+	}
+
+	return false
+}
+
+// Parses a filter expression. "and" binds tighter than "or", and parentheses
+// group conditions.
+func Parse(s string) (Node, error) {
+	tokens, err := tokenize(s)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	node, err := p.parseOr()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, &Error{Pos: t.pos, Message: fmt.Sprintf("unexpected %q", t.text)}
+	}
+
+	return node, nil
+}
+
+func (p *parser) parseOr() (Node, error) {
+	return p.parseGroup(true)
+}
+
+func (p *parser) parseAnd() (Node, error) {
+	return p.parseGroup(false)
+}
+
+// Parses operands joined by "or", or by "and" when or is false
+func (p *parser) parseGroup(or bool) (Node, error) {
+	operand := p.parseAnd
+	word := "or"
+
+	if !or {
+		operand = p.parseUnary
+		word = "and"
+	}
+
+	first, err := operand()
+
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := []Node{first}
+
+	for p.keyword(word) {
+		node, err := operand()
+
+		if err != nil {
+			return nil, err
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	if len(nodes) == 1 {
+		return first, nil
+	}
+
+	return Group{Or: or, Nodes: nodes}, nil
+}
+
+func (p *parser) parseUnary() (Node, error) {
+	if p.keyword("not") {
+		node, err := p.parseUnary()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return Not{Node: node}, nil
+	}
+
+	if t := p.peek(); t.kind == tokenOpen {
+		p.next()
+		node, err := p.parseOr()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if t := p.next(); t.kind != tokenClose {
+			return nil, &Error{Pos: t.pos, Message: "expected )"}
+		}
+
+		return node, nil
+	}
+
+	return p.parseCondition()
+}
+
+func (p *parser) parseCondition() (Node, error) {
+	p.conditions++
+
+	if p.conditions > MaxConditions {
+		return nil, &Error{Pos: p.peek().pos, Message: fmt.Sprintf("more than %d conditions", MaxConditions)}
+	}
+
+	column := p.next()
+
+	if column.kind != tokenWord && column.kind != tokenIdent && column.kind != tokenString {
+		return nil, &Error{Pos: column.pos, Message: "expected a column name"}
+	}
+
+	opToken := p.next()
+	op := strings.ToLower(opToken.text)
+
+	if alias, ok := opAliases[op]; ok {
+		op = alias
+	}
+
+	if opToken.kind != tokenWord || !operators[op] {
+		return nil, &Error{Pos: opToken.pos, Message: fmt.Sprintf("expected an operator after %q", column.text)}
+	}
+
+	c := Condition{Column: column.text, Op: op}
+
+	switch op {
+	case OpIsNull:
+		c.Value = Literal{Text: "true"}
+
+		if t := p.peek(); t.kind == tokenWord && (strings.EqualFold(t.text, "true") || strings.EqualFold(t.text, "false")) {
+			c.Value = Literal{Text: strings.ToLower(p.next().text)}
+		}
+	case OpIn:
+		list, err := p.parseList()
+
+		if err != nil {
+			return nil, err
+		}
+
+		c.List = list
+	default:
+		value, err := p.parseLiteral()
+
+		if err != nil {
+			return nil, err
+		}
+
+		c.Value = value
+	}
+
+	return c, nil
+}
+
+func (p *parser) parseLiteral() (Literal, error) {
+	t := p.next()
+
+	switch t.kind {
+	case tokenString:
+		return Literal{Text: t.text}, nil
+	case tokenWord:
+		if strings.EqualFold(t.text, "null") {
+			return Literal{Null: true}, nil
+		}
+
+		return Literal{Text: t.text}, nil
+	}
+
+	return Literal{}, &Error{Pos: t.pos, Message: "expected a value"}
+}
+
+func (p *parser) parseList() ([]Literal, error) {
+	if t := p.next(); t.kind != tokenOpen {
+		return nil, &Error{Pos: t.pos, Message: "expected a list of values in parentheses"}
+	}
+
+	list := make([]Literal, 0)
+
+	if p.peek().kind == tokenClose {
+		p.next()
+		return list, nil
+	}
+
+	for {
+		value, err := p.parseLiteral()
+
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, value)
+
+		t := p.next()
+
+		if t.kind == tokenClose {
+			return list, nil
+		}
+
+		if t.kind != tokenComma {
+			return nil, &Error{Pos: t.pos, Message: "expected , or ) in list"}
+		}
+	}
+}
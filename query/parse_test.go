@@ -0,0 +1,116 @@
+package query
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   Node
+	}{
+		{"price gte 10", Condition{Column: "price", Op: OpGte, Value: Literal{Text: "10"}}},
+		{"price >= 10", Condition{Column: "price", Op: OpGte, Value: Literal{Text: "10"}}},
+		{"name EQ 'a b'", Condition{Column: "name", Op: OpEq, Value: Literal{Text: "a b"}}},
+		{`name eq "it's"`, Condition{Column: "name", Op: OpEq, Value: Literal{Text: "it's"}}},
+		{`name eq 'it\'s'`, Condition{Column: "name", Op: OpEq, Value: Literal{Text: "it's"}}},
+		{"`unit price` lt 5", Condition{Column: "unit price", Op: OpLt, Value: Literal{Text: "5"}}},
+		{"note eq null", Condition{Column: "note", Op: OpEq, Value: Literal{Null: true}}},
+		{"note eq 'null'", Condition{Column: "note", Op: OpEq, Value: Literal{Text: "null"}}},
+		{"note is-null", Condition{Column: "note", Op: OpIsNull, Value: Literal{Text: "true"}}},
+		{"note is-null FALSE", Condition{Column: "note", Op: OpIsNull, Value: Literal{Text: "false"}}},
+		{"name ~ '^w'", Condition{Column: "name", Op: OpRegex, Value: Literal{Text: "^w"}}},
+		{"status in (new, 'on hold')", Condition{Column: "status", Op: OpIn, List: []Literal{{Text: "new"}, {Text: "on hold"}}}},
+		{"status in []", Condition{Column: "status", Op: OpIn, List: []Literal{}}},
+		{"not a eq 1", Not{Node: Condition{Column: "a", Op: OpEq, Value: Literal{Text: "1"}}}},
+		{
+			"a eq 1 or b eq 2 and c eq 3",
+			Group{Or: true, Nodes: []Node{
+				Condition{Column: "a", Op: OpEq, Value: Literal{Text: "1"}},
+				Group{Nodes: []Node{
+					Condition{Column: "b", Op: OpEq, Value: Literal{Text: "2"}},
+					Condition{Column: "c", Op: OpEq, Value: Literal{Text: "3"}},
+				}},
+			}},
+		},
+		{
+			"(a eq 1 or b eq 2) and not (c eq 3)",
+			Group{Nodes: []Node{
+				Group{Or: true, Nodes: []Node{
+					Condition{Column: "a", Op: OpEq, Value: Literal{Text: "1"}},
+					Condition{Column: "b", Op: OpEq, Value: Literal{Text: "2"}},
+				}},
+				Not{Node: Condition{Column: "c", Op: OpEq, Value: Literal{Text: "3"}}},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := Parse(tt.filter)
+
+		if err != nil {
+			t.Errorf("%q: %v", tt.filter, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %#v, want %#v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		filter string
+		pos    int
+	}{
+		{"", 0},
+		{"price", 5},
+		{"price like 1", 6},
+		{"price eq", 8},
+		{"price eq 'open", 9},
+		{"(a eq 1", 7},
+		{"a eq 1 b eq 2", 7},
+		{"a in 1", 5},
+		{"a in (1 2)", 8},
+		{"a eq 1 and", 10},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse(tt.filter)
+
+		var parseErr *Error
+
+		if !errors.As(err, &parseErr) {
+			t.Errorf("%q: got %v, want a parse error", tt.filter, err)
+			continue
+		}
+
+		if parseErr.Pos != tt.pos {
+			t.Errorf("%q: got error at %d, want %d: %v", tt.filter, parseErr.Pos, tt.pos, err)
+		}
+	}
+}
+
+func TestParseMaxConditions(t *testing.T) {
+	conditions := make([]string, MaxConditions+1)
+
+	for i := range conditions {
+		conditions[i] = "a eq 1"
+	}
+
+	_, err := Parse(strings.Join(conditions[:MaxConditions], " or "))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Parse(strings.Join(conditions, " or "))
+
+	if err == nil || !strings.Contains(err.Error(), "conditions") {
+		t.Errorf("got %v, want too many conditions", err)
+	}
+}
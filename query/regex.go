@@ -0,0 +1,272 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Most repetitions a Postgres regex bound may give
+const maxRegexRepeat = 255
+
+// Embedded options a Postgres regex may start with
+var regexOptions = regexp.MustCompile(`^\(\?[bceimnpqstwx]+\)`)
+
+// Checks that a pattern is a valid Postgres advanced regular expression, the
+// flavor the ~ operator runs. The pattern is translated to Go syntax for
+// checking its structure: lookarounds become plain groups, back references
+// and character escapes become literals, and syntax Postgres lacks, such as
+// named groups, \z or \p{...}, is rejected.
+func validateRegex(pattern string) error {
+	if strings.HasPrefix(pattern, "***=") {
+		return nil
+	}
+
+	pattern = strings.TrimPrefix(pattern, "***:")
+	pattern = strings.TrimPrefix(pattern, regexOptions.FindString(pattern))
+
+	var b strings.Builder
+	backref := 0
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+
+		switch c {
+		case '\\':
+			n, ref, err := translateEscape(&b, pattern[i:], false)
+
+			if err != nil {
+				return err
+			}
+
+			if ref > backref {
+				backref = ref
+			}
+
+			i += n - 1
+		case '[':
+			n, err := translateBracket(&b, pattern[i:])
+
+			if err != nil {
+				return err
+			}
+
+			i += n - 1
+		case '(':
+			n, err := translateGroup(&b, pattern[i:])
+
+			if err != nil {
+				return err
+			}
+
+			i += n - 1
+		case '{':
+			n, err := checkBound(pattern[i:])
+
+			if err != nil {
+				return err
+			}
+
+			b.WriteString(pattern[i : i+n])
+			i += n - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	re, err := regexp.Compile(b.String())
+
+	if err != nil {
+		return err
+	}
+
+	if backref > re.NumSubexp() {
+		return fmt.Errorf("back reference \\%d has no group", backref)
+	}
+
+	return nil
+}
+
+// Translates the escape at the start of s, returning its length and the
+// group number of a back reference
+func translateEscape(b *strings.Builder, s string, inBracket bool) (int, int, error) {
+	if len(s) < 2 {
+		return 0, 0, errors.New("trailing backslash")
+	}
+
+	e := s[1]
+
+	switch {
+	case e >= '1' && e <= '9' && !inBracket:
+		ref, _ := strconv.Atoi(string(e))
+		b.WriteString("x")
+
+		return 2, ref, nil
+	case strings.IndexByte("dsw", e) >= 0:
+		b.WriteString(s[:2])
+	case strings.IndexByte("DSW", e) >= 0:
+		if inBracket {
+			return 0, 0, fmt.Errorf(`\%c cannot be used in a bracket expression`, e)
+		}
+
+		b.WriteString(s[:2])
+	case strings.IndexByte("AZmMyY", e) >= 0 && inBracket:
+		return 0, 0, fmt.Errorf(`\%c cannot be used in a bracket expression`, e)
+	case e == 'A':
+		b.WriteString(`\A`)
+	case e == 'Z':
+		b.WriteString(`\z`)
+	case strings.IndexByte("mMyY", e) >= 0:
+		b.WriteString(`\b`)
+	case strings.IndexByte("abBefnrtv", e) >= 0:
+		b.WriteString("x")
+	case e == 'c':
+		if len(s) < 3 {
+			return 0, 0, errors.New(`\c needs a character`)
+		}
+
+		b.WriteString("x")
+
+		return 3, 0, nil
+	case e == 'u', e == 'U':
+		n := 4
+
+		if e == 'U' {
+			n = 8
+		}
+
+		if len(s) < 2+n || strings.Trim(s[2:2+n], "0123456789abcdefABCDEF") != "" {
+			return 0, 0, fmt.Errorf(`\%c needs %d hexadecimal digits`, e, n)
+		}
+
+		b.WriteString("x")
+
+		return 2 + n, 0, nil
+	case e == 'x':
+		n := len(s[2:]) - len(strings.TrimLeft(s[2:], "0123456789abcdefABCDEF"))
+
+		if n == 0 {
+			return 0, 0, errors.New(`\x needs hexadecimal digits`)
+		}
+
+		b.WriteString("x")
+
+		return 2 + n, 0, nil
+	case e == '0':
+		n := len(s[2:]) - len(strings.TrimLeft(s[2:], "01234567"))
+		b.WriteString("x")
+
+		return 2 + n, 0, nil
+	case e >= 'a' && e <= 'z', e >= 'A' && e <= 'Z', e >= '0' && e <= '9':
+		return 0, 0, fmt.Errorf(`invalid escape \%c`, e)
+	case e >= utf8.RuneSelf:
+		_, size := utf8.DecodeRuneInString(s[1:])
+		b.WriteString("x")
+
+		return 1 + size, 0, nil
+	default:
+		b.WriteString(s[:2])
+	}
+
+	return 2, 0, nil
+}
+
+// Translates the bracket expression at the start of s, returning its length
+func translateBracket(b *strings.Builder, s string) (int, error) {
+	i := 1
+	b.WriteByte('[')
+
+	if i < len(s) && s[i] == '^' {
+		b.WriteByte('^')
+		i++
+	}
+
+	if i < len(s) && s[i] == ']' {
+		b.WriteString(`\]`)
+		i++
+	}
+
+	for i < len(s) {
+		switch {
+		case s[i] == ']':
+			b.WriteByte(']')
+			return i + 1, nil
+		case strings.HasPrefix(s[i:], "[:"):
+			end := strings.Index(s[i+2:], ":]")
+
+			if end < 0 {
+				return 0, errors.New("unterminated character class")
+			}
+
+			b.WriteString(s[i : i+2+end+2])
+			i += 2 + end + 2
+		case strings.HasPrefix(s[i:], "[.") || strings.HasPrefix(s[i:], "[="):
+			return 0, errors.New("collating elements are not supported")
+		case s[i] == '\\':
+			n, _, err := translateEscape(b, s[i:], true)
+
+			if err != nil {
+				return 0, err
+			}
+
+			i += n
+		case s[i] == '[':
+			b.WriteString(`\[`)
+			i++
+		default:
+			b.WriteByte(s[i])
+			i++
+		}
+	}
+
+	return 0, errors.New("missing closing ]")
+}
+
+// Translates the opening of the group at the start of s, returning the
+// length of its opening
+func translateGroup(b *strings.Builder, s string) (int, error) {
+	if !strings.HasPrefix(s, "(?") {
+		b.WriteByte('(')
+		return 1, nil
+	}
+
+	for _, prefix := range []string{"(?:", "(?=", "(?!", "(?<=", "(?<!"} {
+		if strings.HasPrefix(s, prefix) {
+			b.WriteString("(?:")
+			return len(prefix), nil
+		}
+	}
+
+	return 0, errors.New("named groups and options after the start are not supported")
+}
+
+// Checks the bound at the start of s, returning its length. Braces not
+// followed by a digit are literal.
+func checkBound(s string) (int, error) {
+	if len(s) < 2 || s[1] < '0' || s[1] > '9' {
+		return 1, nil
+	}
+
+	end := strings.IndexByte(s, '}')
+
+	if end < 0 {
+		return 0, errors.New("unterminated repetition bound")
+	}
+
+	for _, count := range strings.Split(s[1:end], ",") {
+		if count == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(count)
+
+		if err != nil || n > maxRegexRepeat {
+			return 0, fmt.Errorf("invalid repetition bound {%s}, at most %d repetitions", s[1:end], maxRegexRepeat)
+		}
+	}
+
+	return end + 1, nil
+}
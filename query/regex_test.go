@@ -0,0 +1,69 @@
+package query
+
+import "testing"
+
+func TestValidateRegex(t *testing.T) {
+	tests := []struct {
+		pattern string
+		valid   bool
+	}{
+		{"^w", true},
+		{`^[A-Z][a-z]+\d{2,3}$`, true},
+		{`(?i)^widget`, true},
+		{`***:(?i)^widget`, true},
+		{`***=(?P<literal`, true},
+		{`(\w+) \1`, true},
+		{`foo(?=bar)`, true},
+		{`foo(?!bar)`, true},
+		{`(?<=\$)\d+`, true},
+		{`(?<!-)\d+`, true},
+		{`\mword\M`, true},
+		{`\yword\y`, true},
+		{`\Astart`, true},
+		{`end\Z`, true},
+		{`[[:alpha:]_]+`, true},
+		{`[^]a]`, true},
+		{`[\d\s,]`, true},
+		{`é\x41\e\t`, true},
+		{`café\é`, true},
+		{`a{,2}`, true},
+		{`a{255}`, true},
+		{`a+?b*?`, true},
+		{`a\.b\(c\)`, true},
+
+		{`(`, false},
+		{`[a-`, false},
+		{`a{256}`, false},
+		{`a{2`, false},
+		{`a{3,1}`, false},
+		{`(?P<name>a)`, false},
+		{`(?<name>a)`, false},
+		{`a(?i)b`, false},
+		{`(?i:a)`, false},
+		{`(?U)a*`, false},
+		{`end\z`, false},
+		{`\p{Greek}`, false},
+		{`\Qa.b\E`, false},
+		{`\h`, false},
+		{`\k<name>`, false},
+		{`(a)\2`, false},
+		{`[\D]`, false},
+		{`[\m]`, false},
+		{`[[.space.]]`, false},
+		{`\u12`, false},
+		{`abc\`, false},
+		{`*a`, false},
+	}
+
+	for _, tt := range tests {
+		err := validateRegex(tt.pattern)
+
+		if tt.valid && err != nil {
+			t.Errorf("%q: %v", tt.pattern, err)
+		}
+
+		if !tt.valid && err == nil {
+			t.Errorf("%q: got valid, want an error", tt.pattern)
+		}
+	}
+}
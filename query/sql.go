@@ -0,0 +1,245 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Column types, matching the types inferred for document headers
+const (
+	TypeString   = "string"
+	TypeInteger  = "integer"
+	TypeFloat    = "float"
+	TypeBoolean  = "boolean"
+	TypeDateTime = "datetime"
+)
+
+// Converts a filter value to the value compared with a column of type t
+type Converter func(t string, v interface{}) (interface{}, error)
+
+// Compiled Postgres condition with its parameters
+type SQL struct {
+	Text string
+	Args []interface{}
+}
+
+// Text of numbers Postgres casts to numeric
+const numberPattern = `^\s*[-+]{0,1}([0-9]+(\.[0-9]*){0,1}|\.[0-9]+)([eE][-+]{0,1}[0-9]+){0,1}\s*$`
+
+// Text of dates and times Postgres casts to timestamptz: a calendar date,
+// February 29 only in leap years, then an optional time and offset
+const dateTimePattern = `^\s*(` +
+	`(000[1-9]|00[1-9][0-9]|0[1-9][0-9]{2}|[1-9][0-9]{3})-` +
+	`((0[13578]|1[02])-(0[1-9]|[12][0-9]|3[01])|(0[469]|11)-(0[1-9]|[12][0-9]|30)|02-(0[1-9]|1[0-9]|2[0-8]))` +
+	`|([0-9]{2}(0[48]|[2468][048]|[13579][26])|([2468][048]|[13579][26]|0[48])00)-02-29` +
+	`)([T ]([01][0-9]|2[0-3]):[0-5][0-9](:[0-5][0-9](\.[0-9]+){0,1}){0,1}){0,1}` +
+	`\s*([zZ]|[-+]([01][0-9]|2[0-3])(:{0,1}[0-5][0-9]){0,1}){0,1}\s*$`
+
+// Text patterns of values that cast to each column type. Values stored
+// before a column was typed may hold anything, so casts are only made on
+// values matching these and others are treated as null rather than failing
+// the query. Repetition is written with braces since ? marks parameters.
+var castPatterns = map[string]string{
+	TypeInteger:  numberPattern,
+	TypeFloat:    numberPattern,
+	TypeBoolean:  `^\s*([tT]([rR][uU][eE]){0,1}|[fF]([aA][lL][sS][eE]){0,1}|[yY]([eE][sS]){0,1}|[nN][oO]{0,1}|[oO][nN]|[oO][fF][fF]|0|1)\s*$`,
+	TypeDateTime: dateTimePattern,
+}
+
+// Postgres types fields are cast to for each column type
+var castTypes = map[string]string{
+	TypeInteger:  "numeric",
+	TypeFloat:    "numeric",
+	TypeBoolean:  "boolean",
+	TypeDateTime: "timestamptz",
+}
+
+// Builds the Postgres expression selecting a field of a JSONB column as the
+// given column type, with the field name as a parameter for every use of it.
+// Values that do not cast to the type are null.
+func Field(column string, field string, t string) SQL {
+	text := column + "->>?::text"
+	cast, ok := castTypes[t]
+
+	if !ok {
+		return SQL{Text: text, Args: []interface{}{field}}
+	}
+
+	return SQL{
+		Text: "(CASE WHEN " + text + " ~ '" + castPatterns[t] + "' THEN (" + text + ")::" + cast + " END)",
+		Args: []interface{}{field, field},
+	}
+}
+
+// Compiles a filter to a condition on the JSONB column, comparing fields
+// using their column types. Fields not in types are rejected.
+func Compile(node Node, column string, types map[string]string, convert Converter) (SQL, error) {
+	switch n := node.(type) {
+	case Group:
+		parts := make([]string, len(n.Nodes))
+		args := make([]interface{}, 0)
+		join := " AND "
+
+		if n.Or {
+			join = " OR "
+		}
+
+		for i, child := range n.Nodes {
+			compiled, err := Compile(child, column, types, convert)
+
+			if err != nil {
+				return SQL{}, err
+			}
+
+			parts[i] = compiled.Text
+			args = append(args, compiled.Args...)
+		}
+
+		return SQL{Text: "(" + strings.Join(parts, join) + ")", Args: args}, nil
+	case Not:
+		compiled, err := Compile(n.Node, column, types, convert)
+
+		if err != nil {
+			return SQL{}, err
+		}
+
+		return SQL{Text: "NOT " + compiled.Text, Args: compiled.Args}, nil
+	case Condition:
+		return compileCondition(n, column, types, convert)
+	}
+
+	return SQL{}, fmt.Errorf("unsupported filter node %T", node)
+}
+
+// Postgres operators for comparisons
+var comparisons = map[string]string{
+	OpEq:  "=",
+	OpNe:  "IS DISTINCT FROM",
+	OpGt:  ">",
+	OpGte: ">=",
+	OpLt:  "<",
+	OpLte: "<=",
+}
+
+func compileCondition(c Condition, column string, types map[string]string, convert Converter) (SQL, error) {
+	t, ok := types[c.Column]
+
+	if !ok {
+		return SQL{}, fmt.Errorf("unknown column %q", c.Column)
+	}
+
+	typed := Field(column, c.Column, t)
+	text := Field(column, c.Column, TypeString)
+
+	switch c.Op {
+	case OpIsNull:
+		if c.Value.Text == "false" {
+			return SQL{Text: "(" + text.Text + " IS NOT NULL)", Args: text.Args}, nil
+		}
+
+		return SQL{Text: "(" + text.Text + " IS NULL)", Args: text.Args}, nil
+	case OpIn:
+		values := make([]interface{}, 0, len(c.List))
+		null := false
+
+		for _, l := range c.List {
+			if l.Null {
+				null = true
+				continue
+			}
+
+			v, err := convertLiteral(c, t, l, convert)
+
+			if err != nil {
+				return SQL{}, err
+			}
+
+			values = append(values, v)
+		}
+
+		parts := make([]string, 0, 2)
+		args := make([]interface{}, 0, 3)
+
+		if len(values) > 0 {
+			parts = append(parts, typed.Text+" IN ?")
+			args = append(append(args, typed.Args...), values)
+		}
+
+		if null {
+			parts = append(parts, text.Text+" IS NULL")
+			args = append(args, text.Args...)
+		}
+
+		if len(parts) == 0 {
+			return SQL{Text: "FALSE"}, nil
+		}
+
+		return SQL{Text: "(" + strings.Join(parts, " OR ") + ")", Args: args}, nil
+	case OpContains, OpStartsWith:
+		if c.Value.Null {
+			return SQL{}, fmt.Errorf("%s needs a value for column %q", c.Op, c.Column)
+		}
+
+		pattern := escapeLike(c.Value.Text) + "%"
+
+		if c.Op == OpContains {
+			pattern = "%" + pattern
+		}
+
+		return SQL{Text: "(" + text.Text + ` LIKE ? ESCAPE '\')`, Args: append(text.Args, pattern)}, nil
+	case OpRegex:
+		if c.Value.Null {
+			return SQL{}, fmt.Errorf("regex needs a pattern for column %q", c.Column)
+		}
+
+		if err := validateRegex(c.Value.Text); err != nil {
+			return SQL{}, fmt.Errorf("invalid regex for column %q: %s", c.Column, err)
+		}
+
+		return SQL{Text: "(" + text.Text + " ~ ?)", Args: append(text.Args, c.Value.Text)}, nil
+	}
+
+	op, ok := comparisons[c.Op]
+
+	if !ok {
+		return SQL{}, fmt.Errorf("unknown operator %q", c.Op)
+	}
+
+	if c.Value.Null {
+		switch c.Op {
+		case OpEq:
+			return SQL{Text: "(" + text.Text + " IS NULL)", Args: text.Args}, nil
+		case OpNe:
+			return SQL{Text: "(" + text.Text + " IS NOT NULL)", Args: text.Args}, nil
+		}
+
+		return SQL{}, fmt.Errorf("%s cannot compare column %q with null", c.Op, c.Column)
+	}
+
+	v, err := convertLiteral(c, t, c.Value, convert)
+
+	if err != nil {
+		return SQL{}, err
+	}
+
+	return SQL{Text: "(" + typed.Text + " " + op + " ?)", Args: append(typed.Args, v)}, nil
+}
+
+func convertLiteral(c Condition, t string, l Literal, convert Converter) (interface{}, error) {
+	v, err := convert(t, l.Text)
+
+	if err == nil && v == nil {
+		err = fmt.Errorf("expected %s", t)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q for column %q: %s", l.Text, c.Column, err)
+	}
+
+	return v, nil
+}
+
+// Escapes LIKE wildcards so text matches literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
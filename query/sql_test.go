@@ -0,0 +1,132 @@
+package query
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var testTypes = map[string]string{
+	"name":  TypeString,
+	"qty":   TypeInteger,
+	"price": TypeFloat,
+	"paid":  TypeBoolean,
+	"when":  TypeDateTime,
+}
+
+func testConvert(t string, v interface{}) (interface{}, error) {
+	switch t {
+	case TypeInteger, TypeFloat:
+		return strconv.ParseFloat(v.(string), 64)
+	case TypeBoolean:
+		return strconv.ParseBool(v.(string))
+	}
+
+	return v, nil
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		filter string
+		text   string
+		args   int
+	}{
+		{"name eq a", "(data->>?::text = ?)", 2},
+		{"qty gt 1", "::numeric END) > ?)", 3},
+		{"paid eq true", "::boolean END) = ?)", 3},
+		{"when lt '2020-01-01'", "::timestamptz END) < ?)", 3},
+		{"name eq null", "(data->>?::text IS NULL)", 1},
+		{"price in (1, 2, null)", "END) IN ? OR data->>?::text IS NULL)", 4},
+		{"name contains 'a_b'", `(data->>?::text LIKE ? ESCAPE '\')`, 2},
+		{"name ~ '^a(?=b)'", "(data->>?::text ~ ?)", 2},
+		{"qty gte 1 and not (price lt 2 or name is-null)", "AND NOT (", 7},
+	}
+
+	for _, tt := range tests {
+		node, err := Parse(tt.filter)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		compiled, err := Compile(node, "data", testTypes, testConvert)
+
+		if err != nil {
+			t.Errorf("%q: %v", tt.filter, err)
+			continue
+		}
+
+		if !strings.Contains(compiled.Text, tt.text) {
+			t.Errorf("%q: got %s, want it to contain %s", tt.filter, compiled.Text, tt.text)
+		}
+
+		if len(compiled.Args) != tt.args || strings.Count(compiled.Text, "?") != tt.args {
+			t.Errorf("%q: got %d parameters and %d args, want %d", tt.filter, strings.Count(compiled.Text, "?"), len(compiled.Args), tt.args)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		filter string
+		err    string
+	}{
+		{"other eq 1", "unknown column"},
+		{"qty gt abc", "invalid value"},
+		{"qty gt null", "cannot compare"},
+		{"name ~ '(?P<n>a)'", "invalid regex"},
+		{"name ~ 'a\\\\z'", "invalid regex"},
+		{"name ~ null", "needs a pattern"},
+	}
+
+	for _, tt := range tests {
+		node, err := Parse(tt.filter)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = Compile(node, "data", testTypes, testConvert)
+
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: got %v, want %s", tt.filter, err, tt.err)
+		}
+	}
+}
+
+// The patterns guarding casts must match every value Postgres would cast, or
+// the values would be treated as null, and nothing it would fail to cast
+func TestCastPatterns(t *testing.T) {
+	tests := []struct {
+		t       string
+		matches []string
+		others  []string
+	}{
+		{TypeInteger, []string{"1", "-20", " +3 ", "1.5", ".5", "5.", "1e10", "-2.5E-3"}, []string{"", "abc", "1,5", "1.2.3", "e5", "0x10", "NaN", "--1"}},
+		{TypeBoolean, []string{"true", "FALSE", "t", "f", "yes", "No", "y", "n", "on", "off", "1", "0", " true "}, []string{"", "maybe", "tr", "2", "o"}},
+		{TypeDateTime, []string{"2020-01-02", "2020-01-02T03:04:05Z", "2020-01-02 03:04", "2020-01-02T03:04:05.123+05:30", "2020-12-31T23:59:59-0800", "2020-02-29", "2000-02-29", "0001-01-01"}, []string{"", "2020-13-01", "2020-01-32", "2020-04-31", "2021-02-29", "1900-02-29", "0000-01-01", "2020-01-02T25:00", "01/02/2020", "yesterday", "2020-01-02T03:04:05+24"}},
+	}
+
+	for _, tt := range tests {
+		re := regexp.MustCompile(castPatterns[tt.t])
+
+		for _, v := range tt.matches {
+			if !re.MatchString(v) {
+				t.Errorf("%s: %q does not match", tt.t, v)
+			}
+		}
+
+		for _, v := range tt.others {
+			if re.MatchString(v) {
+				t.Errorf("%s: %q matches", tt.t, v)
+			}
+		}
+	}
+
+	for _, pattern := range castPatterns {
+		if strings.ContainsAny(pattern, "?'") {
+			t.Errorf("pattern %s holds a parameter marker or quote", pattern)
+		}
+	}
+}
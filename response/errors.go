@@ -7,16 +7,23 @@ import (
 )
 
 type HTTPError struct {
-	Error   string `json:"error"`
-	Message string `json:"message"`
-	Code    int    `json:"code"`
+	Error   string      `json:"error"`
+	Message string      `json:"message"`
+	Code    int         `json:"code"`
+	Details interface{} `json:"details,omitempty"`
 }
 
 func ErrorResponse(w http.ResponseWriter, err error, message string, code int) {
+	ErrorDetailsResponse(w, err, message, code, nil)
+}
+
+// Writes an error response carrying structured details about the failure
+func ErrorDetailsResponse(w http.ResponseWriter, err error, message string, code int, details interface{}) {
 	errObj := HTTPError{
 		Error:   err.Error(),
 		Message: message,
 		Code:    code,
+		Details: details,
 	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(code)
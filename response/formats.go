@@ -0,0 +1,342 @@
+package response
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phankanp/csv-to-json/model"
+	"github.com/phankanp/csv-to-json/xlsx"
+)
+
+// Writes records in an output format one at a time, so a response can be
+// streamed without holding every record
+type Encoder interface {
+	// Writes a record, given as the value sent by formats of JSON objects and
+	// as its values in column order for tabular formats
+	Encode(item interface{}, values []interface{}) error
+	// Ends the output once every record is written
+	Close() error
+}
+
+// Output format a response can be negotiated to
+type Format struct {
+	// Name chosen with the format query parameter, also used as the file
+	// extension of exports
+	Name        string
+	ContentType string
+	// Starts the output of records with the columns
+	NewEncoder func(w io.Writer, columns []string, opts EncoderOptions) (Encoder, error)
+}
+
+// Settings of the output of a document's records
+type EncoderOptions struct {
+	// Title of the document, naming the sheet of workbooks
+	Title string
+	// Dialect of csv output, standard csv when zero
+	Dialect model.Dialect
+}
+
+// JSON, the format used when the client asks for none
+var JSON = Format{Name: "json", ContentType: "application/json", NewEncoder: newJSONEncoder}
+
+var formats = []Format{
+	JSON,
+	{Name: "ndjson", ContentType: "application/x-ndjson", NewEncoder: newNDJSONEncoder},
+	{Name: "csv", ContentType: "text/csv", NewEncoder: newCSVEncoder},
+	{Name: "xlsx", ContentType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", NewEncoder: newXLSXEncoder},
+}
+
+// Adds an output format, replacing any registered format of the same name
+func RegisterFormat(f Format) {
+	for i := range formats {
+		if formats[i].Name == f.Name {
+			formats[i] = f
+			return
+		}
+	}
+
+	formats = append(formats, f)
+}
+
+// Lists the registered formats
+func Formats() []Format {
+	return append([]Format(nil), formats...)
+}
+
+// Gets a registered format by name
+func FormatByName(name string) (Format, bool) {
+	for _, f := range formats {
+		if strings.EqualFold(f.Name, name) {
+			return f, true
+		}
+	}
+
+	return Format{}, false
+}
+
+// Picks the output format of a request from the format query parameter, or
+// else the registered format the Accept header prefers by quality, earlier
+// media types winning ties, defaulting to JSON
+func NegotiateFormat(r *http.Request) (Format, error) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		f, ok := FormatByName(name)
+
+		if !ok {
+			return Format{}, fmt.Errorf("unknown format %q", name)
+		}
+
+		return f, nil
+	}
+
+	best := JSON
+	bestQ := 0.0
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+
+		if v, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(v, 64)
+
+			if err != nil {
+				continue
+			}
+		}
+
+		if q <= bestQ {
+			continue
+		}
+
+		if f, ok := matchFormat(mediaType); ok {
+			best = f
+			bestQ = q
+		}
+	}
+
+	return best, nil
+}
+
+// Finds the registered format of a media type, which may be a */* or type/*
+// range matching JSON or the first format of the type
+func matchFormat(mediaType string) (Format, bool) {
+	if mediaType == "*/*" {
+		return JSON, true
+	}
+
+	for _, f := range formats {
+		if f.ContentType == mediaType {
+			return f, true
+		}
+	}
+
+	if strings.HasSuffix(mediaType, "/*") {
+		for _, f := range formats {
+			if strings.HasPrefix(f.ContentType, strings.TrimSuffix(mediaType, "*")) {
+				return f, true
+			}
+		}
+	}
+
+	return Format{}, false
+}
+
+// Writes the response headers of a format, offering the body as a file named
+// after title when attach is set
+func FormatHeaders(w http.ResponseWriter, f Format, title string, attach bool) {
+	contentType := f.ContentType
+
+	if strings.HasPrefix(contentType, "text/") || strings.HasSuffix(contentType, "json") {
+		contentType += "; charset=utf-8"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+
+	if attach {
+		name := strings.NewReplacer("/", "_", `\`, "_").Replace(title)
+
+		if name == "" {
+			name = "document"
+		}
+
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + "." + f.Name}))
+	}
+}
+
+// Writes items as a JSON array
+type jsonEncoder struct {
+	w     io.Writer
+	count int
+}
+
+func newJSONEncoder(w io.Writer, columns []string, opts EncoderOptions) (Encoder, error) {
+	_, err := io.WriteString(w, "[")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &jsonEncoder{w: w}, nil
+}
+
+func (e *jsonEncoder) Encode(item interface{}, values []interface{}) error {
+	b, err := json.Marshal(item)
+
+	if err != nil {
+		return err
+	}
+
+	if e.count > 0 {
+		b = append([]byte(","), b...)
+	}
+
+	e.count++
+	_, err = e.w.Write(b)
+
+	return err
+}
+
+func (e *jsonEncoder) Close() error {
+	_, err := io.WriteString(e.w, "]\n")
+
+	return err
+}
+
+// Writes items as newline delimited JSON, an object per line
+type ndjsonEncoder struct {
+	json *json.Encoder
+}
+
+func newNDJSONEncoder(w io.Writer, columns []string, opts EncoderOptions) (Encoder, error) {
+	return &ndjsonEncoder{json: json.NewEncoder(w)}, nil
+}
+
+func (e *ndjsonEncoder) Encode(item interface{}, values []interface{}) error {
+	return e.json.Encode(item)
+}
+
+func (e *ndjsonEncoder) Close() error {
+	return nil
+}
+
+// Writes values as CSV records in the document's dialect, after a record of
+// the columns unless the dialect has no header. Missing and null values are
+// left empty.
+type csvEncoder struct {
+	csv *model.CSVWriter
+}
+
+func newCSVEncoder(w io.Writer, columns []string, opts EncoderOptions) (Encoder, error) {
+	writer, err := model.NewCSVWriter(w, opts.Dialect)
+
+	if err != nil {
+		return nil, err
+	}
+
+	e := &csvEncoder{csv: writer}
+
+	if writer.HasHeader() {
+		err = writer.Write(columns)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return e, nil
+}
+
+func (e *csvEncoder) Encode(item interface{}, values []interface{}) error {
+	record := make([]string, len(values))
+
+	for i, v := range values {
+		switch v := v.(type) {
+		case nil:
+		case string:
+			record[i] = v
+		case json.Number:
+			record[i] = v.String()
+		case time.Time:
+			record[i] = v.Format(time.RFC3339Nano)
+		case bool, int, int64, float64:
+			record[i] = fmt.Sprint(v)
+		default:
+			b, err := json.Marshal(v)
+
+			if err != nil {
+				return err
+			}
+
+			record[i] = string(b)
+		}
+	}
+
+	return e.csv.Write(record)
+}
+
+func (e *csvEncoder) Close() error {
+	return e.csv.Flush()
+}
+
+// Writes values as rows of a workbook sheet named after the title, after a
+// row of the columns
+type xlsxEncoder struct {
+	xlsx *xlsx.Writer
+}
+
+func newXLSXEncoder(w io.Writer, columns []string, opts EncoderOptions) (Encoder, error) {
+	writer, err := xlsx.NewWriter(w, opts.Title)
+
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]interface{}, len(columns))
+
+	for i, column := range columns {
+		header[i] = column
+	}
+
+	err = writer.WriteRow(header)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &xlsxEncoder{xlsx: writer}, nil
+}
+
+func (e *xlsxEncoder) Encode(item interface{}, values []interface{}) error {
+	cells := make([]interface{}, len(values))
+
+	for i, v := range values {
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			b, err := json.Marshal(v)
+
+			if err != nil {
+				return err
+			}
+
+			cells[i] = string(b)
+		default:
+			cells[i] = v
+		}
+	}
+
+	return e.xlsx.WriteRow(cells)
+}
+
+func (e *xlsxEncoder) Close() error {
+	return e.xlsx.Close()
+}
@@ -0,0 +1,55 @@
+package response
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		url    string
+		accept string
+		want   string
+	}{
+		{"/", "", "json"},
+		{"/", "text/csv", "csv"},
+		{"/", "application/x-ndjson, text/csv", "ndjson"},
+		{"/", "text/csv;q=0.1, application/json", "json"},
+		{"/", "text/csv;q=0.5, application/x-ndjson;q=0.8", "ndjson"},
+		{"/", "text/csv;q=0, application/xml", "json"},
+		{"/", "application/xml, text/csv;q=0.2", "csv"},
+		{"/", "text/csv;q=0.5, */*", "json"},
+		{"/", "text/*", "csv"},
+		{"/", "text/csv;q=abc", "json"},
+		{"/?format=xlsx", "text/csv", "xlsx"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.url, nil)
+
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+
+		f, err := NegotiateFormat(r)
+
+		if err != nil {
+			t.Errorf("%s %q: %v", tt.url, tt.accept, err)
+			continue
+		}
+
+		if f.Name != tt.want {
+			t.Errorf("%s %q: got %s, want %s", tt.url, tt.accept, f.Name, tt.want)
+		}
+	}
+}
+
+func TestNegotiateFormatUnknown(t *testing.T) {
+	r := httptest.NewRequest("GET", "/?format=yaml", nil)
+
+	_, err := NegotiateFormat(r)
+
+	if err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,473 @@
+package xlsx
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const relationshipsNS = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+
+// Spreadsheet opened for reading
+type Workbook struct {
+	files         map[string]*zip.File
+	sheets        []sheetRef
+	sharedStrings []string
+	dateStyles    map[int]bool
+	date1904      bool
+}
+
+type sheetRef struct {
+	name string
+	path string
+}
+
+// Checks if the zip archive read from r looks like an xlsx workbook
+func IsWorkbook(r io.ReaderAt, size int64) bool {
+	z, err := zip.NewReader(r, size)
+
+	if err != nil {
+		return false
+	}
+
+	for _, f := range z.File {
+		if f.Name == "xl/workbook.xml" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Opens a workbook, loading its sheet list, shared strings and styles
+func Open(r io.ReaderAt, size int64) (*Workbook, error) {
+	z, err := zip.NewReader(r, size)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid xlsx file: %s", err)
+	}
+
+	wb := &Workbook{files: make(map[string]*zip.File), dateStyles: make(map[int]bool)}
+
+	for _, f := range z.File {
+		wb.files[f.Name] = f
+	}
+
+	if _, ok := wb.files["xl/workbook.xml"]; !ok {
+		return nil, errors.New("invalid xlsx file: missing workbook")
+	}
+
+	err = wb.readWorkbook()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = wb.readSharedStrings()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = wb.readStyles()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return wb, nil
+}
+
+// Names of the sheets in workbook order
+func (wb *Workbook) SheetNames() []string {
+	names := make([]string, len(wb.sheets))
+
+	for i, s := range wb.sheets {
+		names[i] = s.name
+	}
+
+	return names
+}
+
+func (wb *Workbook) decode(name string, v interface{}) error {
+	f, ok := wb.files[name]
+
+	if !ok {
+		return nil
+	}
+
+	rc, err := f.Open()
+
+	if err != nil {
+		return err
+	}
+
+	defer rc.Close()
+
+	return xml.NewDecoder(rc).Decode(v)
+}
+
+func (wb *Workbook) readWorkbook() error {
+	var workbook struct {
+		Pr struct {
+			Date1904 string `xml:"date1904,attr"`
+		} `xml:"workbookPr"`
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+			RID  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+
+	var rels struct {
+		Relationships []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+
+	err := wb.decode("xl/workbook.xml", &workbook)
+
+	if err != nil {
+		return fmt.Errorf("invalid xlsx workbook: %s", err)
+	}
+
+	err = wb.decode("xl/_rels/workbook.xml.rels", &rels)
+
+	if err != nil {
+		return fmt.Errorf("invalid xlsx workbook relationships: %s", err)
+	}
+
+	targets := make(map[string]string)
+
+	for _, rel := range rels.Relationships {
+		target := rel.Target
+
+		if strings.HasPrefix(target, "/") {
+			target = strings.TrimPrefix(target, "/")
+		} else {
+			target = path.Join("xl", target)
+		}
+
+		targets[rel.ID] = target
+	}
+
+	wb.date1904 = workbook.Pr.Date1904 == "1" || workbook.Pr.Date1904 == "true"
+
+	for _, s := range workbook.Sheets {
+		if target, ok := targets[s.RID]; ok {
+			wb.sheets = append(wb.sheets, sheetRef{name: s.Name, path: target})
+		}
+	}
+
+	return nil
+}
+
+func (wb *Workbook) readSharedStrings() error {
+	var sst struct {
+		Items []richText `xml:"si"`
+	}
+
+	err := wb.decode("xl/sharedStrings.xml", &sst)
+
+	if err != nil {
+		return fmt.Errorf("invalid xlsx shared strings: %s", err)
+	}
+
+	wb.sharedStrings = make([]string, len(sst.Items))
+
+	for i, item := range sst.Items {
+		wb.sharedStrings[i] = item.String()
+	}
+
+	return nil
+}
+
+// Text that is either plain or split into formatted runs
+type richText struct {
+	T    string `xml:"t"`
+	Runs []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t richText) String() string {
+	if len(t.Runs) == 0 {
+		return t.T
+	}
+
+	var b strings.Builder
+	b.WriteString(t.T)
+
+	for _, r := range t.Runs {
+		b.WriteString(r.T)
+	}
+
+	return b.String()
+}
+
+func (wb *Workbook) readStyles() error {
+	var styles struct {
+		NumFmts []struct {
+			ID   int    `xml:"numFmtId,attr"`
+			Code string `xml:"formatCode,attr"`
+		} `xml:"numFmts>numFmt"`
+		CellXfs []struct {
+			NumFmtID int `xml:"numFmtId,attr"`
+		} `xml:"cellXfs>xf"`
+	}
+
+	err := wb.decode("xl/styles.xml", &styles)
+
+	if err != nil {
+		return fmt.Errorf("invalid xlsx styles: %s", err)
+	}
+
+	customDates := make(map[int]bool)
+
+	for _, f := range styles.NumFmts {
+		customDates[f.ID] = isDateFormat(f.Code)
+	}
+
+	for i, xf := range styles.CellXfs {
+		if isBuiltinDateFormat(xf.NumFmtID) || customDates[xf.NumFmtID] {
+			wb.dateStyles[i] = true
+		}
+	}
+
+	return nil
+}
+
+// Built-in number formats that display dates or times
+func isBuiltinDateFormat(id int) bool {
+	return (id >= 14 && id <= 22) || (id >= 27 && id <= 36) || (id >= 45 && id <= 47) || (id >= 50 && id <= 58)
+}
+
+// Checks if a custom number format displays a date or time, ignoring
+// quoted literals, escaped characters and bracketed sections such as colors
+func isDateFormat(code string) bool {
+	inQuote, inBracket, escaped := false, false, false
+
+	for _, c := range strings.ToLower(code) {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			inQuote = !inQuote
+		case inQuote:
+		case c == '[':
+			inBracket = true
+		case c == ']':
+			inBracket = false
+		case inBracket:
+		case c == 'd' || c == 'm' || c == 'y' || c == 'h' || c == 's':
+			return true
+		}
+	}
+
+	return false
+}
+
+// Converts a serial date number to a time
+func (wb *Workbook) serialToTime(v float64) time.Time {
+	epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+	if wb.date1904 {
+		epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	days := math.Floor(v)
+	nanos := math.Round((v - days) * 86400 * 1e3)
+
+	return epoch.AddDate(0, 0, int(days)).Add(time.Duration(nanos) * time.Millisecond)
+}
+
+// Streams the rows of one sheet
+type Rows struct {
+	wb     *Workbook
+	rc     io.ReadCloser
+	dec    *xml.Decoder
+	number int
+}
+
+// Opens a sheet by name for reading its rows
+func (wb *Workbook) Rows(sheet string) (*Rows, error) {
+	for _, s := range wb.sheets {
+		if s.name != sheet {
+			continue
+		}
+
+		f, ok := wb.files[s.path]
+
+		if !ok {
+			return nil, fmt.Errorf("sheet %q is missing from the workbook", sheet)
+		}
+
+		rc, err := f.Open()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &Rows{wb: wb, rc: rc, dec: xml.NewDecoder(rc)}, nil
+	}
+
+	return nil, fmt.Errorf("sheet %q not found", sheet)
+}
+
+// Row number of the last row read
+func (r *Rows) Number() int {
+	return r.number
+}
+
+func (r *Rows) Close() error {
+	return r.rc.Close()
+}
+
+type cell struct {
+	Ref       string   `xml:"r,attr"`
+	Type      string   `xml:"t,attr"`
+	Style     int      `xml:"s,attr"`
+	Value     string   `xml:"v"`
+	InlineStr richText `xml:"is"`
+}
+
+// Reads the next row of the sheet. Cells are float64 for numbers, time.Time
+// for date formatted numbers, bool, string, or nil when empty. Returns io.EOF
+// after the last row.
+func (r *Rows) Next() ([]interface{}, error) {
+	for {
+		tok, err := r.dec.Token()
+
+		if err != nil {
+			return nil, err
+		}
+
+		start, ok := tok.(xml.StartElement)
+
+		if !ok || start.Name.Local != "row" {
+			continue
+		}
+
+		number := r.number + 1
+
+		for _, attr := range start.Attr {
+			if attr.Name.Local == "r" {
+				if n, err := strconv.Atoi(attr.Value); err == nil {
+					number = n
+				}
+			}
+		}
+
+		var row struct {
+			Cells []cell `xml:"c"`
+		}
+
+		err = r.dec.DecodeElement(&row, &start)
+
+		if err != nil {
+			return nil, err
+		}
+
+		r.number = number
+
+		values := make([]interface{}, 0, len(row.Cells))
+
+		for i, c := range row.Cells {
+			col := i
+
+			if c.Ref != "" {
+				col, err = columnIndex(c.Ref)
+
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			for len(values) <= col {
+				values = append(values, nil)
+			}
+
+			values[col], err = r.wb.cellValue(c)
+
+			if err != nil {
+				return nil, fmt.Errorf("cell %s: %s", c.Ref, err)
+			}
+		}
+
+		return values, nil
+	}
+}
+
+func (wb *Workbook) cellValue(c cell) (interface{}, error) {
+	switch c.Type {
+	case "s":
+		i, err := strconv.Atoi(c.Value)
+
+		if err != nil || i < 0 || i >= len(wb.sharedStrings) {
+			return nil, errors.New("invalid shared string index")
+		}
+
+		return wb.sharedStrings[i], nil
+	case "inlineStr":
+		return c.InlineStr.String(), nil
+	case "str", "e":
+		return c.Value, nil
+	case "b":
+		return c.Value == "1", nil
+	case "d":
+		t, err := time.Parse(time.RFC3339Nano, c.Value)
+
+		if err != nil {
+			return c.Value, nil
+		}
+
+		return t, nil
+	}
+
+	if c.Value == "" {
+		return nil, nil
+	}
+
+	v, err := strconv.ParseFloat(c.Value, 64)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if wb.dateStyles[c.Style] {
+		return wb.serialToTime(v), nil
+	}
+
+	return v, nil
+}
+
+// Converts a cell reference such as "AB12" to a zero based column index
+func columnIndex(ref string) (int, error) {
+	col := 0
+	i := 0
+
+	for ; i < len(ref); i++ {
+		c := ref[i]
+
+		if c < 'A' || c > 'Z' {
+			break
+		}
+
+		col = col*26 + int(c-'A'+1)
+	}
+
+	if i == 0 {
+		return 0, fmt.Errorf("invalid cell reference %q", ref)
+	}
+
+	return col - 1, nil
+}
@@ -0,0 +1,250 @@
+package xlsx
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Opens a workbook zipped from the parts of a fixture in testdata
+func openFixture(t *testing.T, name string) (*Workbook, []byte) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	root := filepath.Join("testdata", name)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+
+		if err != nil {
+			return err
+		}
+
+		content, err := ioutil.ReadFile(path)
+
+		if err != nil {
+			return err
+		}
+
+		f, err := z.Create(filepath.ToSlash(rel))
+
+		if err != nil {
+			return err
+		}
+
+		_, err = f.Write(content)
+
+		return err
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	wb, err := Open(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return wb, buf.Bytes()
+}
+
+type sheetRow struct {
+	number int
+	values []interface{}
+	err    string
+}
+
+// Reads every row of a sheet, checking it against want
+func checkRows(t *testing.T, wb *Workbook, sheet string, want []sheetRow) {
+	t.Helper()
+
+	r, err := wb.Rows(sheet)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	for _, row := range want {
+		values, err := r.Next()
+
+		if row.err != "" {
+			if err == nil || err.Error() != row.err {
+				t.Errorf("%s: got %v, %v, want error %q", sheet, values, err, row.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: %v", sheet, err)
+		}
+
+		if r.Number() != row.number || !reflect.DeepEqual(values, row.values) {
+			t.Errorf("%s: got row %d %#v, want row %d %#v", sheet, r.Number(), values, row.number, row.values)
+		}
+	}
+
+	if values, err := r.Next(); err != io.EOF {
+		t.Errorf("%s: got %v, %v, want EOF", sheet, values, err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	wb, content := openFixture(t, "workbook")
+
+	if !IsWorkbook(bytes.NewReader(content), int64(len(content))) {
+		t.Error("fixture is not detected as a workbook")
+	}
+
+	want := []string{"Orders", "Sparse", "Broken", "Missing"}
+
+	if got := wb.SheetNames(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got sheets %q, want %q", got, want)
+	}
+
+	want = []string{"id", "ordered", "customer", "Acme & Sons", " spaced "}
+
+	if !reflect.DeepEqual(wb.sharedStrings, want) {
+		t.Errorf("got shared strings %q, want %q", wb.sharedStrings, want)
+	}
+
+	_, err := wb.Rows("Missing")
+
+	if err == nil || !strings.Contains(err.Error(), "missing from the workbook") {
+		t.Errorf("got %v, want missing sheet", err)
+	}
+
+	_, err = wb.Rows("Other")
+
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("got %v, want sheet not found", err)
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+		err     string
+	}{
+		{"not a zip", []byte("a,b\n1,2\n"), "invalid xlsx file"},
+		{"zip without a workbook", emptyZip(t), "missing workbook"},
+	}
+
+	for _, tt := range tests {
+		if IsWorkbook(bytes.NewReader(tt.content), int64(len(tt.content))) {
+			t.Errorf("%s: detected as a workbook", tt.name)
+		}
+
+		_, err := Open(bytes.NewReader(tt.content), int64(len(tt.content)))
+
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got %v, want %s", tt.name, err, tt.err)
+		}
+	}
+}
+
+func emptyZip(t *testing.T) []byte {
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+
+	if _, err := z.Create("word/document.xml"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestRowsStrings(t *testing.T) {
+	wb, _ := openFixture(t, "workbook")
+
+	checkRows(t, wb, "Orders", []sheetRow{
+		{number: 1, values: []interface{}{"id", "ordered", "customer", "paid", "total"}},
+		{number: 2, values: []interface{}{1.0, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), "Acme & Sons", true, 1234.5}},
+		{number: 3, values: []interface{}{2.0, time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC), " spaced ", false, 2.5}},
+		{number: 4, values: []interface{}{"3", time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), "#N/A", nil, -0.25}},
+	})
+}
+
+func TestRowsGaps(t *testing.T) {
+	wb, _ := openFixture(t, "workbook")
+
+	wide := make([]interface{}, 27)
+	wide[26] = 27.0
+
+	checkRows(t, wb, "Sparse", []sheetRow{
+		{number: 2, values: []interface{}{nil, "b", nil, 4.0}},
+		{number: 5, values: wide},
+		{number: 6, values: []interface{}{1.0, "x"}},
+		{number: 7, values: []interface{}{}},
+	})
+}
+
+func TestRowsInvalidCells(t *testing.T) {
+	wb, _ := openFixture(t, "workbook")
+
+	checkRows(t, wb, "Broken", []sheetRow{
+		{err: "cell A1: invalid shared string index"},
+		{err: `invalid cell reference "1A"`},
+		{err: `cell A3: strconv.ParseFloat: parsing "abc": invalid syntax`},
+	})
+}
+
+func TestRowsDate1904(t *testing.T) {
+	wb, _ := openFixture(t, "date1904")
+
+	checkRows(t, wb, "Dates", []sheetRow{
+		{number: 1, values: []interface{}{
+			time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2020, 1, 1, 18, 0, 0, 0, time.UTC),
+			42369.75,
+		}},
+	})
+}
+
+func TestIsDateFormat(t *testing.T) {
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{"yyyy-mm-dd", true},
+		{"h:mm AM/PM", true},
+		{"[$-409]mmmm d, yyyy", true},
+		{"0.00", false},
+		{"#,##0", false},
+		{"[Red]#,##0.00", false},
+		{`0.0"days"`, false},
+		{`0.0\h`, false},
+		{"@", false},
+	}
+
+	for _, tt := range tests {
+		if got := isDateFormat(tt.code); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package xlsx
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Most rows a sheet can hold
+const MaxRows = 1048576
+
+// Most characters a cell can hold
+const MaxCellLength = 32767
+
+// Parts of a single sheet workbook other than the sheet itself
+var workbookParts = []struct {
+	name    string
+	content string
+}{
+	{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+		`</Relationships>`},
+	// Style 1 formats date/time cells
+	{"xl/styles.xml", xml.Header + `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<numFmts count="1"><numFmt numFmtId="164" formatCode="yyyy-mm-dd hh:mm:ss"/></numFmts>` +
+		`<fonts count="1"><font/></fonts>` +
+		`<fills count="1"><fill/></fills>` +
+		`<borders count="1"><border/></borders>` +
+		`<cellStyleXfs count="1"><xf/></cellStyleXfs>` +
+		`<cellXfs count="2"><xf/><xf numFmtId="164" applyNumberFormat="1"/></cellXfs>` +
+		`</styleSheet>`},
+}
+
+// Writes a workbook of a single sheet a row at a time, so rows are never held
+// in memory
+type Writer struct {
+	zip   *zip.Writer
+	sheet *bufio.Writer
+	rows  int
+}
+
+// Starts a workbook with a sheet of the given name
+func NewWriter(w io.Writer, sheet string) (*Writer, error) {
+	z := zip.NewWriter(w)
+
+	for _, part := range workbookParts {
+		f, err := z.Create(part.name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = io.WriteString(f, part.content)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := z.Create("xl/workbook.xml")
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = fmt.Fprintf(f, `%s<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="%s">`+
+		`<sheets><sheet name="%s" sheetId="1" r:id="rId1"/></sheets></workbook>`, xml.Header, relationshipsNS, escape(sheetName(sheet)))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The sheet is the last part, left open for rows
+	f, err = z.Create("xl/worksheets/sheet1.xml")
+
+	if err != nil {
+		return nil, err
+	}
+
+	wr := &Writer{zip: z, sheet: bufio.NewWriter(f)}
+
+	_, err = wr.sheet.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return wr, nil
+}
+
+// Writes a row of the sheet. Values may be strings, numbers, json.Number,
+// bool, time.Time, or nil for an empty cell.
+func (w *Writer) WriteRow(values []interface{}) error {
+	if w.rows == MaxRows {
+		return fmt.Errorf("a sheet holds at most %d rows", MaxRows)
+	}
+
+	w.rows++
+
+	fmt.Fprintf(w.sheet, `<row r="%d">`, w.rows)
+
+	for i, v := range values {
+		ref := columnName(i) + strconv.Itoa(w.rows)
+
+		switch v := v.(type) {
+		case nil:
+			continue
+		case bool:
+			b := 0
+
+			if v {
+				b = 1
+			}
+
+			fmt.Fprintf(w.sheet, `<c r="%s" t="b"><v>%d</v></c>`, ref, b)
+		case time.Time:
+			fmt.Fprintf(w.sheet, `<c r="%s" s="1"><v>%s</v></c>`, ref, strconv.FormatFloat(timeToSerial(v), 'f', -1, 64))
+		case string:
+			writeString(w.sheet, ref, v)
+		default:
+			n, ok := number(v)
+
+			if !ok {
+				writeString(w.sheet, ref, fmt.Sprint(v))
+				continue
+			}
+
+			fmt.Fprintf(w.sheet, `<c r="%s"><v>%s</v></c>`, ref, n)
+		}
+	}
+
+	_, err := w.sheet.WriteString(`</row>`)
+
+	return err
+}
+
+// Ends the sheet and the workbook. The underlying writer is not closed.
+func (w *Writer) Close() error {
+	_, err := w.sheet.WriteString(`</sheetData></worksheet>`)
+
+	if err != nil {
+		return err
+	}
+
+	err = w.sheet.Flush()
+
+	if err != nil {
+		return err
+	}
+
+	return w.zip.Close()
+}
+
+func writeString(w *bufio.Writer, ref string, s string) {
+	if runes := []rune(s); len(runes) > MaxCellLength {
+		s = string(runes[:MaxCellLength])
+	}
+
+	fmt.Fprintf(w, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, ref, escape(s))
+}
+
+// Formats a finite number as cell text
+func number(v interface{}) (string, bool) {
+	var f float64
+
+	switch n := v.(type) {
+	case json.Number:
+		f, err := n.Float64()
+
+		if err != nil || math.IsInf(f, 0) {
+			return "", false
+		}
+
+		return n.String(), true
+	case float64:
+		f = n
+	case float32:
+		f = float64(n)
+	case int:
+		return strconv.Itoa(n), true
+	case int64:
+		return strconv.FormatInt(n, 10), true
+	default:
+		return "", false
+	}
+
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return "", false
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64), true
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+
+	return b.String()
+}
+
+// Makes a valid sheet name, at most 31 characters without []:*?/\
+func sheetName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '_'
+		}
+
+		return r
+	}, name)
+
+	if runes := []rune(name); len(runes) > 31 {
+		name = string(runes[:31])
+	}
+
+	if strings.TrimSpace(name) == "" {
+		return "Sheet1"
+	}
+
+	return name
+}
+
+// Converts a zero based column index to its letters, such as 27 to "AB"
+func columnName(i int) string {
+	name := ""
+
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+
+	return name
+}
+
+// Converts a time to a serial date in the 1900 date system
+func timeToSerial(t time.Time) float64 {
+	epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	seconds := float64(t.Unix()-epoch.Unix()) + float64(t.Nanosecond())/1e9
+
+	return seconds / 86400
+}
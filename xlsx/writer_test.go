@@ -0,0 +1,157 @@
+package xlsx
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriterRoundTrip(t *testing.T) {
+	day := time.Date(2021, 6, 7, 8, 9, 10, 500e6, time.UTC)
+	long := strings.Repeat("x", MaxCellLength+10)
+
+	rows := [][]interface{}{
+		{"name", "count", "price", "paid", "when"},
+		{"a & <b>", 3, 1.25, true, day},
+		{" padded ", int64(-4), json.Number("1e3"), false, nil},
+		{nil, float32(0.5), math.Inf(1), nil, "2021"},
+		{long},
+	}
+
+	want := [][]interface{}{
+		{"name", "count", "price", "paid", "when"},
+		{"a & <b>", 3.0, 1.25, true, day},
+		{" padded ", -4.0, 1000.0, false},
+		{nil, 0.5, "+Inf", nil, "2021"},
+		{long[:MaxCellLength]},
+	}
+
+	var buf bytes.Buffer
+
+	w, err := NewWriter(&buf, "Q1: sales/returns [draft] for the whole year")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, row := range rows {
+		if err := w.WriteRow(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsWorkbook(bytes.NewReader(buf.Bytes()), int64(buf.Len())) {
+		t.Fatal("not a workbook")
+	}
+
+	wb, err := Open(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sheet := "Q1_ sales_returns _draft_ for t"
+
+	if names := wb.SheetNames(); !reflect.DeepEqual(names, []string{sheet}) {
+		t.Fatalf("got sheets %q", names)
+	}
+
+	r, err := wb.Rows(sheet)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	for i, want := range want {
+		got, err := r.Next()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("row %d: got %v, want %v", i+1, got, want)
+		}
+
+		if r.Number() != i+1 {
+			t.Errorf("row %d: got number %d", i+1, r.Number())
+		}
+	}
+
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+}
+
+func TestColumnName(t *testing.T) {
+	tests := []struct {
+		index int
+		want  string
+	}{
+		{0, "A"},
+		{25, "Z"},
+		{26, "AA"},
+		{27, "AB"},
+		{701, "ZZ"},
+		{702, "AAA"},
+		{16383, "XFD"},
+	}
+
+	for _, tt := range tests {
+		if got := columnName(tt.index); got != tt.want {
+			t.Errorf("%d: got %s, want %s", tt.index, got, tt.want)
+		}
+
+		if got, err := columnIndex(tt.want + "7"); err != nil || got != tt.index {
+			t.Errorf("%s: got %d, %v, want %d", tt.want, got, err, tt.index)
+		}
+	}
+}
+
+func TestSheetName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Sales", "Sales"},
+		{"", "Sheet1"},
+		{"   ", "Sheet1"},
+		{`a/b\c?d*e[f]g:h`, "a_b_c_d_e_f_g_h"},
+		{strings.Repeat("é", 40), strings.Repeat("é", 31)},
+	}
+
+	for _, tt := range tests {
+		if got := sheetName(tt.name); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTimeToSerial(t *testing.T) {
+	tests := []struct {
+		time time.Time
+		want float64
+	}{
+		{time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC), 0},
+		{time.Date(1900, 3, 1, 0, 0, 0, 0, time.UTC), 61},
+		{time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC), 43831.5},
+		{time.Date(2020, 1, 1, 12, 0, 0, 0, time.FixedZone("", 3600)), 43831.5},
+	}
+
+	for _, tt := range tests {
+		if got := timeToSerial(tt.time); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.time, got, tt.want)
+		}
+	}
+}